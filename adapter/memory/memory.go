@@ -25,8 +25,17 @@ SOFTWARE.
 package memory
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"regexp"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/victorspringer/http-cache"
@@ -47,6 +56,16 @@ const (
 
 	// MFU is the constant for Most Frequently Used.
 	MFU Algorithm = "MFU"
+
+	// NearestExpiry is the constant for the response expiring the soonest,
+	// which is the closest to be released anyway.
+	NearestExpiry Algorithm = "NEAREST-EXPIRY"
+
+	// WTinyLFU is the constant for Window TinyLFU, which combines recency
+	// and frequency: Get tracks them in the adapter itself, estimating the
+	// frequency of keys with a count-min sketch, including missing ones. It
+	// requires the capacity to be split among shards.
+	WTinyLFU Algorithm = "W-TINYLFU"
 )
 
 // Config contains the memory adapter configuration parameters.
@@ -56,62 +75,514 @@ type Config struct {
 
 	// Algorithm is the approach used to select a cached
 	// response to be evicted when the capacity is reached.
+	// Expired responses are evicted first, whatever the algorithm.
 	Algorithm Algorithm
+
+	// Shards is the number of partitions of the store, each with its own
+	// lock, so that unrelated keys do not contend. Unless GlobalCapacity
+	// is set, the capacity is split evenly among them and responses are
+	// evicted within their partition. Defaults to 1. Optional setting.
+	Shards int
+
+	// GlobalCapacity enforces the capacity over every shard together,
+	// instead of splitting it among them, so that a busy shard does not
+	// evict while others have room. The response to evict is then picked
+	// among a few sampled across shards, as Redis does, which approximates
+	// the algorithm. Optional setting.
+	GlobalCapacity bool
+
+	// Deduplicate stores identical response bodies only once, shared by
+	// every key they are cached for. It saves memory when many URLs or Vary
+	// variants yield the same body, at the cost of re-encoding responses on
+	// Get. Bodies are matched by their ETag when headers are stored.
+	Deduplicate bool
+
+	// OnEvict is called with every response evicted to make room for
+	// another, e.g. to write it back to a slower tier. It is called after
+	// the adapter is unlocked, so it may use the adapter. Optional setting.
+	OnEvict func(key uint64, r cache.Response)
 }
 
+// evictionSamples is the number of responses sampled across shards to pick
+// the one to evict, when the capacity is global.
+const evictionSamples = 5
+
 // Adapter is the memory adapter data structure.
 type Adapter struct {
+	// count is the number of responses cached or about to be, when the
+	// capacity is global. It is first to be 64-bit aligned for atomics.
+	count int64
+
+	capacity    int
+	global      bool
+	algorithm   Algorithm
+	shards      []*shard
+	deduplicate bool
+	bodies      *bodies
+	onEvict     func(uint64, cache.Response)
+}
+
+// shard is a partition of the store, holding the keys equal to its index
+// modulo the number of shards.
+type shard struct {
 	sync.Mutex
-	capacity  int
-	algorithm Algorithm
-	store     map[uint64][]byte
+	capacity    int
+	store       map[uint64][]byte
+	expirations map[uint64]time.Time
+	keyBodies   map[uint64]uint64
+	lfu         *tinyLFU
+}
+
+// bodies are the response bodies shared among every shard, by hash.
+type bodies struct {
+	sync.Mutex
+	values map[uint64]*body
+}
+
+// body is a response body shared by several keys, identified by its hash.
+type body struct {
+	value []byte
+	refs  int
+}
+
+// value returns the shared body of a hash.
+func (b *bodies) value(h uint64) []byte {
+	b.Lock()
+	defer b.Unlock()
+
+	if v, ok := b.values[h]; ok {
+		return v.value
+	}
+	return nil
+}
+
+// shard returns the shard holding a key.
+func (a *Adapter) shard(key uint64) *shard {
+	return a.shards[key%uint64(len(a.shards))]
 }
 
 // Get implements the cache Adapter interface Get method.
 func (a *Adapter) Get(key uint64) ([]byte, bool) {
-	if response, ok := a.store[key]; ok {
-		return response, true
+	s := a.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lfu != nil {
+		s.lfu.access(key)
+	}
+
+	return a.load(s, key)
+}
+
+// GetMeta implements the cache MetaAdapter interface GetMeta method.
+func (a *Adapter) GetMeta(key uint64) ([]byte, time.Time, bool) {
+	s := a.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lfu != nil {
+		s.lfu.access(key)
 	}
 
-	return nil, false
+	response, ok := a.load(s, key)
+	return response, s.expirations[key], ok
+}
+
+// load returns the response of a key from its locked shard, with its body.
+func (a *Adapter) load(s *shard, key uint64) ([]byte, bool) {
+	response, ok := s.store[key]
+	if !ok {
+		return nil, false
+	}
+	if h, ok := s.keyBodies[key]; ok {
+		r := cache.BytesToResponse(response)
+		r.Value = a.bodies.value(h)
+		response = r.Bytes()
+	}
+
+	return response, true
 }
 
 // Set implements the cache Adapter interface Set method.
 func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
-	if len(a.store) == a.capacity {
-		k := make(chan uint64, 1)
-		go a.evict(k)
-		a.Release(<-k)
+	s := a.shard(key)
+
+	reserved := false
+	if a.global {
+		s.Lock()
+		_, ok := s.store[key]
+		s.Unlock()
+		if !ok {
+			a.reserve()
+			reserved = true
+		}
+	}
+
+	s.Lock()
+
+	var evictedKey uint64
+	var evicted []byte
+	if _, ok := s.store[key]; ok {
+		if reserved {
+			atomic.AddInt64(&a.count, -1)
+		}
+	} else {
+		if !a.global && len(s.store) >= s.capacity {
+			evictedKey = s.evict(a.algorithm)
+			if a.onEvict != nil {
+				evicted, _ = a.load(s, evictedKey)
+			}
+			a.remove(s, evictedKey)
+		}
+		if s.lfu != nil {
+			s.lfu.add(key)
+		}
+	}
+	if a.deduplicate {
+		response = a.share(s, key, response)
+	}
+	s.store[key] = response
+	if s.expirations == nil {
+		s.expirations = make(map[uint64]time.Time)
+	}
+	s.expirations[key] = expiration
+	s.Unlock()
+
+	if evicted != nil {
+		a.onEvict(evictedKey, cache.BytesToResponse(evicted))
+	}
+}
+
+// reserve takes a slot of the global capacity for a new response, evicting
+// others until one is free.
+func (a *Adapter) reserve() {
+	for {
+		n := atomic.LoadInt64(&a.count)
+		if n < int64(a.capacity) {
+			if atomic.CompareAndSwapInt64(&a.count, n, n+1) {
+				return
+			}
+			continue
+		}
+
+		a.evictSampled()
+	}
+}
+
+// evictSampled evicts the response the algorithm prefers among a few sampled
+// across shards. Shards are locked one at a time, so that concurrent evictions
+// do not deadlock.
+func (a *Adapter) evictSampled() {
+	var victim *shard
+	var victimKey uint64
+	var victimResponse cache.Response
+	now := time.Now()
+	expired := false
+	for i := 0; i < evictionSamples && !expired; i++ {
+		s := a.shards[rand.Intn(len(a.shards))]
+		s.Lock()
+		for k, v := range s.store {
+			r := cache.BytesToResponse(v)
+			if expired = s.expired(k, now); expired || victim == nil || evictsFirst(a.algorithm, r, victimResponse) {
+				victim, victimKey, victimResponse = s, k, r
+			}
+			break
+		}
+		s.Unlock()
+	}
+	if victim == nil {
+		// Every slot is reserved by a response not cached yet.
+		runtime.Gosched()
+		return
+	}
+
+	victim.Lock()
+	var evicted []byte
+	if _, ok := victim.store[victimKey]; ok {
+		if a.onEvict != nil {
+			evicted, _ = a.load(victim, victimKey)
+		}
+		a.remove(victim, victimKey)
+	}
+	victim.Unlock()
+
+	if evicted != nil {
+		a.onEvict(victimKey, cache.BytesToResponse(evicted))
+	}
+}
+
+// evictsFirst reports whether the algorithm evicts a response before another.
+func evictsFirst(algorithm Algorithm, r, other cache.Response) bool {
+	switch algorithm {
+	case LRU:
+		return r.LastAccess.Before(other.LastAccess)
+	case MRU:
+		return r.LastAccess.After(other.LastAccess)
+	case LFU:
+		return r.Frequency < other.Frequency
+	case MFU:
+		return r.Frequency > other.Frequency
+	case NearestExpiry:
+		return r.Expiration.Before(other.Expiration)
+	}
+
+	return false
+}
+
+// share stores the body of a response among the shared bodies and returns
+// the response without it. Bodies are identified by their strong ETag when
+// stored, so variants of a resource share one body without hashing it, or by
+// their content hash otherwise. Bodies colliding with a different one of the
+// same identity are not shared.
+func (a *Adapter) share(s *shard, key uint64, response []byte) []byte {
+	a.unshare(s, key)
+
+	r := cache.BytesToResponse(response)
+	hash := fnv.New64a()
+	if etag := r.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		hash.Write([]byte("etag:" + etag))
+	} else {
+		hash.Write(r.Value)
+	}
+	h := hash.Sum64()
+
+	a.bodies.Lock()
+	defer a.bodies.Unlock()
+
+	b, ok := a.bodies.values[h]
+	if !ok {
+		b = &body{value: r.Value}
+		a.bodies.values[h] = b
+	} else if !bytes.Equal(b.value, r.Value) {
+		return response
+	}
+	b.refs++
+	s.keyBodies[key] = h
+
+	r.Value = nil
+	return r.Bytes()
+}
+
+// unshare drops the reference of a key to its shared body, if any.
+func (a *Adapter) unshare(s *shard, key uint64) {
+	h, ok := s.keyBodies[key]
+	if !ok {
+		return
+	}
+	delete(s.keyBodies, key)
+
+	a.bodies.Lock()
+	defer a.bodies.Unlock()
+
+	if b := a.bodies.values[h]; b.refs > 1 {
+		b.refs--
+	} else {
+		delete(a.bodies.values, h)
+	}
+}
+
+// remove deletes a key from its locked shard.
+func (a *Adapter) remove(s *shard, key uint64) {
+	if _, ok := s.store[key]; ok {
+		delete(s.store, key)
+		delete(s.expirations, key)
+		a.unshare(s, key)
+		if s.lfu != nil {
+			s.lfu.remove(key)
+		}
+		if a.global {
+			atomic.AddInt64(&a.count, -1)
+		}
+	}
+}
+
+// Entries returns a snapshot of the cached responses by key.
+func (a *Adapter) Entries() map[uint64]cache.Response {
+	entries := make(map[uint64]cache.Response)
+	for _, s := range a.shards {
+		s.Lock()
+		for k, v := range s.store {
+			r := cache.BytesToResponse(v)
+			if h, ok := s.keyBodies[k]; ok {
+				r.Value = a.bodies.value(h)
+			}
+			entries[k] = r
+		}
+		s.Unlock()
+	}
+
+	return entries
+}
+
+// PruneFunc releases every cached response for which prune returns true and
+// returns the number of responses released. The adapter is locked while prune
+// is called, so it must not use the adapter.
+func (a *Adapter) PruneFunc(prune func(key uint64, r cache.Response) bool) int {
+	count := 0
+	for _, s := range a.shards {
+		s.Lock()
+		for k := range s.store {
+			b, _ := a.load(s, k)
+			if prune(k, cache.BytesToResponse(b)) {
+				a.remove(s, k)
+				count++
+			}
+		}
+		s.Unlock()
+	}
+
+	return count
+}
+
+// PurgeMatching releases every cached response whose URL matches re and
+// returns the number of responses released. URLs are the canonical ones of
+// the requests, e.g. /api/v1/users?page=2 for server requests, stored only
+// with the StoreRequestURL setting of the client. Every cached response is
+// decoded and matched, so it takes time proportional to their number.
+func (a *Adapter) PurgeMatching(re *regexp.Regexp) int {
+	return a.PruneFunc(func(key uint64, r cache.Response) bool {
+		return r.URL != "" && re.MatchString(r.URL)
+	})
+}
+
+// snapshotEntry is a cached response as written by Snapshot, along with the
+// expiration date it was set with.
+type snapshotEntry struct {
+	Key        uint64
+	Response   []byte
+	Expiration time.Time
+}
+
+// expiration returns the date past which the entry is dropped: the one it was
+// set with, which covers the stale windows of the response, or else the
+// expiration of the response, e.g. for snapshots written without the former.
+func (e snapshotEntry) expiration() time.Time {
+	if !e.Expiration.IsZero() {
+		return e.Expiration
 	}
 
-	a.Lock()
-	a.store[key] = response
-	a.Unlock()
+	return cache.BytesToResponse(e.Response).Expiration
+}
+
+// Snapshot writes every unexpired cached response to w, to be loaded back
+// with Restore, e.g. to keep the cache warm across restarts. Responses still
+// within their stale-while-revalidate or stale-if-error window are kept.
+func (a *Adapter) Snapshot(w io.Writer) error {
+	now := time.Now()
+	var entries []snapshotEntry
+	for _, s := range a.shards {
+		s.Lock()
+		for k := range s.store {
+			b, _ := a.load(s, k)
+			e := snapshotEntry{Key: k, Response: b, Expiration: s.expirations[k]}
+			if e.expiration().After(now) {
+				entries = append(entries, e)
+			}
+		}
+		s.Unlock()
+	}
+
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+// Restore caches the responses of a snapshot read from r, dropping the ones
+// expired since it was written. Responses are evicted as by Set to make room.
+func (a *Adapter) Restore(r io.Reader) error {
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if expiration := e.expiration(); expiration.After(now) {
+			a.Set(e.Key, e.Response, expiration)
+		}
+	}
+
+	return nil
 }
 
 // Release implements the Adapter interface Release method.
 func (a *Adapter) Release(key uint64) {
-	if _, ok := a.store[key]; ok {
-		a.Lock()
-		delete(a.store, key)
-		a.Unlock()
+	s := a.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	a.remove(s, key)
+}
+
+// ReleaseAfter implements the cache DelayedReleaseAdapter interface
+// ReleaseAfter method. The response cached for the key when d elapsed is
+// freed, even if it was set again meanwhile.
+func (a *Adapter) ReleaseAfter(key uint64, d time.Duration) {
+	time.AfterFunc(d, func() {
+		a.Release(key)
+	})
+}
+
+// Flush implements the cache FlushableAdapter interface Flush method.
+func (a *Adapter) Flush() {
+	for _, s := range a.shards {
+		s.Lock()
+		defer s.Unlock()
+	}
+
+	for _, s := range a.shards {
+		if a.global {
+			atomic.AddInt64(&a.count, -int64(len(s.store)))
+		}
+		s.store = make(map[uint64][]byte, s.capacity)
+		s.expirations = nil
+		if s.lfu != nil {
+			s.lfu = newTinyLFU(s.capacity)
+		}
+		if a.deduplicate {
+			s.keyBodies = make(map[uint64]uint64)
+		}
+	}
+	if a.deduplicate {
+		a.bodies.Lock()
+		a.bodies.values = make(map[uint64]*body)
+		a.bodies.Unlock()
 	}
 }
 
-func (a *Adapter) evict(key chan uint64) {
+// expired reports whether the response of a key in the locked shard expired.
+func (s *shard) expired(key uint64, now time.Time) bool {
+	expiration, ok := s.expirations[key]
+	return ok && !expiration.IsZero() && !expiration.After(now)
+}
+
+// evict returns the key of the response to be evicted from the locked shard,
+// preferring an expired one over the choice of the algorithm.
+func (s *shard) evict(algorithm Algorithm) uint64 {
+	now := time.Now()
+	for k := range s.expirations {
+		if s.expired(k, now) {
+			return k
+		}
+	}
+
+	if algorithm == WTinyLFU && s.lfu != nil {
+		return s.lfu.victim()
+	}
+
 	selectedKey := uint64(0)
-	lastAccess := time.Now()
+	lastAccess := now
 	frequency := 9999999999999
+	var expiration time.Time
+	selected := false
 
-	if a.algorithm == MRU {
+	if algorithm == MRU {
 		lastAccess = time.Time{}
-	} else if a.algorithm == MFU {
+	} else if algorithm == MFU {
 		frequency = 0
 	}
 
-	for k, v := range a.store {
+	for k, v := range s.store {
 		r := cache.BytesToResponse(v)
-		switch a.algorithm {
+		switch algorithm {
 		case LRU:
 			if r.LastAccess.Before(lastAccess) {
 				selectedKey = k
@@ -133,10 +604,16 @@ func (a *Adapter) evict(key chan uint64) {
 				selectedKey = k
 				frequency = r.Frequency
 			}
+		case NearestExpiry:
+			if !selected || r.Expiration.Before(expiration) {
+				selectedKey = k
+				expiration = r.Expiration
+				selected = true
+			}
 		}
 	}
 
-	key <- selectedKey
+	return selectedKey
 }
 
 // NewAdapter initializes memory adapter.
@@ -149,10 +626,45 @@ func NewAdapter(cfg *Config) (cache.Adapter, error) {
 		return nil, errors.New("memory adapter requires a caching algorithm")
 	}
 
-	return &Adapter{
-		sync.Mutex{},
-		cfg.Capacity,
-		cfg.Algorithm,
-		make(map[uint64][]byte, cfg.Capacity),
-	}, nil
+	if cfg.Algorithm == WTinyLFU && cfg.GlobalCapacity {
+		return nil, errors.New("memory adapter requires a capacity split among shards for W-TinyLFU")
+	}
+
+	shards := cfg.Shards
+	if shards < 0 || shards > cfg.Capacity {
+		return nil, errors.New("memory adapter requires a number of shards between one and the capacity")
+	}
+	if shards == 0 {
+		shards = 1
+	}
+
+	a := &Adapter{
+		capacity:  cfg.Capacity,
+		global:    cfg.GlobalCapacity,
+		algorithm: cfg.Algorithm,
+		shards:    make([]*shard, shards),
+		onEvict:   cfg.OnEvict,
+	}
+	for i := range a.shards {
+		capacity := cfg.Capacity / shards
+		if i < cfg.Capacity%shards {
+			capacity++
+		}
+		a.shards[i] = &shard{
+			capacity: capacity,
+			store:    make(map[uint64][]byte, capacity),
+		}
+		if cfg.Deduplicate {
+			a.shards[i].keyBodies = make(map[uint64]uint64)
+		}
+		if cfg.Algorithm == WTinyLFU {
+			a.shards[i].lfu = newTinyLFU(capacity)
+		}
+	}
+	if cfg.Deduplicate {
+		a.deduplicate = true
+		a.bodies = &bodies{values: make(map[uint64]*body)}
+	}
+
+	return a, nil
 }
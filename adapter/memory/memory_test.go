@@ -1,8 +1,17 @@
 package memory
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,17 +20,19 @@ import (
 
 func TestGet(t *testing.T) {
 	a := &Adapter{
-		sync.Mutex{},
-		2,
-		LRU,
-		map[uint64][]byte{
-			14974843192121052621: cache.Response{
-				Value:      []byte("value 1"),
-				Expiration: time.Now(),
-				LastAccess: time.Now(),
-				Frequency:  1,
-			}.Bytes(),
-		},
+		capacity:  2,
+		algorithm: LRU,
+		shards: []*shard{{
+			capacity: 2,
+			store: map[uint64][]byte{
+				14974843192121052621: cache.Response{
+					Value:      []byte("value 1"),
+					Expiration: time.Now(),
+					LastAccess: time.Now(),
+					Frequency:  1,
+				}.Bytes(),
+			},
+		}},
 	}
 
 	tests := []struct {
@@ -60,10 +71,12 @@ func TestGet(t *testing.T) {
 
 func TestSet(t *testing.T) {
 	a := &Adapter{
-		sync.Mutex{},
-		2,
-		LRU,
-		make(map[uint64][]byte),
+		capacity:  2,
+		algorithm: LRU,
+		shards: []*shard{{
+			capacity: 2,
+			store:    make(map[uint64][]byte),
+		}},
 	}
 
 	tests := []struct {
@@ -99,7 +112,7 @@ func TestSet(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a.Set(tt.key, tt.response.Bytes(), tt.response.Expiration)
-			if cache.BytesToResponse(a.store[tt.key]).Value == nil {
+			if cache.BytesToResponse(a.shards[0].store[tt.key]).Value == nil {
 				t.Errorf(
 					"memory.Set() error = store[%v] response is not %s", tt.key, tt.response.Value,
 				)
@@ -108,26 +121,342 @@ func TestSet(t *testing.T) {
 	}
 }
 
-func TestRelease(t *testing.T) {
+func TestGetMeta(t *testing.T) {
+	a, _ := NewAdapter(&Config{Capacity: 2, Algorithm: LRU})
+	expiration := time.Now().Add(1 * time.Minute)
+	a.Set(1, cache.Response{Value: []byte("value 1")}.Bytes(), expiration)
+
+	b, got, ok := a.(*Adapter).GetMeta(1)
+	if !ok || !got.Equal(expiration) || string(cache.BytesToResponse(b).Value) != "value 1" {
+		t.Errorf("memory.GetMeta() = %v %v, want %v true", got, ok, expiration)
+	}
+
+	a.Release(1)
+	if _, got, ok := a.(*Adapter).GetMeta(1); ok || !got.IsZero() {
+		t.Errorf("memory.GetMeta() = %v %v after release, want zero false", got, ok)
+	}
+}
+
+func TestEntries(t *testing.T) {
 	a := &Adapter{
-		sync.Mutex{},
-		2,
-		LRU,
-		map[uint64][]byte{
-			14974843192121052621: cache.Response{
-				Expiration: time.Now().Add(1 * time.Minute),
-				Value:      []byte("value 1"),
-			}.Bytes(),
-			14974839893586167988: cache.Response{
-				Expiration: time.Now(),
-				Value:      []byte("value 2"),
-			}.Bytes(),
-			14974840993097796199: cache.Response{
-				Expiration: time.Now(),
-				Value:      []byte("value 3"),
-			}.Bytes(),
+		capacity:  2,
+		algorithm: LRU,
+		shards: []*shard{{
+			capacity: 2,
+			store: map[uint64][]byte{
+				14974843192121052621: cache.Response{
+					Value: []byte("value 1"),
+					URL:   "http://foo.bar/test-1",
+				}.Bytes(),
+				14974839893586167988: cache.Response{
+					Value: []byte("value 2"),
+					URL:   "http://foo.bar/test-2",
+				}.Bytes(),
+			},
+		}},
+	}
+
+	want := map[uint64]string{
+		14974843192121052621: "http://foo.bar/test-1",
+		14974839893586167988: "http://foo.bar/test-2",
+	}
+
+	got := a.Entries()
+	if len(got) != len(want) {
+		t.Errorf("memory.Entries() length = %v, want %v", len(got), len(want))
+		return
+	}
+	for k, url := range want {
+		if got[k].URL != url {
+			t.Errorf("memory.Entries()[%v].URL = %v, want %v", k, got[k].URL, url)
+		}
+	}
+}
+
+func TestPruneFunc(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:    8,
+		Algorithm:   LRU,
+		Shards:      2,
+		Deduplicate: true,
+	})
+	m := a.(*Adapter)
+
+	exp := time.Now().Add(1 * time.Minute)
+	urls := map[uint64]string{
+		1: "http://foo.bar/beta/a",
+		2: "http://foo.bar/beta/b",
+		3: "http://foo.bar/a",
+		4: "http://foo.bar/b",
+	}
+	for k, url := range urls {
+		m.Set(k, cache.Response{Value: []byte("value"), URL: url}.Bytes(), exp)
+	}
+
+	tests := []struct {
+		name      string
+		prefix    string
+		wantCount int
+		wantKeys  []uint64
+	}{
+		{
+			"prunes matching entries",
+			"http://foo.bar/beta",
+			2,
+			[]uint64{3, 4},
+		},
+		{
+			"prunes nothing when nothing matches",
+			"http://foo.bar/beta",
+			0,
+			[]uint64{3, 4},
+		},
+		{
+			"prunes every entry",
+			"http://foo.bar/",
+			2,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count := m.PruneFunc(func(key uint64, r cache.Response) bool {
+				return strings.HasPrefix(r.URL, tt.prefix) && string(r.Value) == "value"
+			})
+			if count != tt.wantCount {
+				t.Errorf("memory.PruneFunc() = %v, want %v", count, tt.wantCount)
+			}
+
+			entries := m.Entries()
+			if len(entries) != len(tt.wantKeys) {
+				t.Errorf("memory.Entries() length = %v, want %v", len(entries), len(tt.wantKeys))
+			}
+			for _, k := range tt.wantKeys {
+				if _, ok := entries[k]; !ok {
+					t.Errorf("memory.PruneFunc() pruned key %v", k)
+				}
+			}
+		})
+	}
+
+	if len(m.bodies.values) != 0 {
+		t.Errorf("memory.PruneFunc() bodies = %v, want 0", len(m.bodies.values))
+	}
+}
+
+func TestPurgeMatching(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:  8,
+		Algorithm: LRU,
+		Shards:    2,
+	})
+	m := a.(*Adapter)
+
+	exp := time.Now().Add(1 * time.Minute)
+	urls := map[uint64]string{
+		1: "/api/v1/users",
+		2: "/api/v1/users?page=2",
+		3: "/api/v2/users",
+		4: "/static/api/v1/app.js",
+		5: "",
+	}
+	for k, url := range urls {
+		m.Set(k, cache.Response{Value: []byte("value"), URL: url}.Bytes(), exp)
+	}
+
+	tests := []struct {
+		name      string
+		re        string
+		wantCount int
+		wantKeys  []uint64
+	}{
+		{
+			"purges matching entries",
+			"^/api/v1/.*",
+			2,
+			[]uint64{3, 4, 5},
+		},
+		{
+			"purges nothing when nothing matches",
+			"^/api/v1/.*",
+			0,
+			[]uint64{3, 4, 5},
+		},
+		{
+			"keeps entries without url",
+			".*",
+			2,
+			[]uint64{5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if count := m.PurgeMatching(regexp.MustCompile(tt.re)); count != tt.wantCount {
+				t.Errorf("memory.PurgeMatching() = %v, want %v", count, tt.wantCount)
+			}
+
+			entries := m.Entries()
+			if len(entries) != len(tt.wantKeys) {
+				t.Errorf("memory.Entries() length = %v, want %v", len(entries), len(tt.wantKeys))
+			}
+			for _, k := range tt.wantKeys {
+				if _, ok := entries[k]; !ok {
+					t.Errorf("memory.PurgeMatching() purged key %v", k)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name        string
+		shards      int
+		deduplicate bool
+	}{
+		{
+			"restores live responses",
+			1,
+			false,
+		},
+		{
+			"restores live responses across shards with shared bodies",
+			2,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Capacity:    4,
+				Algorithm:   LRU,
+				Shards:      tt.shards,
+				Deduplicate: tt.deduplicate,
+			}
+			a, _ := NewAdapter(cfg)
+			for k, expiration := range map[uint64]time.Duration{
+				1: 1 * time.Minute,
+				2: 1 * time.Minute,
+				3: -1 * time.Minute,
+			} {
+				r := cache.Response{Value: []byte("value"), Expiration: time.Now().Add(expiration)}
+				a.Set(k, r.Bytes(), r.Expiration)
+			}
+			stale := cache.Response{Value: []byte("value"), Expiration: time.Now().Add(-1 * time.Minute)}
+			a.Set(4, stale.Bytes(), time.Now().Add(1*time.Minute))
+
+			var buf bytes.Buffer
+			if err := a.(*Adapter).Snapshot(&buf); err != nil {
+				t.Fatalf("memory.Snapshot() error = %v", err)
+			}
+			b, _ := NewAdapter(cfg)
+			if err := b.(*Adapter).Restore(&buf); err != nil {
+				t.Fatalf("memory.Restore() error = %v", err)
+			}
+
+			entries := b.(*Adapter).Entries()
+			if len(entries) != 3 {
+				t.Errorf("memory.Restore() entries = %v, want 3", len(entries))
+			}
+			for _, k := range []uint64{1, 2, 4} {
+				if got := string(entries[k].Value); got != "value" {
+					t.Errorf("memory.Restore() entry %v = %q, want value", k, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Duration
+		stored     time.Duration
+		wantOK     bool
+	}{
+		{
+			"restores unexpired response",
+			1 * time.Minute,
+			0,
+			true,
+		},
+		{
+			"drops response expired since the snapshot",
+			-1 * time.Minute,
+			0,
+			false,
+		},
+		{
+			"restores response within its stale window",
+			-1 * time.Minute,
+			1 * time.Minute,
+			true,
+		},
+		{
+			"drops response past its stored expiration",
+			1 * time.Minute,
+			-1 * time.Minute,
+			false,
 		},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored time.Time
+			if tt.stored != 0 {
+				stored = time.Now().Add(tt.stored)
+			}
+			var buf bytes.Buffer
+			gob.NewEncoder(&buf).Encode([]snapshotEntry{{
+				Key: 1,
+				Response: cache.Response{
+					Value:      []byte("value 1"),
+					Expiration: time.Now().Add(tt.expiration),
+				}.Bytes(),
+				Expiration: stored,
+			}})
+
+			a, _ := NewAdapter(&Config{Capacity: 2, Algorithm: LRU})
+			if err := a.(*Adapter).Restore(&buf); err != nil {
+				t.Fatalf("memory.Restore() error = %v", err)
+			}
+			_, expiration, ok := a.(*Adapter).GetMeta(1)
+			if ok != tt.wantOK {
+				t.Errorf("memory.Restore() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !stored.IsZero() && !expiration.Equal(stored) {
+				t.Errorf("memory.Restore() expiration = %v, want %v", expiration, stored)
+			}
+		})
+	}
+
+	a, _ := NewAdapter(&Config{Capacity: 2, Algorithm: LRU})
+	if err := a.(*Adapter).Restore(strings.NewReader("not a snapshot")); err == nil {
+		t.Error("memory.Restore() error = nil, want error")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	a := &Adapter{
+		capacity:  2,
+		algorithm: LRU,
+		shards: []*shard{{
+			capacity: 2,
+			store: map[uint64][]byte{
+				14974843192121052621: cache.Response{
+					Expiration: time.Now().Add(1 * time.Minute),
+					Value:      []byte("value 1"),
+				}.Bytes(),
+				14974839893586167988: cache.Response{
+					Expiration: time.Now(),
+					Value:      []byte("value 2"),
+				}.Bytes(),
+				14974840993097796199: cache.Response{
+					Expiration: time.Now(),
+					Value:      []byte("value 3"),
+				}.Bytes(),
+			},
+		}},
+	}
 
 	tests := []struct {
 		name        string
@@ -151,16 +480,458 @@ func TestRelease(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a.Release(tt.key)
-			if len(a.store) > tt.storeLength {
-				t.Errorf("memory.Release() error; store length = %v, want 0", len(a.store))
+			if len(a.shards[0].store) > tt.storeLength {
+				t.Errorf("memory.Release() error; store length = %v, want 0", len(a.shards[0].store))
 			}
 		})
 	}
 }
 
-func TestEvict(t *testing.T) {
-	k := make(chan uint64, 1)
+func TestReleaseAfter(t *testing.T) {
+	a, _ := NewAdapter(&Config{Capacity: 2, Algorithm: LRU})
+	a.Set(1, cache.Response{Value: []byte("value 1")}.Bytes(), time.Now().Add(1*time.Minute))
+
+	a.(*Adapter).ReleaseAfter(1, 50*time.Millisecond)
+	if _, ok := a.Get(1); !ok {
+		t.Error("memory.ReleaseAfter() released the response before the delay")
+	}
+
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		if _, ok := a.Get(1); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("memory.ReleaseAfter() did not release the response after the delay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:    4,
+		Algorithm:   LRU,
+		Deduplicate: true,
+	})
+	m := a.(*Adapter)
+
+	exp1 := time.Now().Add(1 * time.Minute).Round(0)
+	exp2 := time.Now().Add(2 * time.Minute).Round(0)
+	m.Set(1, cache.Response{Value: []byte("[]"), Expiration: exp1}.Bytes(), exp1)
+	m.Set(2, cache.Response{Value: []byte("[]"), Expiration: exp2}.Bytes(), exp2)
+	m.Set(3, cache.Response{Value: []byte("value 3"), Expiration: exp1}.Bytes(), exp1)
+
+	if len(m.bodies.values) != 2 {
+		t.Errorf("memory.Set() bodies = %v, want 2", len(m.bodies.values))
+	}
+
+	tests := []struct {
+		name           string
+		key            uint64
+		wantValue      string
+		wantExpiration time.Time
+	}{
+		{
+			"first key has its own expiration",
+			1,
+			"[]",
+			exp1,
+		},
+		{
+			"second key has its own expiration",
+			2,
+			"[]",
+			exp2,
+		},
+		{
+			"distinct body is kept",
+			3,
+			"value 3",
+			exp1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := m.Get(tt.key)
+			if !ok {
+				t.Error("memory.Get() ok = false, want true")
+				return
+			}
+			r := cache.BytesToResponse(b)
+			if string(r.Value) != tt.wantValue {
+				t.Errorf("memory.Get() Value = %v, want %v", string(r.Value), tt.wantValue)
+			}
+			if !r.Expiration.Equal(tt.wantExpiration) {
+				t.Errorf("memory.Get() Expiration = %v, want %v", r.Expiration, tt.wantExpiration)
+			}
+		})
+	}
+
+	m.Release(1)
+	if b, _ := m.Get(2); string(cache.BytesToResponse(b).Value) != "[]" {
+		t.Error("memory.Release() dropped a body still shared")
+	}
+	m.Release(2)
+	if len(m.bodies.values) != 1 {
+		t.Errorf("memory.Release() bodies = %v, want 1", len(m.bodies.values))
+	}
+}
+
+func TestDeduplicateETag(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:    4,
+		Algorithm:   LRU,
+		Deduplicate: true,
+	})
+	m := a.(*Adapter)
+
+	exp := time.Now().Add(1 * time.Minute)
+	variants := []http.Header{
+		{"Etag": []string{`"v1"`}, "Content-Language": []string{"en"}},
+		{"Etag": []string{`"v1"`}, "Content-Language": []string{"fr"}},
+	}
+	for i, h := range variants {
+		m.Set(uint64(i+1), cache.Response{Value: []byte("value"), Header: h}.Bytes(), exp)
+	}
+	m.Set(3, cache.Response{
+		Value:  []byte("other"),
+		Header: http.Header{"Etag": []string{`"v1"`}},
+	}.Bytes(), exp)
+
+	if len(m.bodies.values) != 1 {
+		t.Errorf("memory.Set() bodies = %v, want 1", len(m.bodies.values))
+	}
+
+	tests := []struct {
+		name         string
+		key          uint64
+		wantValue    string
+		wantLanguage string
+	}{
+		{
+			"first variant keeps its headers",
+			1,
+			"value",
+			"en",
+		},
+		{
+			"second variant keeps its headers",
+			2,
+			"value",
+			"fr",
+		},
+		{
+			"colliding etag keeps its own body",
+			3,
+			"other",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := m.Get(tt.key)
+			r := cache.BytesToResponse(b)
+			if string(r.Value) != tt.wantValue {
+				t.Errorf("memory.Get() Value = %v, want %v", string(r.Value), tt.wantValue)
+			}
+			if got := r.Header.Get("Content-Language"); got != tt.wantLanguage {
+				t.Errorf("memory.Get() Content-Language = %v, want %v", got, tt.wantLanguage)
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	a := &Adapter{
+		capacity:  2,
+		algorithm: LRU,
+		shards: []*shard{{
+			capacity: 2,
+			store: map[uint64][]byte{
+				14974843192121052621: cache.Response{Value: []byte("value 1")}.Bytes(),
+				14974839893586167988: cache.Response{Value: []byte("value 2")}.Bytes(),
+			},
+		}},
+	}
+
+	a.Flush()
+	if len(a.shards[0].store) != 0 {
+		t.Errorf("memory.Flush() store length = %v, want 0", len(a.shards[0].store))
+	}
+
+	a.Set(1, cache.Response{Value: []byte("value 1")}.Bytes(), time.Now().Add(1*time.Minute))
+	if _, ok := a.Get(1); !ok {
+		t.Error("memory.Set() after memory.Flush() did not store the response")
+	}
+
+	var _ cache.FlushableAdapter = a
+}
+
+func TestShards(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:  8,
+		Algorithm: LRU,
+		Shards:    4,
+	})
+	m := a.(*Adapter)
+
+	exp := time.Now().Add(1 * time.Minute)
+	for k := uint64(0); k < 8; k++ {
+		m.Set(k, cache.Response{
+			Value:      []byte("value"),
+			LastAccess: time.Now().Add(time.Duration(k) * time.Second),
+		}.Bytes(), exp)
+	}
+	m.Set(8, cache.Response{Value: []byte("value"), LastAccess: time.Now()}.Bytes(), exp)
+
+	tests := []struct {
+		name string
+		key  uint64
+		ok   bool
+	}{
+		{
+			"evicts the least recently used key of the shard",
+			0,
+			false,
+		},
+		{
+			"keeps the other key of the shard",
+			4,
+			true,
+		},
+		{
+			"keeps the new key",
+			8,
+			true,
+		},
+		{
+			"keeps keys of other shards",
+			1,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := m.Get(tt.key); ok != tt.ok {
+				t.Errorf("memory.Get() ok = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+
+	if got := len(m.Entries()); got != 8 {
+		t.Errorf("memory.Entries() length = %v, want 8", got)
+	}
+}
+
+func TestShardsConcurrency(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:    64,
+		Algorithm:   LRU,
+		Shards:      8,
+		Deduplicate: true,
+	})
+	m := a.(*Adapter)
+
+	var wg sync.WaitGroup
+	exp := time.Now().Add(1 * time.Minute)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := uint64(0); k < 256; k++ {
+				m.Set(k*uint64(i+1), cache.Response{Value: []byte("value")}.Bytes(), exp)
+				m.Get(k)
+				m.Release(k + 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries := m.Entries()
+	if len(entries) > 64 {
+		t.Errorf("memory.Entries() length = %v, want at most 64", len(entries))
+	}
+	for k, r := range entries {
+		if string(r.Value) != "value" {
+			t.Errorf("memory.Entries()[%v].Value = %v, want value", k, string(r.Value))
+		}
+	}
+}
+
+func TestGlobalCapacity(t *testing.T) {
+	tests := []struct {
+		name           string
+		globalCapacity bool
+		wantEntries    int
+	}{
+		{
+			"keeps the capacity for keys of one shard",
+			true,
+			8,
+		},
+		{
+			"keeps the capacity of the shard by default",
+			false,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := NewAdapter(&Config{
+				Capacity:       8,
+				Algorithm:      LRU,
+				Shards:         4,
+				GlobalCapacity: tt.globalCapacity,
+			})
+
+			exp := time.Now().Add(1 * time.Minute)
+			for k := uint64(0); k < 64; k += 4 {
+				a.Set(k, cache.Response{Value: []byte("value"), LastAccess: time.Now()}.Bytes(), exp)
+			}
+			if got := len(a.(*Adapter).Entries()); got != tt.wantEntries {
+				t.Errorf("memory.Entries() length = %v, want %v", got, tt.wantEntries)
+			}
+		})
+	}
+}
+
+func TestGlobalCapacityConcurrency(t *testing.T) {
+	var evictions int64
+	a, _ := NewAdapter(&Config{
+		Capacity:       16,
+		Algorithm:      LFU,
+		Shards:         4,
+		GlobalCapacity: true,
+		Deduplicate:    true,
+		OnEvict: func(key uint64, r cache.Response) {
+			atomic.AddInt64(&evictions, 1)
+		},
+	})
+	m := a.(*Adapter)
+
+	var wg sync.WaitGroup
+	exp := time.Now().Add(1 * time.Minute)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := uint64(0); k < 100; k++ {
+				m.Set(uint64(i)*1000+k, cache.Response{Value: []byte("value"), Frequency: int(k)}.Bytes(), exp)
+				if n := atomic.LoadInt64(&m.count); n > 16 {
+					t.Errorf("memory.Set() count = %v, want at most 16", n)
+				}
+				m.Release(uint64(i)*1000 + k/2)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries := len(m.Entries())
+	if entries > 16 || int64(entries) != atomic.LoadInt64(&m.count) {
+		t.Errorf("memory.Entries() length = %v, count = %v, want at most 16", entries, m.count)
+	}
+
+	m.Flush()
+	if m.count != 0 {
+		t.Errorf("memory.Flush() count = %v, want 0", m.count)
+	}
+}
+
+func TestEvictsFirst(t *testing.T) {
+	older := cache.Response{LastAccess: time.Now().Add(-1 * time.Minute), Frequency: 1, Expiration: time.Now().Add(1 * time.Minute)}
+	newer := cache.Response{LastAccess: time.Now(), Frequency: 2, Expiration: time.Now().Add(2 * time.Minute)}
+
+	tests := []struct {
+		name      string
+		algorithm Algorithm
+		want      bool
+	}{
+		{
+			"lru evicts the older response",
+			LRU,
+			true,
+		},
+		{
+			"mru evicts the newer response",
+			MRU,
+			false,
+		},
+		{
+			"lfu evicts the less frequent response",
+			LFU,
+			true,
+		},
+		{
+			"mfu evicts the more frequent response",
+			MFU,
+			false,
+		},
+		{
+			"nearest expiry evicts the response expiring first",
+			NearestExpiry,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evictsFirst(tt.algorithm, older, newer); got != tt.want {
+				t.Errorf("evictsFirst() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		a, _ := NewAdapter(&Config{
+			Capacity:  1024,
+			Algorithm: LRU,
+			Shards:    shards,
+		})
+		response := cache.Response{Value: []byte("value")}.Bytes()
+		exp := time.Now().Add(1 * time.Minute)
 
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				k := uint64(0)
+				for pb.Next() {
+					k++
+					a.Set(k%512, response, exp)
+					a.Get(k % 512)
+				}
+			})
+		})
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	evicted := map[uint64]string{}
+	var a cache.Adapter
+	a, _ = NewAdapter(&Config{
+		Capacity:  2,
+		Algorithm: LFU,
+		OnEvict: func(key uint64, r cache.Response) {
+			evicted[key] = string(r.Value)
+			a.Get(key)
+		},
+	})
+
+	exp := time.Now().Add(1 * time.Minute)
+	a.Set(1, cache.Response{Value: []byte("value 1"), Frequency: 2}.Bytes(), exp)
+	a.Set(2, cache.Response{Value: []byte("value 2"), Frequency: 1}.Bytes(), exp)
+	a.Set(1, cache.Response{Value: []byte("value 1"), Frequency: 3}.Bytes(), exp)
+	if len(evicted) != 0 {
+		t.Errorf("memory.Set() evicted = %v, want none", evicted)
+	}
+
+	a.Set(3, cache.Response{Value: []byte("value 3"), Frequency: 1}.Bytes(), exp)
+	if !reflect.DeepEqual(evicted, map[uint64]string{2: "value 2"}) {
+		t.Errorf("memory.Set() evicted = %v, want map[2:value 2]", evicted)
+	}
+}
+
+func TestEvict(t *testing.T) {
 	tests := []struct {
 		name      string
 		algorithm Algorithm
@@ -187,33 +958,34 @@ func TestEvict(t *testing.T) {
 		count++
 
 		a := &Adapter{
-			sync.Mutex{},
-			2,
-			tt.algorithm,
-			map[uint64][]byte{
-				14974843192121052621: cache.Response{
-					Value:      []byte("value 1"),
-					Expiration: time.Now().Add(1 * time.Minute),
-					LastAccess: time.Now().Add(-1 * time.Minute),
-					Frequency:  2,
-				}.Bytes(),
-				14974839893586167988: cache.Response{
-					Value:      []byte("value 2"),
-					Expiration: time.Now().Add(1 * time.Minute),
-					LastAccess: time.Now().Add(-2 * time.Minute),
-					Frequency:  1,
-				}.Bytes(),
-				14974840993097796199: cache.Response{
-					Value:      []byte("value 3"),
-					Expiration: time.Now().Add(1 * time.Minute),
-					LastAccess: time.Now().Add(-3 * time.Minute),
-					Frequency:  3,
-				}.Bytes(),
-			},
+			capacity:  2,
+			algorithm: tt.algorithm,
+			shards: []*shard{{
+				capacity: 2,
+				store: map[uint64][]byte{
+					14974843192121052621: cache.Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(1 * time.Minute),
+						LastAccess: time.Now().Add(-1 * time.Minute),
+						Frequency:  2,
+					}.Bytes(),
+					14974839893586167988: cache.Response{
+						Value:      []byte("value 2"),
+						Expiration: time.Now().Add(1 * time.Minute),
+						LastAccess: time.Now().Add(-2 * time.Minute),
+						Frequency:  1,
+					}.Bytes(),
+					14974840993097796199: cache.Response{
+						Value:      []byte("value 3"),
+						Expiration: time.Now().Add(1 * time.Minute),
+						LastAccess: time.Now().Add(-3 * time.Minute),
+						Frequency:  3,
+					}.Bytes(),
+				},
+			}},
 		}
 		t.Run(tt.name, func(t *testing.T) {
-			a.evict(k)
-			key := <-k
+			key := a.shards[0].evict(a.algorithm)
 
 			if count == 1 {
 				if key != 14974840993097796199 {
@@ -241,6 +1013,233 @@ func TestEvict(t *testing.T) {
 	}
 }
 
+func TestNearestExpiry(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:  3,
+		Algorithm: NearestExpiry,
+	})
+
+	now := time.Now()
+	for k, ttl := range map[uint64]time.Duration{
+		1: 3 * time.Minute,
+		2: 1 * time.Minute,
+		3: 2 * time.Minute,
+	} {
+		a.Set(k, cache.Response{
+			Value:      []byte("value"),
+			Expiration: now.Add(ttl),
+			LastAccess: now.Add(-ttl),
+		}.Bytes(), now.Add(ttl))
+	}
+
+	tests := []struct {
+		name        string
+		key         uint64
+		ttl         time.Duration
+		wantEvicted uint64
+	}{
+		{
+			"evicts the response expiring first",
+			4,
+			5 * time.Minute,
+			2,
+		},
+		{
+			"evicts the next response expiring first",
+			5,
+			4 * time.Minute,
+			3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Set(tt.key, cache.Response{
+				Value:      []byte("value"),
+				Expiration: now.Add(tt.ttl),
+			}.Bytes(), now.Add(tt.ttl))
+
+			if _, ok := a.Get(tt.wantEvicted); ok {
+				t.Errorf("memory.Get(%v) ok = true, want false", tt.wantEvicted)
+			}
+			if _, ok := a.Get(tt.key); !ok {
+				t.Errorf("memory.Get(%v) ok = false, want true", tt.key)
+			}
+		})
+	}
+}
+
+func TestEvictExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm Algorithm
+	}{
+		{
+			"lru removes the expired response",
+			LRU,
+		},
+		{
+			"mru removes the expired response",
+			MRU,
+		},
+		{
+			"lfu removes the expired response",
+			LFU,
+		},
+		{
+			"mfu removes the expired response",
+			MFU,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := NewAdapter(&Config{
+				Capacity:  3,
+				Algorithm: tt.algorithm,
+			})
+
+			a.Set(1, cache.Response{
+				Value:      []byte("value 1"),
+				LastAccess: time.Now().Add(-1 * time.Minute),
+				Frequency:  1,
+			}.Bytes(), time.Now().Add(1*time.Minute))
+			a.Set(2, cache.Response{
+				Value:      []byte("value 2"),
+				LastAccess: time.Now().Add(-2 * time.Minute),
+				Frequency:  2,
+			}.Bytes(), time.Now().Add(-1*time.Minute))
+			a.Set(3, cache.Response{
+				Value:      []byte("value 3"),
+				LastAccess: time.Now().Add(-3 * time.Minute),
+				Frequency:  3,
+			}.Bytes(), time.Now().Add(1*time.Minute))
+			a.Set(4, cache.Response{Value: []byte("value 4")}.Bytes(), time.Now().Add(1*time.Minute))
+
+			for _, key := range []uint64{1, 3, 4} {
+				if _, ok := a.Get(key); !ok {
+					t.Errorf("memory.Get(%v) ok = false, want true", key)
+				}
+			}
+			if _, ok := a.Get(2); ok {
+				t.Errorf("memory.Get(2) ok = true, want false")
+			}
+		})
+	}
+}
+
+func TestMiddlewareMaxTTL(t *testing.T) {
+	var calls int
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-Cache-TTL", "172800")
+		w.Write([]byte(fmt.Sprintf("value %v", calls)))
+	})
+
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		wantBody string
+		wantCode int
+	}{
+		{
+			"entry within the max ttl is served",
+			23 * time.Hour,
+			"value 1",
+			302,
+		},
+		{
+			"entry past the max ttl is refreshed",
+			25 * time.Hour,
+			"value 2",
+			200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			now := time.Now()
+			a, _ := NewAdapter(&Config{Capacity: 2, Algorithm: LRU})
+			client, _ := cache.NewClient(&cache.Config{
+				Adapter:   a,
+				TTL:       1 * time.Minute,
+				TTLHeader: "X-Cache-TTL",
+				MaxTTL:    24 * time.Hour,
+				Clock:     func() time.Time { return now },
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			now = now.Add(tt.elapsed)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareServeStaleOnTimeout(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name           string
+		staleOnTimeout bool
+		wantBody       string
+		wantRefreshed  bool
+	}{
+		{
+			"serves the expired response past the deadline",
+			true,
+			"value 1",
+			true,
+		},
+		{
+			"waits for the handler by default",
+			false,
+			"new value",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := NewAdapter(&Config{Capacity: 2, Algorithm: LRU})
+			expired := cache.Response{
+				Value:      []byte("value 1"),
+				Expiration: time.Now().Add(-1 * time.Minute),
+			}
+			a.Set(14974843192121052621, expired.Bytes(), expired.Expiration)
+
+			client, _ := cache.NewClient(&cache.Config{
+				Adapter:             a,
+				TTL:                 1 * time.Minute,
+				ServeStaleOnTimeout: tt.staleOnTimeout,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+			defer cancel()
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r.WithContext(ctx))
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+
+			time.Sleep(300 * time.Millisecond)
+			b, _ := a.Get(14974843192121052621)
+			if refreshed := string(cache.BytesToResponse(b).Value) == "new value"; refreshed != tt.wantRefreshed {
+				t.Errorf("*Client.Middleware() refreshed = %v, want %v", refreshed, tt.wantRefreshed)
+			}
+		})
+	}
+}
+
 func TestNewAdapter(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -251,14 +1250,16 @@ func TestNewAdapter(t *testing.T) {
 		{
 			"returns new Adapter",
 			&Config{
-				4,
-				LRU,
+				Capacity:  4,
+				Algorithm: LRU,
 			},
 			&Adapter{
-				sync.Mutex{},
-				4,
-				LRU,
-				make(map[uint64][]byte),
+				capacity:  4,
+				algorithm: LRU,
+				shards: []*shard{{
+					capacity: 4,
+					store:    make(map[uint64][]byte),
+				}},
 			},
 			false,
 		},
@@ -278,6 +1279,44 @@ func TestNewAdapter(t *testing.T) {
 			nil,
 			true,
 		},
+		{
+			"returns new sharded Adapter",
+			&Config{
+				Capacity:  5,
+				Algorithm: LRU,
+				Shards:    2,
+			},
+			&Adapter{
+				capacity:  5,
+				algorithm: LRU,
+				shards: []*shard{
+					{capacity: 3, store: make(map[uint64][]byte)},
+					{capacity: 2, store: make(map[uint64][]byte)},
+				},
+			},
+			false,
+		},
+		{
+			"returns error",
+			&Config{
+				Capacity:  4,
+				Algorithm: LRU,
+				Shards:    5,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Capacity:       4,
+				Algorithm:      WTinyLFU,
+				Shards:         2,
+				GlobalCapacity: true,
+			},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,219 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package memory
+
+import "container/list"
+
+// sketchSeeds are the seeds of the hashes indexing the rows of a sketch.
+var sketchSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// maxSketchCount is the count past which a sketch counter saturates.
+const maxSketchCount = 15
+
+// sketch is a count-min sketch estimating the access frequency of keys in
+// constant space. Counters are halved once the additions reach ten times the
+// capacity, so that the estimates favor recent accesses.
+type sketch struct {
+	rows      [len(sketchSeeds)][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newSketch returns a sketch sized for a capacity.
+func newSketch(capacity int) *sketch {
+	width := 16
+	for width < capacity {
+		width *= 2
+	}
+
+	s := &sketch{mask: uint64(width - 1), resetAt: 10 * capacity}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index returns the counter of a key in a row.
+func (s *sketch) index(key uint64, row int) uint64 {
+	h := (key ^ sketchSeeds[row]) * 0x9e3779b97f4a7c15
+	return (h ^ h>>31) & s.mask
+}
+
+// increment counts an access to a key.
+func (s *sketch) increment(key uint64) {
+	for i := range s.rows {
+		if j := s.index(key, i); s.rows[i][j] < maxSketchCount {
+			s.rows[i][j]++
+		}
+	}
+
+	if s.additions++; s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+// estimate returns the estimated access frequency of a key.
+func (s *sketch) estimate(key uint64) uint8 {
+	min := uint8(maxSketchCount)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(key, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// segment is the part of the W-TinyLFU store holding a key.
+type segment int
+
+const (
+	// window is the segment new keys are admitted to.
+	window segment = iota
+
+	// probation is the segment of the main store holding the keys admitted
+	// from the window, until they are accessed again.
+	probation
+
+	// protected is the segment of the main store holding the keys accessed
+	// while on probation.
+	protected
+)
+
+// lfuEntry is a key in its W-TinyLFU segment.
+type lfuEntry struct {
+	key     uint64
+	segment segment
+}
+
+// tinyLFU is the W-TinyLFU policy of a shard. New keys enter a small LRU
+// window, 1% of the capacity. The key leaving the full window is admitted to
+// the main store, a segmented LRU, only if it is estimated to be accessed
+// more often than the key it would evict from there.
+type tinyLFU struct {
+	sketch       *sketch
+	segments     [3]*list.List
+	elements     map[uint64]*list.Element
+	windowCap    int
+	protectedCap int
+}
+
+// newTinyLFU returns a W-TinyLFU policy for a capacity.
+func newTinyLFU(capacity int) *tinyLFU {
+	windowCap := capacity / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+
+	p := &tinyLFU{
+		sketch:       newSketch(capacity),
+		elements:     make(map[uint64]*list.Element, capacity),
+		windowCap:    windowCap,
+		protectedCap: (capacity - windowCap) * 8 / 10,
+	}
+	for i := range p.segments {
+		p.segments[i] = list.New()
+	}
+	return p
+}
+
+// access counts a lookup of a key, whether it is cached or not, and moves it
+// up its segment when it is: from probation, it is promoted to protected,
+// demoting the least recent protected key to probation when full.
+func (p *tinyLFU) access(key uint64) {
+	p.sketch.increment(key)
+
+	e, ok := p.elements[key]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*lfuEntry)
+	if entry.segment != probation {
+		p.segments[entry.segment].MoveToFront(e)
+		return
+	}
+
+	p.move(e, protected)
+	if p.segments[protected].Len() > p.protectedCap {
+		p.move(p.segments[protected].Back(), probation)
+	}
+}
+
+// add puts a new key in the window. The key leaving it when full is admitted
+// to probation, since there is room.
+func (p *tinyLFU) add(key uint64) {
+	p.elements[key] = p.segments[window].PushFront(&lfuEntry{key: key, segment: window})
+	if p.segments[window].Len() > p.windowCap {
+		p.move(p.segments[window].Back(), probation)
+	}
+}
+
+// victim returns the key to evict to make room for a new one, once the store
+// is full. When the window is full, the candidate leaving it is compared with
+// the least recent key on probation: the one estimated to be accessed less is
+// evicted, and the candidate is admitted to probation if it wins.
+func (p *tinyLFU) victim() uint64 {
+	main := p.segments[probation].Back()
+	if main == nil {
+		main = p.segments[protected].Back()
+	}
+	candidate := p.segments[window].Back()
+	switch {
+	case main == nil && candidate == nil:
+		return 0
+	case main == nil:
+		return candidate.Value.(*lfuEntry).key
+	case candidate == nil || p.segments[window].Len() < p.windowCap:
+		return main.Value.(*lfuEntry).key
+	}
+
+	candidateKey, mainKey := candidate.Value.(*lfuEntry).key, main.Value.(*lfuEntry).key
+	if p.sketch.estimate(candidateKey) <= p.sketch.estimate(mainKey) {
+		return candidateKey
+	}
+	p.move(candidate, probation)
+	return mainKey
+}
+
+// remove drops a key from its segment.
+func (p *tinyLFU) remove(key uint64) {
+	if e, ok := p.elements[key]; ok {
+		p.segments[e.Value.(*lfuEntry).segment].Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+// move puts the element of a key at the front of another segment.
+func (p *tinyLFU) move(e *list.Element, to segment) {
+	entry := e.Value.(*lfuEntry)
+	p.segments[entry.segment].Remove(e)
+	entry.segment = to
+	p.elements[entry.key] = p.segments[to].PushFront(entry)
+}
@@ -0,0 +1,144 @@
+package memory
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/victorspringer/http-cache"
+)
+
+func TestSketch(t *testing.T) {
+	s := newSketch(64)
+	for i := 0; i < 5; i++ {
+		s.increment(1)
+	}
+	s.increment(2)
+
+	tests := []struct {
+		name string
+		key  uint64
+		want uint8
+	}{
+		{
+			"estimates a frequent key",
+			1,
+			5,
+		},
+		{
+			"estimates a rare key",
+			2,
+			1,
+		},
+		{
+			"estimates a missing key",
+			3,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.estimate(tt.key); got != tt.want {
+				t.Errorf("sketch.estimate(%v) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	for i := 0; i < 20; i++ {
+		s.increment(1)
+	}
+	if got := s.estimate(1); got != maxSketchCount {
+		t.Errorf("sketch.estimate() = %v, want saturated at %v", got, maxSketchCount)
+	}
+
+	for i := 0; s.additions > 0 && i < s.resetAt; i++ {
+		s.increment(uint64(100 + i))
+	}
+	if got := s.estimate(1); got > maxSketchCount/2 {
+		t.Errorf("sketch.estimate() = %v after reset, want at most %v", got, maxSketchCount/2)
+	}
+}
+
+func TestWTinyLFU(t *testing.T) {
+	a, _ := NewAdapter(&Config{
+		Capacity:  10,
+		Algorithm: WTinyLFU,
+	})
+
+	set := func(key uint64) {
+		a.Set(key, cache.Response{Value: []byte("value")}.Bytes(), time.Now().Add(1*time.Minute))
+	}
+
+	// Keys 1 to 10 fill the store, 1 to 5 being accessed often.
+	for k := uint64(1); k <= 10; k++ {
+		set(k)
+	}
+	for i := 0; i < 3; i++ {
+		for k := uint64(1); k <= 5; k++ {
+			a.Get(k)
+		}
+	}
+
+	// One-hit wonders are evicted from the window without being admitted.
+	for k := uint64(100); k < 200; k++ {
+		a.Get(k)
+		set(k)
+	}
+
+	for k := uint64(1); k <= 5; k++ {
+		if _, ok := a.(*Adapter).shards[0].store[k]; !ok {
+			t.Errorf("memory.Set() evicted the frequent key %v", k)
+		}
+	}
+	if got := len(a.(*Adapter).shards[0].store); got != 10 {
+		t.Errorf("memory.Set() kept %v responses, want 10", got)
+	}
+}
+
+func TestWTinyLFUHitRatio(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm Algorithm
+	}{
+		{
+			"lru",
+			LRU,
+		},
+		{
+			"w-tinylfu",
+			WTinyLFU,
+		},
+	}
+
+	ratios := map[Algorithm]float64{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := NewAdapter(&Config{
+				Capacity:  20,
+				Algorithm: tt.algorithm,
+			})
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 1000)
+
+			hits, requests := 0, 3000
+			now := time.Now()
+			for i := 0; i < requests; i++ {
+				key := zipf.Uint64()
+				response := cache.Response{
+					Value:      []byte("value"),
+					LastAccess: now.Add(time.Duration(i)),
+					Frequency:  1,
+				}
+				if _, ok := a.Get(key); ok {
+					// The client stores hits back with their access date.
+					hits++
+				}
+				a.Set(key, response.Bytes(), now.Add(1*time.Hour))
+			}
+			ratios[tt.algorithm] = float64(hits) / float64(requests)
+		})
+	}
+
+	if ratios[WTinyLFU] <= ratios[LRU] {
+		t.Errorf("W-TinyLFU hit ratio = %v, want above the LRU one, %v", ratios[WTinyLFU], ratios[LRU])
+	}
+}
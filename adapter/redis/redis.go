@@ -25,6 +25,10 @@ SOFTWARE.
 package redis
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
 	"sync"
 	"time"
 
@@ -37,47 +41,174 @@ import (
 // Adapter is the memory adapter data structure.
 type Adapter struct {
 	sync.Mutex
-	store *redisCache.Codec
+	store  *redisCache.Codec
+	ring   *redis.Ring
+	prefix string
+	tokens map[uint64]string
+	clock  func() time.Time
 }
 
+// Config contains the Redis adapter configuration parameters.
+type Config struct {
+	// Ring is the configuration of the Redis ring.
+	Ring *RingOptions
+
+	// Clock returns the current time the TTL of responses is computed from,
+	// e.g. the fake clock of the client in tests. Defaults to time.Now.
+	// Optional setting.
+	Clock func() time.Time
+}
+
+// unlockScript deletes a lock only if it still holds the token it was
+// acquired with, so that a lock expired and acquired by another client is not
+// released.
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
 // RingOptions exports go-redis RingOptions type.
 type RingOptions redis.RingOptions
 
 // Get implements the cache Adapter interface Get method.
 func (a *Adapter) Get(key uint64) ([]byte, bool) {
 	var c []byte
-	if err := a.store.Get(string(key), &c); err == nil {
+	if err := a.store.Get(a.key(key), &c); err == nil {
 		return c, true
 	}
 
 	return nil, false
 }
 
+// GetCtx implements the cache ContextAdapter interface GetCtx method.
+func (a *Adapter) GetCtx(ctx context.Context, key uint64) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	var c []byte
+	err := a.store.Get(a.key(key), &c)
+	if err == redisCache.ErrCacheMiss {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return c, true, nil
+}
+
 // Set implements the cache Adapter interface Set method.
 func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
 	a.Lock()
 	a.store.Set(&redisCache.Item{
-		Key:        string(key),
+		Key:        a.key(key),
 		Object:     response,
-		Expiration: expiration.Sub(time.Now()),
+		Expiration: a.ttl(expiration),
 	})
 	a.Unlock()
 }
 
+// SetCtx implements the cache ContextAdapter interface SetCtx method.
+func (a *Adapter) SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	return a.store.Set(&redisCache.Item{
+		Key:        a.key(key),
+		Object:     response,
+		Expiration: a.ttl(expiration),
+	})
+}
+
 // Release implements the cache Adapter interface Release method.
 func (a *Adapter) Release(key uint64) {
 	a.Lock()
-	a.store.Delete(string(key))
+	a.store.Delete(a.key(key))
 	a.Unlock()
 }
 
+// LockKey implements the cache LockingAdapter interface LockKey method.
+func (a *Adapter) LockKey(key uint64, ttl time.Duration) (bool, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return false, err
+	}
+	token := hex.EncodeToString(b)
+
+	ok, err := a.ring.SetNX(a.lockKey(key), token, ttl).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	a.Lock()
+	a.tokens[key] = token
+	a.Unlock()
+
+	return true, nil
+}
+
+// UnlockKey implements the cache LockingAdapter interface UnlockKey method.
+func (a *Adapter) UnlockKey(key uint64) error {
+	a.Lock()
+	token, ok := a.tokens[key]
+	delete(a.tokens, key)
+	a.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return unlockScript.Run(a.ring, []string{a.lockKey(key)}, token).Err()
+}
+
+// key returns the Redis key of a cache key.
+func (a *Adapter) key(key uint64) string {
+	return a.prefix + strconv.FormatUint(key, 10)
+}
+
+// ttl returns the time left until an expiration.
+func (a *Adapter) ttl(expiration time.Time) time.Duration {
+	if a.clock != nil {
+		return expiration.Sub(a.clock())
+	}
+
+	return expiration.Sub(time.Now())
+}
+
+// lockKey returns the Redis key of the lock of a cache key.
+func (a *Adapter) lockKey(key uint64) string {
+	return a.key(key) + ":lock"
+}
+
+// WithKeyPrefix implements the cache PrefixableAdapter interface
+// WithKeyPrefix method.
+func (a *Adapter) WithKeyPrefix(prefix string) cache.Adapter {
+	return &Adapter{
+		store:  a.store,
+		ring:   a.ring,
+		prefix: a.prefix + prefix,
+		tokens: make(map[uint64]string),
+		clock:  a.clock,
+	}
+}
+
 // NewAdapter initializes Redis adapter.
 func NewAdapter(opt *RingOptions) cache.Adapter {
-	ropt := redis.RingOptions(*opt)
+	return NewAdapterWithConfig(&Config{Ring: opt})
+}
+
+// NewAdapterWithConfig initializes Redis adapter with its configuration.
+func NewAdapterWithConfig(cfg *Config) cache.Adapter {
+	ropt := redis.RingOptions(*cfg.Ring)
+	ring := redis.NewRing(&ropt)
 	return &Adapter{
-		sync.Mutex{},
-		&redisCache.Codec{
-			Redis: redis.NewRing(&ropt),
+		store: &redisCache.Codec{
+			Redis: ring,
 			Marshal: func(v interface{}) ([]byte, error) {
 				return msgpack.Marshal(v)
 
@@ -86,5 +217,8 @@ func NewAdapter(opt *RingOptions) cache.Adapter {
 				return msgpack.Unmarshal(b, v)
 			},
 		},
+		ring:   ring,
+		tokens: make(map[uint64]string),
+		clock:  cfg.Clock,
 	}
 }
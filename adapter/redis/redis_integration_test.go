@@ -0,0 +1,95 @@
+//go:build integration
+// +build integration
+
+package redis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/victorspringer/http-cache"
+)
+
+func TestDistributedSingleFlight(t *testing.T) {
+	var calls int32
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("new value"))
+	})
+
+	url := "http://foo.bar/single-flight-" + time.Now().Format(time.RFC3339Nano)
+
+	var handlers []http.Handler
+	for i := 0; i < 2; i++ {
+		client, err := cache.NewClient(&cache.Config{
+			Adapter: NewAdapter(&RingOptions{
+				Addrs: map[string]string{
+					"server": ":6379",
+				},
+			}),
+			TTL:                     1 * time.Minute,
+			DistributedSingleFlight: true,
+			SingleFlightTimeout:     1 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("cache.NewClient() error = %v", err)
+		}
+		handlers = append(handlers, client.Middleware(httpTestHandler))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(handler http.Handler) {
+			defer wg.Done()
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v, want new value", w.Body.String())
+			}
+		}(handlers[i%2])
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("*Client.Middleware() handler calls = %v, want 1", got)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	a := NewAdapter(&RingOptions{
+		Addrs: map[string]string{
+			"server": ":6379",
+		},
+	}).(*Adapter)
+	b := NewAdapter(&RingOptions{
+		Addrs: map[string]string{
+			"server": ":6379",
+		},
+	}).(*Adapter)
+	key := uint64(time.Now().UnixNano())
+
+	if ok, err := a.LockKey(key, 1*time.Second); !ok || err != nil {
+		t.Fatalf("redis.LockKey() = %v %v, want true", ok, err)
+	}
+	if ok, _ := b.LockKey(key, 1*time.Second); ok {
+		t.Error("redis.LockKey() acquired a held lock")
+	}
+	if err := b.UnlockKey(key); err != nil {
+		t.Errorf("redis.UnlockKey() error = %v", err)
+	}
+	if ok, _ := b.LockKey(key, 1*time.Second); ok {
+		t.Error("redis.UnlockKey() released a lock held by another adapter")
+	}
+	a.UnlockKey(key)
+	if ok, _ := b.LockKey(key, 1*time.Second); !ok {
+		t.Error("redis.LockKey() did not acquire a released lock")
+	}
+	b.UnlockKey(key)
+}
@@ -126,3 +126,75 @@ func TestRelease(t *testing.T) {
 		})
 	}
 }
+
+func TestKey(t *testing.T) {
+	a := NewAdapter(&RingOptions{
+		Addrs: map[string]string{
+			"server": ":6379",
+		},
+	}).(*Adapter)
+
+	tests := []struct {
+		name    string
+		adapter cache.Adapter
+		want    string
+	}{
+		{
+			"formats the key in decimal",
+			a,
+			"14974843192121052621",
+		},
+		{
+			"prefixes the key",
+			a.WithKeyPrefix("httpcache:"),
+			"httpcache:14974843192121052621",
+		},
+		{
+			"nests prefixes",
+			a.WithKeyPrefix("app:").(*Adapter).WithKeyPrefix("httpcache:"),
+			"app:httpcache:14974843192121052621",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.adapter.(*Adapter).key(14974843192121052621); got != tt.want {
+				t.Errorf("redis.key() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		adapter cache.Adapter
+		want    time.Duration
+	}{
+		{
+			"computes the ttl from the clock",
+			NewAdapterWithConfig(&Config{
+				Ring:  &RingOptions{Addrs: map[string]string{"server": ":6379"}},
+				Clock: clock,
+			}),
+			1 * time.Minute,
+		},
+		{
+			"keeps the clock with a prefix",
+			NewAdapterWithConfig(&Config{
+				Ring:  &RingOptions{Addrs: map[string]string{"server": ":6379"}},
+				Clock: clock,
+			}).(*Adapter).WithKeyPrefix("httpcache:"),
+			1 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.adapter.(*Adapter).ttl(now.Add(1 * time.Minute)); got != tt.want {
+				t.Errorf("redis.ttl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
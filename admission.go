@@ -0,0 +1,92 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMinRequestsWindow is the default of Config.MinRequestsWindow.
+const defaultMinRequestsWindow = 1 * time.Minute
+
+// requestCounterWidth is the number of counters of each row of a
+// requestCounter, a power of two.
+const requestCounterWidth = 4096
+
+// requestCounterSeeds are the seeds of the hashes indexing the rows of a
+// requestCounter.
+var requestCounterSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// requestCounter counts the requests of keys over a window with a count-min
+// sketch, in constant memory. Counts may be overestimated when keys collide,
+// never underestimated. They are cleared once the window elapsed.
+type requestCounter struct {
+	sync.Mutex
+	rows    [len(requestCounterSeeds)][requestCounterWidth]uint8
+	window  time.Duration
+	resetAt time.Time
+}
+
+func newRequestCounter(window time.Duration) *requestCounter {
+	return &requestCounter{window: window}
+}
+
+// count counts a request of a key and returns the estimated number of its
+// requests in the current window, including this one.
+func (rc *requestCounter) count(key uint64, now time.Time) int {
+	rc.Lock()
+	defer rc.Unlock()
+
+	if !now.Before(rc.resetAt) {
+		rc.rows = [len(requestCounterSeeds)][requestCounterWidth]uint8{}
+		rc.resetAt = now.Add(rc.window)
+	}
+
+	min := 255
+	for i := range rc.rows {
+		h := (key ^ requestCounterSeeds[i]) * 0x9e3779b97f4a7c15
+		j := (h ^ h>>31) & (requestCounterWidth - 1)
+		if rc.rows[i][j] < 255 {
+			rc.rows[i][j]++
+		}
+		if v := int(rc.rows[i][j]); v < min {
+			min = v
+		}
+	}
+
+	return min
+}
+
+// admitted counts a request of a key missing from the cache and reports
+// whether its response is to be cached, once requested MinRequestsBeforeCache
+// times within the window.
+func (c *Client) admitted(key uint64) bool {
+	if c.requestCounts == nil {
+		return true
+	}
+
+	return c.requestCounts.count(key, c.clock()) >= c.minRequests
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareMinRequestsBeforeCache(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name        string
+		minRequests int
+		interval    time.Duration
+		wantCodes   []int
+	}{
+		{
+			"caches on the third request",
+			3,
+			1 * time.Second,
+			[]int{200, 200, 200, 302},
+		},
+		{
+			"caches on the first request by default",
+			0,
+			1 * time.Second,
+			[]int{200, 302, 302, 302},
+		},
+		{
+			"counts requests within the window only",
+			3,
+			40 * time.Second,
+			[]int{200, 200, 200, 200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:                adapter,
+				TTL:                    1 * time.Minute,
+				MinRequestsBeforeCache: tt.minRequests,
+				Clock: func() time.Time {
+					return now
+				},
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			for i, wantCode := range tt.wantCodes {
+				r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != wantCode || w.Body.String() != "new value" {
+					t.Errorf("*Client.Middleware() request %v = %v %v, want %v new value", i+1, w.Code, w.Body.String(), wantCode)
+				}
+				now = now.Add(tt.interval)
+			}
+		})
+	}
+}
+
+func TestRequestCounter(t *testing.T) {
+	now := time.Now()
+	rc := newRequestCounter(1 * time.Minute)
+	for i := 1; i <= 3; i++ {
+		if got := rc.count(1, now); got != i {
+			t.Errorf("requestCounter.count() = %v, want %v", got, i)
+		}
+	}
+	if got := rc.count(2, now); got != 1 {
+		t.Errorf("requestCounter.count() of another key = %v, want 1", got)
+	}
+	if got := rc.count(1, now.Add(1*time.Minute)); got != 1 {
+		t.Errorf("requestCounter.count() after the window = %v, want 1", got)
+	}
+}
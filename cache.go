@@ -26,24 +26,92 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
-	"hash/fnv"
+	"fmt"
+	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// FNV-1a 64-bit parameters, as used by hash/fnv.
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
 // Response is the cached response data structure.
 type Response struct {
 	// Value is the cached response value.
 	Value []byte
 
-	// Expiration is the cached response expiration date.
+	// Header is the cached response header.
+	Header http.Header
+
+	// Trailer is the cached response trailer, announced and replayed after
+	// the body on hits.
+	Trailer http.Header
+
+	// StatusCode is the status code of the cached response. It is zero for
+	// responses cached before it was stored.
+	StatusCode int
+
+	// Immutable reports whether the origin marked the response as immutable,
+	// in which case it is never revalidated while fresh.
+	Immutable bool
+
+	// LastModified is the modification date of the response, from its
+	// Last-Modified header or else the date it was cached.
+	LastModified time.Time
+
+	// StoredAt is the date the response was cached. It is zero for responses
+	// cached before it was stored.
+	StoredAt time.Time
+
+	// URL is the canonical URL of the request the response was cached for.
+	// It is only stored when Config.StoreRequestURL is set.
+	URL string
+
+	// Expiration is the cached response expiration date, i.e. its soft
+	// expiration: past it, the response is stale.
 	Expiration time.Time
 
+	// HardExpiration is the date past which a stale response is no longer
+	// served. Until then, it is served while being refreshed in background.
+	// It is Expiration plus the stale-while-revalidate directive of the
+	// response Cache-Control header if any, else plus
+	// Config.StaleWhileRevalidate, which also applies when it is zero.
+	HardExpiration time.Time
+
+	// Vary lists the request headers responses to the request vary on, by
+	// their Vary header or Config.DefaultVary, canonical and sorted. It is
+	// only set on the index cached under the key of the request, which
+	// holds no response: they are cached under the keys of their variants.
+	Vary []string
+
+	// Variants are the keys of the variants listed by a Vary index.
+	Variants []uint64
+
+	// Checksum is the SHA-256 hash of Value, verified when it is read. It is
+	// only stored when Config.VerifyChecksum is set.
+	Checksum []byte
+
+	// StaleIfError is how long after its expiration the response may be
+	// served stale when regenerating it fails with a server error, from
+	// the stale-if-error directive of its Cache-Control header (RFC 5861).
+	StaleIfError time.Duration
+
 	// LastAccess is the last date a cached response was accessed.
 	// Used by LRU and MRU algorithms.
 	LastAccess time.Time
@@ -59,19 +127,523 @@ type Config struct {
 	// Adapter type for the HTTP cache middleware client.
 	Adapter Adapter
 
-	// TTL is how long a response is going to be cached.
+	// TTL is how long a response is going to be cached. It is the soft TTL:
+	// the hard one adds StaleWhileRevalidate to it.
 	TTL time.Duration
 
+	// TTLBySize returns the TTL of a response from the size of its body,
+	// e.g. to cache expensive large responses longer, instead of TTL. A
+	// non-positive duration falls back to TTL. Surrogate-Control and
+	// TTLHeader take precedence over it. Optional setting.
+	TTLBySize func(size int) time.Duration
+
+	// TTLByStatus maps status codes to the TTL of their responses instead of
+	// TTL, e.g. to cache 404 Not Found, once made cacheable by Cacheable,
+	// shortly. A multiple of 100 such as 200 applies to its whole class,
+	// unless the exact status code is mapped too. It takes precedence over
+	// TTLBySize. Optional setting.
+	TTLByStatus map[int]time.Duration
+
+	// SurrogateControl honors the Surrogate-Control header of responses,
+	// meant for shared caches: its max-age is used as the TTL instead of
+	// the configured one, and the header is stripped from the responses
+	// sent to clients. Optional setting.
+	SurrogateControl bool
+
+	// TTLHeader is the name of a response header, such as X-Cache-TTL, by
+	// which handlers set the TTL of their response in seconds. It takes
+	// precedence over Surrogate-Control and the configured TTL, and is
+	// stripped from the responses sent to clients. Optional setting.
+	TTLHeader string
+
+	// AbsoluteMaxAge is how long after it was stored a response is served at
+	// most, whatever its expiration, e.g. one set from a long upstream
+	// max-age. Past it, the response is regenerated. Optional setting.
+	AbsoluteMaxAge time.Duration
+
+	// MaxTTL caps how long a response is cached, whatever sets its TTL, e.g.
+	// a long TTLHeader or Surrogate-Control max-age. It also bounds the
+	// stale-while-revalidate and stale-if-error windows. Optional setting.
+	MaxTTL time.Duration
+
+	// HonorRequestNoCache regenerates the cached responses of requests with
+	// the no-cache Cache-Control directive, e.g. browser reloads, unless
+	// they are fresh and immutable. By default, the directive is ignored, so
+	// that clients cannot bust the shared cache. Optional setting.
+	HonorRequestNoCache bool
+
 	// ReleaseKey is the parameter key used to free a request cached
 	// response. Optional setting.
 	ReleaseKey string
+
+	// VaryFunc returns a variation of the request, such as a device class or
+	// an A/B bucket, which is folded into the cache key so each variation is
+	// cached separately. It must be deterministic: the same request must
+	// always yield the same string. An empty string shares the entry of the
+	// plain URL. Optional setting.
+	VaryFunc func(*http.Request) string
+
+	// RouteKeyFunc returns the route template matched by a request, such as
+	// /users/{id}, which is folded into its cache key. The path of routed
+	// requests is normalized, so that trailing or duplicate slashes and
+	// escaping differences do not split their entries. With chi, mount the
+	// middleware on the routes, e.g. with r.With, and return
+	// chi.RouteContext(r.Context()).RoutePattern(). Optional setting.
+	RouteKeyFunc func(*http.Request) (template string, ok bool)
+
+	// VaryAccept caches responses separately by the media type preferred by
+	// the Accept request header. Wildcards share the entry of requests
+	// without Accept. Media ranges such as text/* are not resolved to the
+	// Content-Type served, and are cached separately from it. Optional
+	// setting.
+	VaryAccept bool
+
+	// VaryAcceptBuckets is the list of media types responses are cached
+	// separately by, e.g. application/json and text/html for a path serving
+	// both API clients and browsers: requests share the entry of the listed
+	// type their Accept header prefers, or else a default entry. Optional
+	// setting.
+	VaryAcceptBuckets []string
+
+	// StoreHeaders is the list of response headers to be cached. When nil,
+	// every header is cached. Hop-by-hop headers, such as Connection, and
+	// Set-Cookie are never cached. Optional setting.
+	StoreHeaders []string
+
+	// BeforeStore is called with every response about to be cached, which
+	// it is allowed to modify. It is not called on hits. Optional setting.
+	BeforeStore func(*Response)
+
+	// AfterLoad is called with every cached response about to be served on
+	// a hit, which it is allowed to modify. Changes are not cached. Optional
+	// setting.
+	AfterLoad func(*Response, *http.Request)
+
+	// BypassSampleRate is the fraction, between 0 and 1, of hits
+	// regenerated by the handler anyway, refreshing the cached response, to
+	// validate the freshness of the cache in production. Optional setting.
+	BypassSampleRate float64
+
+	// OnDrift is called with the cached and regenerated bodies of the hits
+	// sampled by BypassSampleRate when they differ. Optional setting.
+	OnDrift func(r *http.Request, cached, fresh []byte)
+
+	// OnEvent is called with every request handled by the middleware, after
+	// it is served, to observe how the cache handled it. Optional setting.
+	OnEvent func(CacheEvent)
+
+	// DistributedSingleFlight lets one client at a time regenerate a missing
+	// response, across every client sharing an adapter implementing
+	// LockingAdapter, such as the Redis one. The others wait for it to be
+	// cached, or regenerate it themselves once SingleFlightTimeout elapsed,
+	// e.g. if the lock holder died. Optional setting.
+	DistributedSingleFlight bool
+
+	// SingleFlightTimeout is how long the lock of a response being
+	// regenerated is held at most. Defaults to 5 seconds.
+	SingleFlightTimeout time.Duration
+
+	// CoalesceCompute lets concurrent GetOrCompute calls missing the same
+	// key wait for a single compute, in process, and share its result.
+	// Optional setting.
+	CoalesceCompute bool
+
+	// SkipEmptyBody serves responses with an empty body, such as 204 No
+	// Content, without caching them. Optional setting.
+	SkipEmptyBody bool
+
+	// UseServeContent serves hits with http.ServeContent, which handles
+	// Range and conditional requests, such as If-Modified-Since, against the
+	// cached response. Hits are then served with the status it picks, e.g.
+	// 200, 206 or 304, instead of 302. Optional setting.
+	UseServeContent bool
+
+	// HeadFromGet answers HEAD requests missing from the cache with the
+	// fresh response cached for the GET request of the same URL, without
+	// its body. Optional setting.
+	HeadFromGet bool
+
+	// CompressOnServe serves cached responses gzip-compressed to the clients
+	// accepting it, unless the handler already encoded them. The compressed
+	// variant is cached along with each response. Optional setting.
+	CompressOnServe bool
+
+	// GenerateETag sets a strong ETag, hashed from the body, on the cached
+	// responses the handler served without one, and answers the hits
+	// matching the If-None-Match header of their request with 304 Not
+	// Modified. Optional setting.
+	GenerateETag bool
+
+	// MinBodyBytes is the size below which response bodies are served
+	// without being cached, e.g. to skip tiny error stubs. Optional setting.
+	MinBodyBytes int
+
+	// MaxBodyBytes is the size above which response bodies are served
+	// without being cached. Bodies are buffered up to it only, past which
+	// they are streamed to the client as written. When zero, there is no
+	// limit. Optional setting.
+	MaxBodyBytes int
+
+	// MinRequestsBeforeCache is the number of times a response must be
+	// requested within MinRequestsWindow before it is cached, so that one-off
+	// URLs, e.g. requested by crawlers, are passed through instead of
+	// polluting the cache. Requests are counted approximately, in bounded
+	// memory. Optional setting.
+	MinRequestsBeforeCache int
+
+	// MinRequestsWindow is the period over which MinRequestsBeforeCache
+	// counts requests. Defaults to 1 minute.
+	MinRequestsWindow time.Duration
+
+	// SkipResponseHeader is the name of a response header with which
+	// handlers opt out of caching, e.g. X-Cache-Skip. When the header is
+	// set, whatever its value, the response is served without being cached
+	// and the header is stripped. Optional setting.
+	SkipResponseHeader string
+
+	// CacheAuthChallenges caches responses carrying an authentication
+	// challenge, with the WWW-Authenticate or Proxy-Authenticate header. By
+	// default, they are specific to their request and served without being
+	// cached. Set-Cookie headers are never cached, whatever this setting.
+	// Optional setting.
+	CacheAuthChallenges bool
+
+	// RequireExplicitFreshness caches only the responses declaring their
+	// freshness, with a max-age or s-maxage directive or an Expires header,
+	// or carrying a validator, an ETag or Last-Modified header. The others,
+	// only heuristically cacheable, are served without being cached.
+	// Optional setting.
+	RequireExplicitFreshness bool
+
+	// IncludePaths is the list of path prefixes to be cached. When empty,
+	// every path is cached. Optional setting.
+	IncludePaths []string
+
+	// ExcludePaths is the list of path prefixes never to be cached. It takes
+	// precedence over IncludePaths. Optional setting.
+	ExcludePaths []string
+
+	// SkipHTTP10 passes HTTP/1.0 requests through, uncached and unanswered
+	// from the cache. Optional setting.
+	SkipHTTP10 bool
+
+	// StrictGET caches only requests with an explicit GET method. Other
+	// requests, including HEAD ones and the ones with an empty method, which
+	// net/http clients send as GET, pass through. Optional setting.
+	StrictGET bool
+
+	// IdempotencyKeyHeader is the name of a request header, such as
+	// Idempotency-Key, by which requests are keyed instead of their URL,
+	// whatever their method. Retries of a request carrying it, e.g. a POST,
+	// are served the response cached for the first one. Optional setting.
+	IdempotencyKeyHeader string
+
+	// CacheOptions caches the responses to OPTIONS requests, e.g. CORS
+	// preflights, keyed by their URL, Origin, Access-Control-Request-Method
+	// and Access-Control-Request-Headers. Hits replay the status and headers
+	// of the response. Optional setting.
+	CacheOptions bool
+
+	// KeyPrefix namespaces the keys of the store shared by the adapter, e.g.
+	// httpcache: for a Redis shared with other applications, so that they
+	// do not collide with unrelated data. It requires an adapter
+	// implementing PrefixableAdapter. Optional setting.
+	KeyPrefix string
+
+	// KeySalt is mixed into every cache key. Changing it, on deploy or at
+	// runtime with SetKeySalt, makes every cached response unreachable
+	// without flushing the adapter; they expire with their TTL. Optional
+	// setting.
+	KeySalt string
+
+	// VaryAcceptLanguage caches responses separately by the language tag
+	// preferred by the Accept-Language request header. Tags are normalized,
+	// e.g. en_US and en-us share an entry, and malformed headers share the
+	// entry of requests without Accept-Language. Optional setting.
+	VaryAcceptLanguage bool
+
+	// VaryAcceptEncoding is the list of content codings the handler serves,
+	// such as br and gzip, by order of preference. When set, responses are
+	// cached separately by the one the Accept-Encoding request header
+	// accepts best, or identity, so that the variants stay few whatever the
+	// header. Optional setting.
+	VaryAcceptEncoding []string
+
+	// DefaultVary is the list of request headers responses always vary on,
+	// along with the ones listed by their Vary header, e.g. Accept-Encoding
+	// for origins omitting it. Optional setting.
+	DefaultVary []string
+
+	// MaxVaryVariants is the maximum number of variants cached per URL for
+	// responses varying on request headers. Past it, new variants are
+	// served without being cached. When zero, there is no limit. Optional
+	// setting.
+	MaxVaryVariants int
+
+	// DisableParamSort keys requests by their raw query, for backends where
+	// the order of the params is significant, e.g. signed URLs. By default,
+	// params are sorted so that their order does not matter. Optional
+	// setting.
+	DisableParamSort bool
+
+	// PreserveValueOrder sorts params by key only, keeping the values of
+	// each key in their order, for backends where it is significant, e.g.
+	// ids=3&ids=1. Optional setting.
+	PreserveValueOrder bool
+
+	// QueryEncoder encodes the params of request URLs, parsed with the
+	// values of each key sorted unless PreserveValueOrder is set, into the
+	// query of their key, e.g. to match the keys of a fronting CDN. It is
+	// responsible for the order of the keys, and unused with
+	// DisableParamSort. Defaults to RFC3986QueryEncoder.
+	QueryEncoder func(params url.Values) string
+
+	// KeyPathOnly reports whether a request is keyed by its path alone,
+	// ignoring every query param, e.g. for endpoints whose params are for
+	// tracking only. Returning true for every request keys them all by
+	// path. Optional setting.
+	KeyPathOnly func(*http.Request) bool
+
+	// KeyIncludesScheme caches responses separately by the scheme requests
+	// were made with, http or https, which is read from ForwardedProtoHeader
+	// when set and present, then from the URL and the connection. Optional
+	// setting.
+	KeyIncludesScheme bool
+
+	// ForwardedProtoHeader is the request header, such as X-Forwarded-Proto,
+	// by which a TLS-terminating proxy passes the scheme of requests.
+	// Optional setting.
+	ForwardedProtoHeader string
+
+	// KeyHeaders is the list of request headers whose values are folded
+	// into the cache key, so requests differing in any of them are cached
+	// separately. Values are trimmed and lowercased. Optional setting.
+	KeyHeaders []string
+
+	// StaleWhileRevalidate is how long after its expiration a response is
+	// still served while it is refreshed in background. Optional setting.
+	StaleWhileRevalidate time.Duration
+
+	// RevalidateWorkers is the maximum number of concurrent background
+	// refreshes. Defaults to 1.
+	RevalidateWorkers int
+
+	// ServeStaleOnTimeout serves the expired response cached for a request
+	// with a deadline, rather than waiting for the handler, when the
+	// deadline passes before the handler responds. The handler then runs
+	// detached from the deadline, and its response refreshes the cache in
+	// background. It is buffered whatever MaxBodyBytes. Optional setting.
+	ServeStaleOnTimeout bool
+
+	// StoreRequestURL stores the canonical request URL alongside each
+	// cached response, for auditing. Optional setting.
+	StoreRequestURL bool
+
+	// Cacheable reports whether responses with a given status code are to be
+	// cached, e.g. to cache 404 Not Found as well. By default, responses with
+	// a status code below 400 are cached. Optional setting.
+	Cacheable func(statusCode int) bool
+
+	// StatusFunc returns the status code a response served by the handler,
+	// or by the transport of RoundTripper, is judged by, to be cached by
+	// Cacheable or to fail over to a stale-if-error response, e.g. the
+	// upstream status set in a header by a proxy. The status code served is
+	// unchanged. Defaults to the StatusCode of the response. Optional
+	// setting.
+	StatusFunc func(res *http.Response) int
+
+	// ReleaseKeys are additional parameter keys used to free a request
+	// cached response. Optional setting.
+	ReleaseKeys []string
+
+	// PurgeAllKey is the parameter key used to free every cached response,
+	// for adapters implementing FlushableAdapter. It is only honoured when
+	// ReleaseAuth is set. Optional setting.
+	PurgeAllKey string
+
+	// ReleaseDelay is the grace period after which the responses freed by
+	// release requests are deleted, so that in-flight reads of them
+	// complete. It requires an adapter implementing DelayedReleaseAdapter.
+	// Optional setting.
+	ReleaseDelay time.Duration
+
+	// ReleaseAuth authorizes release and purge-all requests. Unauthorized
+	// ones are answered with 403 Forbidden. When nil, release requests are
+	// always authorized. Optional setting.
+	ReleaseAuth func(*http.Request) bool
+
+	// ReleaseResponse answers release requests with a JSON confirmation,
+	// instead of passing them through to the handler. Optional setting.
+	ReleaseResponse bool
+
+	// AdapterRetry is the retry policy applied to the calls of adapters
+	// implementing ContextAdapter. Optional setting.
+	AdapterRetry RetryPolicy
+
+	// SetFailurePolicy is what is done when a ContextAdapter fails to cache
+	// a response, once its retries are exhausted. Policies other than
+	// SetFailureIgnore require a ContextAdapter. Defaults to
+	// SetFailureIgnore.
+	SetFailurePolicy SetFailurePolicy
+
+	// FallbackAdapter is the local adapter responses are cached to on
+	// SetFailureFallback, and looked up from when the ContextAdapter misses
+	// them. Optional setting.
+	FallbackAdapter Adapter
+
+	// DisableAdapterPanicRecovery lets panics of the adapter propagate. By
+	// default, they are logged and the request proceeds as a cache miss.
+	// Optional setting.
+	DisableAdapterPanicRecovery bool
+
+	// ErrorLog is the logger for adapter errors. When nil, the standard
+	// logger is used. Optional setting.
+	ErrorLog *log.Logger
+
+	// OnError is called with every error logged to ErrorLog, such as adapter
+	// failures or checksum mismatches, e.g. to count them. Optional setting.
+	OnError func(err error)
+
+	// VerifyChecksum stores the checksum of cached bodies and verifies it
+	// when they are read, so that responses tampered with or corrupted in a
+	// shared store are treated as misses. Responses cached without a
+	// checksum are treated as misses too. Optional setting.
+	VerifyChecksum bool
+
+	// Clock returns the current time, e.g. a fake one in tests, which should
+	// then be the clock of the adapter too. Defaults to time.Now. Optional
+	// setting.
+	Clock func() time.Time
+
+	// Codec encodes the responses cached by the adapter, e.g. BinaryCodec
+	// for smaller entries. Responses streamed to a StreamAdapter are always
+	// encoded by gob. Defaults to GobCodec.
+	Codec Codec
+}
+
+// SetFailurePolicy is the way failures of the adapter to cache a response are
+// handled.
+type SetFailurePolicy string
+
+const (
+	// SetFailureIgnore serves the response without caching it.
+	SetFailureIgnore SetFailurePolicy = "IGNORE"
+
+	// SetFailureReport serves the response without caching it, and logs the
+	// failure to ErrorLog and OnError, e.g. to count it.
+	SetFailureReport SetFailurePolicy = "REPORT"
+
+	// SetFailureFallback caches the response to the FallbackAdapter instead,
+	// so that at least this client caches it.
+	SetFailureFallback SetFailurePolicy = "FALLBACK"
+)
+
+// RetryPolicy contains the parameters for retrying transient adapter errors.
+// The zero value disables retries.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an adapter call,
+	// including the first one.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. It doubles on every
+	// subsequent retry and is randomly jittered.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between retries. Optional setting.
+	MaxDelay time.Duration
 }
 
 // Client data structure for HTTP cache middleware.
 type Client struct {
-	adapter    Adapter
-	ttl        time.Duration
-	releaseKey string
+	adapter          Adapter
+	ttl              time.Duration
+	ttlBySize        func(int) time.Duration
+	ttlByStatus      map[int]time.Duration
+	surrogateControl bool
+	ttlHeader        string
+	absoluteMaxAge   time.Duration
+	maxTTL           time.Duration
+	requestNoCache   bool
+	adapterRetry     RetryPolicy
+	setFailure       SetFailurePolicy
+	fallback         Adapter
+
+	disablePanicRecovery bool
+	errorLog             *log.Logger
+	onError              func(error)
+	verifyChecksum       bool
+
+	releaseKey      string
+	releaseKeys     []string
+	releaseDelay    time.Duration
+	purgeAllKey     string
+	releaseAuth     func(*http.Request) bool
+	releaseResponse bool
+
+	includePaths      []string
+	excludePaths      []string
+	skipHTTP10        bool
+	strictGET         bool
+	cacheOptions      bool
+	varyFunc          func(*http.Request) string
+	routeKeyFunc      func(*http.Request) (string, bool)
+	varyAccept        bool
+	acceptBuckets     []string
+	varyLanguage      bool
+	varyEncoding      []string
+	defaultVary       []string
+	maxVaryVariants   int
+	keyHeaders        []string
+	disableParamSort  bool
+	preserveValues    bool
+	queryEncoder      func(url.Values) string
+	keyPathOnly       func(*http.Request) bool
+	keyScheme         bool
+	forwardedProto    string
+	idempotencyHeader string
+	keySalt           atomic.Value
+
+	storeRequestURL bool
+	storeHeaders    []string
+	cacheableStatus func(int) bool
+	statusFunc      func(*http.Response) int
+	skipEmptyBody   bool
+	minBodyBytes    int
+	maxBodyBytes    int
+	minRequests     int
+	requestCounts   *requestCounter
+	skipHeader      string
+	authChallenges  bool
+	explicitFresh   bool
+	beforeStore     func(*Response)
+	afterLoad       func(*Response, *http.Request)
+	onEvent         func(CacheEvent)
+	onDrift         func(*http.Request, []byte, []byte)
+	bypassRate      float64
+	serveContent    bool
+	headFromGet     bool
+	compressOnServe bool
+	generateETag    bool
+
+	staleWhileRevalidate time.Duration
+	revalidateWorkers    int
+	revalidator          *revalidator
+	revalidatorOnce      sync.Once
+	staleOnTimeout       bool
+
+	locker        LockingAdapter
+	flightTimeout time.Duration
+
+	coalesceCompute bool
+	computeMu       sync.Mutex
+	computes        map[uint64]*computeCall
+
+	// disabled is set atomically, to 1 when caching is disabled.
+	disabled int32
+
+	now    func() time.Time
+	random func() float64
+	codec  Codec
 }
 
 // Adapter interface for HTTP cache middleware client.
@@ -87,112 +659,1695 @@ type Adapter interface {
 	Release(key uint64)
 }
 
+// FlushableAdapter is an optional interface for adapters able to free every
+// cached response at once.
+type FlushableAdapter interface {
+	Adapter
+
+	// Flush frees the whole cache.
+	Flush()
+}
+
+// ContextAdapter is an optional interface for adapters backed by a network
+// store. Its methods honour the request context and report errors, which
+// makes it possible to retry transient failures.
+type ContextAdapter interface {
+	Adapter
+
+	// GetCtx retrieves the cached response by a given key. It returns
+	// false and a nil error when the key does not exist.
+	GetCtx(ctx context.Context, key uint64) ([]byte, bool, error)
+
+	// SetCtx caches a response for a given key until an expiration date.
+	SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error
+}
+
+// PrefixableAdapter is an optional interface for adapters backed by a store
+// with string keys, able to namespace them.
+type PrefixableAdapter interface {
+	Adapter
+
+	// WithKeyPrefix returns an adapter sharing the store of this one, whose
+	// keys are prefixed with a given string.
+	WithKeyPrefix(prefix string) Adapter
+}
+
+// DelayedReleaseAdapter is an optional interface for adapters able to free a
+// cached response after a grace period.
+type DelayedReleaseAdapter interface {
+	Adapter
+
+	// ReleaseAfter frees cache for a given key once a duration elapsed.
+	ReleaseAfter(key uint64, d time.Duration)
+}
+
+// MetaAdapter is an optional interface for adapters storing the expiration
+// date of responses apart from them, which spares decoding the ones past it.
+type MetaAdapter interface {
+	Adapter
+
+	// GetMeta retrieves the cached response by a given key along with the
+	// expiration date it was set with. It also returns true or false,
+	// whether it exists or not.
+	GetMeta(key uint64) ([]byte, time.Time, bool)
+}
+
 // Middleware is the HTTP cache middleware handler.
 func (c *Client) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" || r.Method == "" {
-			sortURLParams(r.URL)
-			key := generateKey(r.URL.String())
-
-			params := r.URL.Query()
-			if _, ok := params[c.releaseKey]; ok {
-				delete(params, c.releaseKey)
-
-				r.URL.RawQuery = params.Encode()
-				key = generateKey(r.URL.String())
-
-				c.adapter.Release(key)
-			} else {
-				b, ok := c.adapter.Get(key)
-				response := BytesToResponse(b)
-				if ok {
-					if response.Expiration.After(time.Now()) {
-						response.LastAccess = time.Now()
-						response.Frequency++
-						c.adapter.Set(key, response.Bytes(), response.Expiration)
-
-						w.WriteHeader(http.StatusFound)
-						w.Write(response.Value)
-						return
-					}
-
-					c.adapter.Release(key)
-				}
-			}
+		c.Handle(w, r, next)
+	})
+}
+
+// Handle serves a request as the middleware does, from the cache or from
+// next, and returns how, e.g. for tests to assert it.
+func (c *Client) Handle(w http.ResponseWriter, r *http.Request, next http.Handler) Status {
+	start := time.Now()
+	event := c.handle(w, r, next)
 
-			rec := httptest.NewRecorder()
-			next.ServeHTTP(rec, r)
+	if c.onEvent != nil {
+		event.Request = r
+		event.Duration = time.Since(start)
+		c.onEvent(event)
+	}
 
-			statusCode := rec.Result().StatusCode
-			if statusCode < 400 {
-				now := time.Now()
-				value := rec.Body.Bytes()
+	return event.Status
+}
 
-				response := Response{
-					Value:      value,
-					Expiration: now.Add(c.ttl),
-					LastAccess: now,
-					Frequency:  1,
-				}
-				c.adapter.Set(key, response.Bytes(), response.Expiration)
+// handle serves a request, from the cache or from next, and returns how.
+func (c *Client) handle(w http.ResponseWriter, r *http.Request, next http.Handler) CacheEvent {
+	if !c.cacheableRequest(r) {
+		next.ServeHTTP(w, r)
+		return CacheEvent{Status: StatusBypass}
+	}
 
-				w.WriteHeader(statusCode)
-				w.Write(value)
+	if c.release(w, r, next) {
+		return CacheEvent{Status: StatusBypass}
+	}
+
+	key := c.requestKey(r)
+	base := key
+	var sampled, fallback, onTimeout *Response
+	flight := c.locker != nil
+	onlyIfCached := parseCacheControl(r.Header).has("only-if-cached")
+	if variant, response, ok := c.lookupResponse(r, key); ok {
+		key = variant
+		now := c.clock()
+		fresh := response.Expiration.After(now)
+
+		switch {
+		case onlyIfCached:
+			if fresh && !c.exceedsMaxAge(response, now) || c.staleAccepted(r, response, now) {
+				return c.serveCached(w, r, key, response, fresh)
+			}
+			// Answered below with a 504, the handler is never called.
+		case c.exceedsMaxAge(response, now):
+			// Regenerated below, replacing the cached response.
+		case c.revalidationRequested(r, response, now):
+			// Regenerated below, replacing the cached response.
+			flight = false
+		case c.bypassSampled():
+			// Regenerated below, replacing the cached response, and
+			// compared with it.
+			sampled, flight = &response, false
+		case fresh || c.hardExpiration(response).After(now):
+			response.LastAccess = now
+			response.Frequency++
+			c.store(r.Context(), key, response)
+
+			if !fresh {
+				c.revalidate(key, next, r)
+			}
+
+			return c.serveCached(w, r, key, response, fresh)
+		case c.staleAccepted(r, response, now):
+			return c.serveCached(w, r, key, response, false)
+		case response.StaleIfError > 0 && !now.After(response.Expiration.Add(response.StaleIfError)):
+			// Regenerated below, falling back to the cached response if
+			// the handler fails.
+			fallback = &response
+			if c.timesOut(r) {
+				onTimeout = &response
 			}
+		case c.timesOut(r):
+			// Regenerated below, falling back to the cached response if
+			// the deadline of the request passes first.
+			onTimeout = &response
+		default:
+			c.remove(r.Context(), key)
+		}
+	} else if c.headFromGet && r.Method == "HEAD" {
+		if event, ok := c.serveHeadFromGet(w, r); ok {
+			return event
+		}
+	}
+
+	if onlyIfCached {
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return CacheEvent{Key: key, Status: StatusMiss}
+	}
+
+	if flight {
+		response, cached, locked := c.awaitFlight(r, key)
+		if cached {
+			return c.serveCached(w, r, key, response, true)
+		}
+		if locked {
+			defer c.unlock(key)
+		}
+	}
+
+	rec := newRecorder(w, c.maxBodyBytes, c.cacheHeaders())
+	if onTimeout != nil {
+		var ok bool
+		if rec, ok = c.serveWithin(r, key, next); !ok {
+			event := c.serveCached(w, r, key, *onTimeout, false)
+			event.BackendTimeout = true
+			return event
+		}
+	} else {
+		next.ServeHTTP(rec, r)
+	}
+	if rec.passthrough {
+		return CacheEvent{Key: key, Status: StatusMiss, Size: rec.size}
+	}
+
+	res := rec.Result()
+	statusCode, status := res.StatusCode, c.status(res)
+	if fallback != nil && classify(status) == classError {
+		event := c.serveCached(w, r, key, *fallback, false)
+		event.BackendError = true
+		return event
+	}
+
+	skip := c.skipRequested(res.Header) || !rec.wrote || rec.flushed
+	response := c.newResponse(r, statusCode, res.Header, rec.Body.Bytes(), c.clock())
+	response.Trailer = storedTrailer(res.Trailer)
+	if !skip && c.cacheable(r, status, response) && c.admitted(base) {
+		if c.generateETag && res.Header.Get("ETag") == "" {
+			res.Header.Set("ETag", generateETag(response.Value))
+			response.Header.Set("ETag", res.Header.Get("ETag"))
+		}
+		c.storeVaried(r, base, response)
+	}
+	if sampled != nil && c.onDrift != nil && !bytes.Equal(sampled.Value, response.Value) {
+		c.onDrift(r, sampled.Value, response.Value)
+	}
+
+	writeResponse(w, r, statusCode, res.Header, response.Trailer, response.Value)
+	return CacheEvent{
+		Key:          key,
+		Status:       StatusMiss,
+		Size:         len(response.Value),
+		BackendError: classify(status) == classError,
+	}
+}
+
+// status returns the status code a response served by next is judged by.
+func (c *Client) status(res *http.Response) int {
+	if c.statusFunc != nil {
+		return c.statusFunc(res)
+	}
+
+	return res.StatusCode
+}
+
+// newResponse builds the response to be cached from the status code, header
+// and body served by next. The Surrogate-Control and TTL headers, meant for
+// the cache only, are consumed.
+func (c *Client) newResponse(r *http.Request, statusCode int, header http.Header, body []byte, now time.Time) Response {
+	ttl := c.ttl
+	if c.ttlBySize != nil {
+		if v := c.ttlBySize(len(body)); v > 0 {
+			ttl = v
+		}
+	}
+	if v, ok := c.statusTTL(statusCode); ok {
+		ttl = v
+	}
+	if c.surrogateControl {
+		if maxAge, ok := parseDirectives(header["Surrogate-Control"]).duration("max-age"); ok {
+			ttl = maxAge
+		}
+		header.Del("Surrogate-Control")
+	}
+	if c.ttlHeader != "" {
+		if v, ok := parseSeconds(header.Get(c.ttlHeader)); ok {
+			ttl = v
 		}
+		header.Del(c.ttlHeader)
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	cc := parseCacheControl(header)
+	response := Response{
+		Value:      body,
+		Header:     sharedHeader(header, c.storeHeaders),
+		StatusCode: statusCode,
+		Expiration: now.Add(ttl),
+		StoredAt:   now,
+		LastAccess: now,
+		Frequency:  1,
+		Immutable:  cc.has("immutable"),
+	}
+	response.StaleIfError, _ = cc.duration("stale-if-error")
+	response.LastModified = now
+	if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		response.LastModified = t
+	}
+	staleWhileRevalidate := c.staleWhileRevalidate
+	if v, ok := cc.duration("stale-while-revalidate"); ok {
+		staleWhileRevalidate = v
+	}
+	response.HardExpiration = response.Expiration.Add(staleWhileRevalidate)
+	if max := now.Add(c.maxTTL); c.maxTTL > 0 && response.HardExpiration.After(max) {
+		response.HardExpiration = max
+	}
+	if c.storeRequestURL {
+		response.URL = c.canonicalURL(r).String()
+	}
+
+	return response
+}
+
+// statusTTL returns the TTL mapped by TTLByStatus to a status code, or else to
+// its class.
+func (c *Client) statusTTL(statusCode int) (time.Duration, bool) {
+	if ttl, ok := c.ttlByStatus[statusCode]; ok {
+		return ttl, true
+	}
+
+	ttl, ok := c.ttlByStatus[statusCode/100*100]
+	return ttl, ok
+}
+
+// KeyFor returns the cache key the middleware uses for a request, without
+// touching the adapter.
+func (c *Client) KeyFor(r *http.Request) uint64 {
+	return c.requestKey(r)
+}
+
+// KeyForURL returns the cache key the middleware uses for a request of a
+// given method and URL. The URL must be as seen by the middleware: for a
+// server, the request URI (e.g. /users?id=1), not an absolute URL. Request
+// headers folded into the key by the configuration are taken as absent.
+func (c *Client) KeyForURL(method, rawurl string) (uint64, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.requestKey(&http.Request{Method: method, URL: u, Header: http.Header{}}), nil
+}
+
+// Flush frees every cached response. It returns an error if the adapter
+// does not implement FlushableAdapter.
+func (c *Client) Flush() (err error) {
+	fa, ok := c.adapter.(FlushableAdapter)
+	if _, flushable := unwrapAdapter(c.adapter).(FlushableAdapter); !ok || !flushable {
+		return errors.New("cache client adapter does not support flushing")
+	}
+
+	err = errors.New("cache client adapter failed to flush")
+	defer c.recoverAdapter("Flush")
+
+	fa.Flush()
+
+	return nil
+}
+
+// Inspect returns the cached response of a request, without updating its
+// access statistics. It also returns true or false, whether it exists or not.
+func (c *Client) Inspect(r *http.Request) (Response, bool) {
+	key := c.requestKey(r)
+	b, ok := c.get(r.Context(), key)
+	if !ok {
+		return Response{}, false
+	}
+
+	_, response, ok := c.variant(r, key, c.decode(b), func(k uint64) ([]byte, bool) {
+		return c.get(r.Context(), k)
 	})
+	return response, ok
 }
 
-// BytesToResponse converts bytes array into Response data structure.
-func BytesToResponse(b []byte) Response {
-	var r Response
-	dec := gob.NewDecoder(bytes.NewReader(b))
-	dec.Decode(&r)
+// TTL returns the remaining freshness of the cached response of a request. It
+// also returns true or false, whether a fresh response is cached or not.
+func (c *Client) TTL(r *http.Request) (time.Duration, bool) {
+	response, ok := c.Inspect(r)
+	if !ok {
+		return 0, false
+	}
 
-	return r
+	ttl := response.Expiration.Sub(c.clock())
+	if ttl <= 0 {
+		return 0, false
+	}
+
+	return ttl, true
 }
 
-// Bytes converts Response data structure into bytes array.
-func (r Response) Bytes() []byte {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	enc.Encode(&r)
+// SetKeySalt replaces the salt mixed into every cache key, making every
+// response cached with the previous one unreachable.
+func (c *Client) SetKeySalt(salt string) {
+	c.keySalt.Store(salt)
+}
 
-	return b.Bytes()
+// SetEnabled enables or disables caching at runtime, e.g. during an incident.
+// While disabled, every request is passed through to the handler, but cached
+// responses are kept for when caching is enabled again. Caching is enabled by
+// default.
+func (c *Client) SetEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+
+	atomic.StoreInt32(&c.disabled, disabled)
 }
 
-func sortURLParams(URL *url.URL) {
-	params := URL.Query()
-	for _, param := range params {
-		sort.Slice(param, func(i, j int) bool {
-			return param[i] < param[j]
-		})
+// cacheableRequest reports whether a request is to be looked up and cached.
+// Other requests are passed through to next.
+func (c *Client) cacheableRequest(r *http.Request) bool {
+	if atomic.LoadInt32(&c.disabled) == 1 {
+		return false
+	}
+	if c.strictGET && r.Method != "GET" {
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "" && c.idempotencyKey(r) == "" &&
+		!(r.Method == "OPTIONS" && c.cacheOptions) {
+		return false
+	}
+	if c.skipHTTP10 && r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+		return false
+	}
+
+	for _, prefix := range c.excludePaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	if len(c.includePaths) == 0 {
+		return true
+	}
+	for _, prefix := range c.includePaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
 	}
-	URL.RawQuery = params.Encode()
+
+	return false
 }
 
-func generateKey(URL string) uint64 {
-	hash := fnv.New64a()
-	hash.Write([]byte(URL))
+// revalidationRequested reports whether the client asks for a cached response
+// to be regenerated, with a min-fresh request directive the response does not
+// satisfy or, if HonorRequestNoCache is set, with the no-cache one. Fresh
+// immutable responses are guaranteed not to change and are served anyway on
+// no-cache.
+func (c *Client) revalidationRequested(r *http.Request, response Response, now time.Time) bool {
+	cc := parseCacheControl(r.Header)
+	if minFresh, ok := cc.duration("min-fresh"); ok && !response.Expiration.After(now.Add(minFresh)) {
+		return true
+	}
+	if !c.requestNoCache || response.Immutable && response.Expiration.After(now) {
+		return false
+	}
 
-	return hash.Sum64()
+	return cc.has("no-cache")
 }
 
-// NewClient initializes the cache HTTP middleware client with a given
-// configuration.
-func NewClient(cfg *Config) (*Client, error) {
-	if cfg.Adapter == nil {
-		return nil, errors.New("cache client requires an adapter")
+// bypassSampled reports whether a cached response is to be regenerated to
+// validate it, as part of the BypassSampleRate of requests.
+func (c *Client) bypassSampled() bool {
+	if c.bypassRate <= 0 {
+		return false
+	}
+	if c.random != nil {
+		return c.random() < c.bypassRate
 	}
 
-	if int64(cfg.TTL) < 1 {
-		return nil, errors.New("cache client requires a valid ttl")
+	return rand.Float64() < c.bypassRate
+}
+
+// staleAccepted reports whether the client accepts, with the max-stale request
+// directive, a stale response as old as a cached one. Without argument, the
+// directive accepts any staleness.
+func (c *Client) staleAccepted(r *http.Request, response Response, now time.Time) bool {
+	cc := parseCacheControl(r.Header)
+	if !cc.has("max-stale") {
+		return false
+	}
+	if cc["max-stale"] == "" {
+		return true
 	}
 
-	c := &Client{
-		adapter:    cfg.Adapter,
-		ttl:        cfg.TTL,
-		releaseKey: cfg.ReleaseKey,
+	maxStale, ok := cc.duration("max-stale")
+	return ok && !now.After(response.Expiration.Add(maxStale))
+}
+
+// serveCached writes a cached response to the client, once transformed by the
+// AfterLoad hook, and returns the corresponding event. Stale responses are
+// served with a warning.
+func (c *Client) serveCached(w http.ResponseWriter, r *http.Request, key uint64, response Response, fresh bool) CacheEvent {
+	if c.afterLoad != nil {
+		c.afterLoad(&response, r)
+	}
+	if c.compressOnServe {
+		response = c.compressed(r, key, response)
+	}
+
+	status, header := StatusHit, sharedHeader(response.Header, nil)
+	if !fresh {
+		status = StatusStale
+		header.Add("Warning", `110 - "Response is Stale"`)
+	}
+
+	if c.generateETag && r.Method != "OPTIONS" && etagMatches(r.Header.Get("If-None-Match"), header.Get("ETag")) {
+		writeNotModified(w, header)
+		return CacheEvent{Key: key, Status: status}
+	}
+
+	if r.Method == "OPTIONS" {
+		statusCode := response.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		writeResponse(w, r, statusCode, header, response.Trailer, response.Value)
+	} else if c.serveContent {
+		for k, v := range storedHeader(header, nil) {
+			w.Header()[k] = v
+		}
+		// http.ServeContent leaves the length of encoded bodies unset, which
+		// makes them chunked, and the stored one may be stale.
+		w.Header().Del("Content-Length")
+		if w.Header().Get("Content-Encoding") != "" && r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(response.Value)))
+		}
+		http.ServeContent(w, r, "", response.LastModified, bytes.NewReader(response.Value))
+	} else {
+		writeResponse(w, r, http.StatusFound, header, response.Trailer, response.Value)
+	}
+
+	return CacheEvent{Key: key, Status: status, Size: len(response.Value)}
+}
+
+// cacheable reports whether a response served by next is to be cached.
+// Responses to requests cancelled meanwhile, e.g. by a client disconnect, may
+// be incomplete and are never cached. Bodies of responses to HEAD requests are
+// always empty, as are usually the ones to OPTIONS requests, so their size is
+// not checked.
+func (c *Client) cacheable(r *http.Request, statusCode int, response Response) bool {
+	if r.Context().Err() != nil {
+		return false
+	}
+	if c.cacheableStatus != nil {
+		if !c.cacheableStatus(statusCode) {
+			return false
+		}
+	} else if classify(statusCode) != classFresh {
+		return false
+	}
+	if r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return true
+	}
+	if c.skipEmptyBody && len(response.Value) == 0 {
+		return false
+	}
+	if len(response.Value) < c.minBodyBytes {
+		return false
+	}
+	if c.maxBodyBytes > 0 && len(response.Value) > c.maxBodyBytes {
+		return false
+	}
+
+	return true
+}
+
+// cacheHeaders returns the response headers meant for the cache only, which
+// are consumed by newResponse and skipRequested instead of being served.
+func (c *Client) cacheHeaders() []string {
+	var headers []string
+	if c.surrogateControl {
+		headers = append(headers, "Surrogate-Control")
+	}
+	if c.ttlHeader != "" {
+		headers = append(headers, c.ttlHeader)
+	}
+	if c.skipHeader != "" {
+		headers = append(headers, c.skipHeader)
+	}
+
+	return headers
+}
+
+// skipRequested reports whether a handler opted out of caching its response
+// with the SkipResponseHeader, which it then strips, or whether the response
+// is an authentication challenge or lacks the explicit freshness required.
+func (c *Client) skipRequested(header http.Header) bool {
+	skip := false
+	if c.skipHeader != "" {
+		_, skip = header[c.skipHeader]
+		delete(header, c.skipHeader)
+	}
+	if !c.authChallenges && (header.Get("WWW-Authenticate") != "" || header.Get("Proxy-Authenticate") != "") {
+		skip = true
+	}
+	if c.explicitFresh && !explicitFreshness(header) {
+		skip = true
+	}
+
+	return skip
+}
+
+// revalidate queues the refresh of a stale response in background. The
+// request is detached from the cancellation of its context, which ends with
+// the client response.
+func (c *Client) revalidate(key uint64, next http.Handler, r *http.Request) {
+	r = r.WithContext(detachedContext{r.Context()})
+
+	// Responses may carry their own stale-while-revalidate window, without
+	// the one of the client being set.
+	c.revalidatorOnce.Do(func() {
+		if c.revalidator == nil {
+			c.revalidator = newRevalidator(c.revalidateWorkers)
+		}
+	})
+	c.revalidator.enqueue(key, func() {
+		rec := newRecorder(nil, c.maxBodyBytes, nil)
+		next.ServeHTTP(rec, r)
+		c.storeRecorded(r, rec)
+	})
+}
+
+// timesOut reports whether a request is to be served a stale response if its
+// deadline passes before the handler responds.
+func (c *Client) timesOut(r *http.Request) bool {
+	if !c.staleOnTimeout {
+		return false
+	}
+
+	_, ok := r.Context().Deadline()
+	return ok
+}
+
+// serveWithin runs next detached from the deadline of a request and returns
+// its recorded response, unless the deadline passes first, in which case the
+// response is cached once recorded.
+func (c *Client) serveWithin(r *http.Request, key uint64, next http.Handler) (*recorder, bool) {
+	detached := r.WithContext(detachedContext{r.Context()})
+	rec := newRecorder(nil, 0, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		next.ServeHTTP(rec, detached)
+	}()
+
+	select {
+	case <-done:
+		return rec, true
+	case <-r.Context().Done():
+		go func() {
+			<-done
+			c.storeRecorded(detached, rec)
+		}()
+		return nil, false
+	}
+}
+
+// storeRecorded caches the response recorded from next for a request, unless
+// it is skipped or not cacheable.
+func (c *Client) storeRecorded(r *http.Request, rec *recorder) {
+	if rec.passthrough {
+		return
+	}
+
+	res := rec.Result()
+	statusCode, status := res.StatusCode, c.status(res)
+	skip := c.skipRequested(res.Header) || !rec.wrote || rec.flushed
+	response := c.newResponse(r, statusCode, res.Header, rec.Body.Bytes(), c.clock())
+	response.Trailer = storedTrailer(res.Trailer)
+	if !skip && c.cacheable(r, status, response) {
+		c.storeVaried(r, c.requestKey(r), response)
+	}
+}
+
+// storeNew caches a response served by next, once transformed by the
+// BeforeStore hook. The hook works on a copy of the body, so the response
+// served to the client is not affected.
+func (c *Client) storeNew(ctx context.Context, key uint64, response Response) {
+	if c.beforeStore != nil {
+		response.Value = append([]byte(nil), response.Value...)
+		c.beforeStore(&response)
+	}
+
+	c.store(ctx, key, response)
+}
+
+// store caches a response. The adapter keeps it until its hard expiration, so
+// it can be served stale.
+func (c *Client) store(ctx context.Context, key uint64, response Response) {
+	if c.verifyChecksum && response.Checksum == nil {
+		response.Checksum = checksum(response.Value)
+	}
+
+	if sa, ok := c.adapter.(StreamAdapter); ok {
+		c.stream(sa, key, response)
+		return
+	}
+
+	c.set(ctx, key, c.encode(response), c.retention(response))
+}
+
+// hardExpiration returns the date past which a response is treated as absent.
+func (c *Client) hardExpiration(response Response) time.Time {
+	if response.HardExpiration.IsZero() {
+		return response.Expiration.Add(c.staleWhileRevalidate)
+	}
+
+	return response.HardExpiration
+}
+
+// serveHeadFromGet serves a HEAD request from the fresh response cached for
+// the GET request of the same URL, if any.
+func (c *Client) serveHeadFromGet(w http.ResponseWriter, r *http.Request) (CacheEvent, bool) {
+	get := *r
+	get.Method = "GET"
+	key := c.requestKey(&get)
+
+	key, response, ok := c.lookupResponse(&get, key)
+	if !ok {
+		return CacheEvent{}, false
+	}
+	now := c.clock()
+	if !response.Expiration.After(now) || c.exceedsMaxAge(response, now) ||
+		c.revalidationRequested(r, response, now) {
+		return CacheEvent{}, false
+	}
+
+	return c.serveCached(w, r, key, response, true), true
+}
+
+// exceedsMaxAge reports whether a response was stored longer than the
+// absolute max age ago.
+func (c *Client) exceedsMaxAge(response Response, now time.Time) bool {
+	return c.absoluteMaxAge > 0 && !response.StoredAt.IsZero() &&
+		now.Sub(response.StoredAt) > c.absoluteMaxAge
+}
+
+// retention returns the date until which a response is kept by the adapter:
+// its hard expiration, or the end of its stale-if-error window if later, at
+// most MaxTTL after it was stored.
+func (c *Client) retention(response Response) time.Time {
+	retention := c.hardExpiration(response)
+	if end := response.Expiration.Add(response.StaleIfError); end.After(retention) {
+		retention = end
+	}
+	if max := response.StoredAt.Add(c.maxTTL); c.maxTTL > 0 && !response.StoredAt.IsZero() && retention.After(max) {
+		retention = max
+	}
+
+	return retention
+}
+
+// encode returns the bytes of a response to be cached, encoded by the codec.
+func (c *Client) encode(response Response) []byte {
+	if c.codec == nil {
+		return response.Bytes()
+	}
+
+	return c.codec.Encode(response)
+}
+
+// decode returns the response of cached bytes, decoded by the codec.
+func (c *Client) decode(b []byte) Response {
+	if c.codec == nil {
+		return BytesToResponse(b)
+	}
+
+	return c.codec.Decode(b)
+}
+
+func (c *Client) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+
+	return time.Now()
+}
+
+// get retrieves a cached response from the adapter, retrying transient
+// errors of context adapters. An error is reported as a miss.
+func (c *Client) get(ctx context.Context, key uint64) (b []byte, ok bool) {
+	defer c.recoverAdapter("Get")
+
+	ca, isCtx := c.adapter.(ContextAdapter)
+	if !isCtx {
+		return c.adapter.Get(key)
+	}
+
+	// The results are only set by a call which did not fail, so that a
+	// recovered panic is reported as a miss.
+	err := c.retry(ctx, func() error {
+		got, found, err := ca.GetCtx(ctx, key)
+		if err == nil {
+			b, ok = got, found
+		}
+		return err
+	})
+	if (err != nil || !ok) && c.fallback != nil {
+		return c.fallback.Get(key)
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	return b, ok
+}
+
+// set caches a response in the adapter, retrying transient errors of context
+// adapters. The write is dropped if every attempt fails.
+func (c *Client) set(ctx context.Context, key uint64, response []byte, expiration time.Time) {
+	defer c.recoverAdapter("Set")
+
+	ca, ok := c.adapter.(ContextAdapter)
+	if !ok {
+		c.adapter.Set(key, response, expiration)
+		return
+	}
+
+	err := c.retry(ctx, func() error {
+		return ca.SetCtx(ctx, key, response, expiration)
+	})
+	if err == nil {
+		return
+	}
+
+	switch c.setFailure {
+	case SetFailureReport:
+		c.logf("cache: adapter SetCtx failed: %v", err)
+	case SetFailureFallback:
+		c.fallback.Set(key, response, expiration)
+	}
+}
+
+// releaseRequest frees the cached response of a key for a release request,
+// after the release delay if any.
+func (c *Client) releaseRequest(ctx context.Context, key uint64) {
+	if b, ok := c.get(ctx, key); ok {
+		for _, k := range c.decode(b).Variants {
+			c.releaseDelayed(ctx, k)
+		}
+	}
+	c.releaseDelayed(ctx, key)
+}
+
+// releaseDelayed frees the cached response of a key, after the release delay
+// if any.
+func (c *Client) releaseDelayed(ctx context.Context, key uint64) {
+	if c.releaseDelay <= 0 {
+		c.remove(ctx, key)
+		return
+	}
+
+	defer c.recoverAdapter("ReleaseAfter")
+	c.adapter.(DelayedReleaseAdapter).ReleaseAfter(key, c.releaseDelay)
+}
+
+// lookup retrieves the cached response of a request. The responses of a
+// MetaAdapter past their expiration are released without being decoded,
+// unless the request accepts stale responses or may be served one on timeout.
+func (c *Client) lookup(r *http.Request, key uint64) ([]byte, bool) {
+	ma, ok := c.adapter.(MetaAdapter)
+	if !ok {
+		return c.get(r.Context(), key)
+	}
+
+	b, expiration, ok := c.getMeta(ma, key)
+	if ok && !expiration.IsZero() && !expiration.After(c.clock()) &&
+		!parseCacheControl(r.Header).has("max-stale") && !c.timesOut(r) {
+		c.remove(r.Context(), key)
+		return nil, false
+	}
+
+	return b, ok
+}
+
+func (c *Client) getMeta(ma MetaAdapter, key uint64) (b []byte, expiration time.Time, ok bool) {
+	defer c.recoverAdapter("GetMeta")
+
+	return ma.GetMeta(key)
+}
+
+// contextReleaser is implemented by adapters whose Release depends on the
+// request context, such as NamespacedAdapter.
+type contextReleaser interface {
+	ReleaseCtx(ctx context.Context, key uint64) error
+}
+
+// wrappingAdapter is implemented by adapter wrappers, such as MirrorAdapter,
+// which implement the optional interfaces whatever the adapter they wrap
+// supports.
+type wrappingAdapter interface {
+	unwrap() Adapter
+}
+
+// unwrapAdapter returns the adapter wrapped by adapter wrappers, if any, whose
+// optional interfaces are the ones supported.
+func unwrapAdapter(adapter Adapter) Adapter {
+	for {
+		w, ok := adapter.(wrappingAdapter)
+		if !ok {
+			return adapter
+		}
+		adapter = w.unwrap()
+	}
+}
+
+// getCtx calls GetCtx on context adapters, or else Get.
+func getCtx(ctx context.Context, adapter Adapter, key uint64) ([]byte, bool, error) {
+	if ca, ok := adapter.(ContextAdapter); ok {
+		return ca.GetCtx(ctx, key)
+	}
+
+	b, ok := adapter.Get(key)
+	return b, ok, nil
+}
+
+// setCtx calls SetCtx on context adapters, or else Set.
+func setCtx(ctx context.Context, adapter Adapter, key uint64, response []byte, expiration time.Time) error {
+	if ca, ok := adapter.(ContextAdapter); ok {
+		return ca.SetCtx(ctx, key, response, expiration)
+	}
+
+	adapter.Set(key, response, expiration)
+	return nil
+}
+
+// releaseCtx calls ReleaseCtx on adapters implementing it, or else Release.
+func releaseCtx(ctx context.Context, adapter Adapter, key uint64) error {
+	if cr, ok := adapter.(contextReleaser); ok {
+		return cr.ReleaseCtx(ctx, key)
+	}
+
+	adapter.Release(key)
+	return nil
+}
+
+// remove frees the cached response of a key from the adapter.
+func (c *Client) remove(ctx context.Context, key uint64) {
+	defer c.recoverAdapter("Release")
+
+	if c.fallback != nil {
+		c.fallback.Release(key)
+	}
+
+	if cr, ok := c.adapter.(contextReleaser); ok {
+		c.retry(ctx, func() error {
+			return cr.ReleaseCtx(ctx, key)
+		})
+		return
+	}
+
+	c.adapter.Release(key)
+}
+
+// recoverAdapter recovers from a panic of an adapter call and logs it, unless
+// recovery is disabled. It is deferred by the methods calling the adapter, so
+// that a buggy adapter does not take the request down.
+func (c *Client) recoverAdapter(op string) {
+	if c.disablePanicRecovery {
+		return
+	}
+
+	if err := recover(); err != nil {
+		c.logf("cache: adapter %s panicked: %v", op, err)
+	}
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.onError != nil {
+		c.onError(fmt.Errorf(format, args...))
+	}
+	if c.errorLog != nil {
+		c.errorLog.Printf(format, args...)
+		return
+	}
+
+	log.Printf(format, args...)
+}
+
+// retry calls fn until it succeeds, the attempts allowed by the retry policy
+// are exhausted or the context is done.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	attempts := c.adapterRetry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; ; i++ {
+		if err = fn(); err == nil || i == attempts-1 {
+			return err
+		}
+
+		t := time.NewTimer(c.adapterRetry.delay(i))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// delay returns the jittered backoff before the given retry, numbered from
+// zero.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// BytesToResponse converts bytes array, encoded by gob or by BinaryCodec,
+// into Response data structure.
+func BytesToResponse(b []byte) Response {
+	if isBinary(b) {
+		return decodeBinary(b)
+	}
+
+	var r Response
+	rd := bytes.NewReader(b)
+	dec := gob.NewDecoder(rd)
+	dec.Decode(&r)
+
+	// Responses streamed to a StreamAdapter are followed by their raw body.
+	if r.Value == nil && rd.Len() > 0 {
+		r.Value = b[len(b)-rd.Len():]
+	}
+
+	return r
+}
+
+// Bytes converts Response data structure into bytes array.
+func (r Response) Bytes() []byte {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	enc.Encode(&r)
+
+	return b.Bytes()
+}
+
+// release handles release and purge-all requests. It returns false for
+// other requests, which are left to the caller.
+func (c *Client) release(w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+	params := r.URL.Query()
+
+	_, purge := params[c.purgeAllKey]
+	purge = purge && c.purgeAllKey != "" && c.releaseAuth != nil
+	if !purge && !c.releaseRequested(params) {
+		return false
+	}
+
+	if c.releaseAuth != nil && !c.releaseAuth(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return true
+	}
+
+	var confirmation interface{}
+	if purge {
+		confirmation = struct {
+			Flushed bool `json:"flushed"`
+		}{c.Flush() == nil}
+	} else {
+		key := c.requestKey(r)
+		c.releaseRequest(r.Context(), key)
+		confirmation = struct {
+			Released bool   `json:"released"`
+			Key      uint64 `json:"key"`
+		}{true, key}
+	}
+
+	if c.releaseResponse {
+		writeReleaseResponse(w, confirmation)
+	} else {
+		next.ServeHTTP(w, r)
+	}
+
+	return true
+}
+
+// releaseRequested reports whether the params of a request carry one of the
+// release keys.
+func (c *Client) releaseRequested(params url.Values) bool {
+	if _, ok := params[c.releaseKey]; ok && c.releaseKey != "" {
+		return true
+	}
+	for _, k := range c.releaseKeys {
+		if _, ok := params[k]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeReleaseResponse confirms to the client that a release was done.
+func writeReleaseResponse(w http.ResponseWriter, confirmation interface{}) {
+	b, _ := json.Marshal(confirmation)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// recorder buffers the response of a handler, reporting whether it wrote
+// anything. Past limit bytes of body, when set, the buffered response is
+// written to dst, if any, and so is the rest of the body, unbuffered.
+type recorder struct {
+	*httptest.ResponseRecorder
+	wrote       bool
+	limit       int
+	dst         http.ResponseWriter
+	passthrough bool
+	flushed     bool
+	size        int
+	// cacheHeaders are stripped from the response passed through to dst.
+	cacheHeaders []string
+}
+
+func newRecorder(dst http.ResponseWriter, limit int, cacheHeaders []string) *recorder {
+	return &recorder{ResponseRecorder: httptest.NewRecorder(), dst: dst, limit: limit, cacheHeaders: cacheHeaders}
+}
+
+// Header implements the http.ResponseWriter interface Header method.
+func (rec *recorder) Header() http.Header {
+	if rec.passthrough && rec.dst != nil {
+		return rec.dst.Header()
+	}
+
+	return rec.ResponseRecorder.Header()
+}
+
+// WriteHeader implements the http.ResponseWriter interface WriteHeader method.
+func (rec *recorder) WriteHeader(statusCode int) {
+	rec.wrote = true
+	rec.ResponseRecorder.WriteHeader(statusCode)
+}
+
+// Write implements the http.ResponseWriter interface Write method.
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wrote = true
+	rec.size += len(b)
+	if !rec.passthrough && rec.limit > 0 && rec.Body.Len()+len(b) > rec.limit {
+		rec.pass()
+	}
+	if rec.passthrough {
+		if rec.dst == nil {
+			return len(b), nil
+		}
+		return rec.dst.Write(b)
+	}
+
+	return rec.ResponseRecorder.Write(b)
+}
+
+// WriteString implements the io.StringWriter interface WriteString method.
+func (rec *recorder) WriteString(str string) (int, error) {
+	return rec.Write([]byte(str))
+}
+
+// Flush implements the http.Flusher interface Flush method. Flushing handlers,
+// such as SSE or long-poll ones, stream their response, which is not cached:
+// it is passed through to dst as written from the first flush.
+func (rec *recorder) Flush() {
+	rec.wrote = true
+	rec.flushed = true
+	if !rec.passthrough && rec.dst != nil {
+		rec.pass()
+	}
+	if !rec.passthrough {
+		rec.ResponseRecorder.Flush()
+	} else if f, ok := rec.dst.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// pass writes the response buffered so far to dst and releases the buffer,
+// the rest of the body being written to dst directly.
+func (rec *recorder) pass() {
+	rec.passthrough = true
+	rec.ResponseRecorder.WriteHeader(http.StatusOK)
+	if rec.dst != nil {
+		header := storedHeader(rec.ResponseRecorder.Header(), nil)
+		for _, k := range rec.cacheHeaders {
+			header.Del(k)
+		}
+		for k, v := range header {
+			rec.dst.Header()[k] = v
+		}
+		rec.dst.WriteHeader(rec.Code)
+		if rec.Body.Len() > 0 {
+			rec.dst.Write(rec.Body.Bytes())
+		}
+	}
+	rec.Body = nil
+}
+
+// writeResponse writes a buffered response to the client, without its
+// hop-by-hop headers. Content-Length is computed from the body, since the
+// buffered header may lack it (e.g. chunked responses) or carry a stale value.
+// HEAD handlers may omit the body, in which case the length they declared is
+// kept. A response with a trailer is sent chunked, announcing the trailer keys
+// in the Trailer header.
+func writeResponse(w http.ResponseWriter, r *http.Request, statusCode int, header, trailer http.Header, body []byte) {
+	for k, v := range storedHeader(header, nil) {
+		w.Header()[k] = v
+	}
+	for k := range trailer {
+		w.Header().Add("Trailer", k)
+	}
+	if (r.Method != "HEAD" || len(body) > 0) && len(trailer) == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	w.WriteHeader(statusCode)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+	for k, v := range trailer {
+		w.Header()[k] = v
+	}
+}
+
+func sortURLParams(URL *url.URL) {
+	sortURLQuery(URL, true, nil)
+}
+
+// sortURLQuery sorts the values of the params of a URL if sortValues is set,
+// and encodes them back with encode, by default RFC3986QueryEncoder, which
+// sorts them by key.
+func sortURLQuery(URL *url.URL, sortValues bool, encode func(url.Values) string) {
+	if encode == nil {
+		if sortedQuery(URL.RawQuery, sortValues) {
+			return
+		}
+		encode = RFC3986QueryEncoder
+	}
+
+	// Queries which do not parse, e.g. with a semicolon or an invalid
+	// escape, are kept as is: the params dropped by the parser would
+	// otherwise be missing from the key, shared with other URLs.
+	params, err := url.ParseQuery(URL.RawQuery)
+	if err != nil {
+		return
+	}
+	for _, param := range params {
+		if sortValues {
+			sort.Slice(param, func(i, j int) bool {
+				return param[i] < param[j]
+			})
+		}
+	}
+	URL.RawQuery = encode(params)
+}
+
+// RFC3986QueryEncoder encodes params sorted by key, as url.Values.Encode does,
+// but with spaces percent-encoded as %20 rather than +, as RFC 3986 does.
+// Either way, escapes are uppercase and unreserved characters are not escaped.
+func RFC3986QueryEncoder(params url.Values) string {
+	// Encode escapes + as %2B, so a + left in its output is a space.
+	return strings.Replace(params.Encode(), "+", "%20", -1)
+}
+
+// sortedQuery reports whether a raw query is already in the form produced by
+// sortURLQuery with RFC3986QueryEncoder: params sorted by key and, if values
+// is set, by value, none of them needing to be escaped. Re-encoding such a
+// query would yield the same string.
+func sortedQuery(query string, values bool) bool {
+	var prevKey, prevValue string
+	for i := 0; query != ""; i++ {
+		var pair string
+		if j := strings.IndexByte(query, '&'); j >= 0 {
+			pair, query = query[:j], query[j+1:]
+			if query == "" {
+				return false
+			}
+		} else {
+			pair, query = query, ""
+		}
+
+		j := strings.IndexByte(pair, '=')
+		if j < 0 {
+			return false
+		}
+		key, value := pair[:j], pair[j+1:]
+		if !unescaped(key) || !unescaped(value) {
+			return false
+		}
+		if i > 0 && (key < prevKey || values && key == prevKey && value < prevValue) {
+			return false
+		}
+		prevKey, prevValue = key, value
+	}
+
+	return true
+}
+
+// unescaped reports whether a string is left unchanged by url.QueryEscape.
+func unescaped(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			continue
+		}
+		if c != '-' && c != '_' && c != '.' && c != '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestKey generates the cache key of a request, salted with the key salt.
+func (c *Client) requestKey(r *http.Request) uint64 {
+	k := c.requestKeyString(r)
+	if salt, _ := c.keySalt.Load().(string); salt != "" {
+		k = salt + "\x00" + k
+	}
+
+	return generateKey(k)
+}
+
+// requestKeyString returns the string the key of a request is generated from:
+// its idempotency key if any, or else its canonical URL and varying headers.
+func (c *Client) requestKeyString(r *http.Request) string {
+	if v := c.idempotencyKey(r); v != "" {
+		return r.Method + "\x00idempotency=" + v
+	}
+
+	u := c.canonicalURL(r)
+	var route string
+	routed := false
+	if c.routeKeyFunc != nil {
+		route, routed = c.routeKeyFunc(r)
+	}
+	if routed {
+		u.Path = routePath(u.Path)
+		u.RawPath = ""
+	}
+
+	k := keyURL(r.Method, u)
+	if routed {
+		k += "\x00route=" + route
+	}
+	if c.keyScheme {
+		k += "\x00scheme=" + c.scheme(r)
+	}
+	if r.Method == "OPTIONS" {
+		k += "\x00" + headerValues(r.Header, preflightHeaders)
+	}
+	if c.varyAccept {
+		if v := acceptedMediaType(r.Header.Get("Accept")); v != "" {
+			k += "\x00accept=" + v
+		}
+	}
+	if len(c.acceptBuckets) > 0 {
+		if v := acceptedBucket(r.Header.Get("Accept"), c.acceptBuckets); v != "" {
+			k += "\x00bucket=" + v
+		}
+	}
+	if c.varyLanguage {
+		if v := acceptedLanguage(r.Header.Get("Accept-Language")); v != "" {
+			k += "\x00language=" + v
+		}
+	}
+	if len(c.varyEncoding) > 0 {
+		k += "\x00encoding=" + acceptedEncoding(r.Header.Get("Accept-Encoding"), c.varyEncoding)
+	}
+	if len(c.keyHeaders) > 0 {
+		k += "\x00" + headerValues(r.Header, c.keyHeaders)
+	}
+	if c.varyFunc != nil {
+		if v := c.varyFunc(r); v != "" {
+			k += "\x00" + v
+		}
+	}
+
+	return k
+}
+
+// preflightHeaders are the request headers keying the responses to OPTIONS
+// requests, canonical and sorted.
+var preflightHeaders = []string{
+	"Access-Control-Request-Headers",
+	"Access-Control-Request-Method",
+	"Origin",
+}
+
+// idempotencyKey returns the value of the IdempotencyKeyHeader of a request.
+func (c *Client) idempotencyKey(r *http.Request) string {
+	if c.idempotencyHeader == "" {
+		return ""
+	}
+
+	return r.Header.Get(c.idempotencyHeader)
+}
+
+// canonicalURL returns a copy of the request URL with sorted params and
+// without the release and purge-all keys nor empty params, so that /x, /x? and
+// /x?= share a key. The request URL itself is left untouched.
+func (c *Client) canonicalURL(r *http.Request) *url.URL {
+	u := *r.URL
+	u.ForceQuery = false
+	if c.keyPathOnly != nil && c.keyPathOnly(r) {
+		u.RawQuery = ""
+		return &u
+	}
+
+	if !c.disableParamSort {
+		u.RawQuery = removeEmptyParams(u.RawQuery)
+		sortURLQuery(&u, !c.preserveValues, c.queryEncoder)
+	}
+
+	if c.releaseKey != "" || len(c.releaseKeys) > 0 || c.purgeAllKey != "" {
+		u.RawQuery = removeParams(u.RawQuery, func(k string) bool {
+			if k == "" {
+				return false
+			}
+			if k == c.releaseKey || k == c.purgeAllKey {
+				return true
+			}
+			for _, rk := range c.releaseKeys {
+				if k == rk {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	return &u
+}
+
+// removeEmptyParams removes from a raw query the params with neither key nor
+// value, such as a lone "=", which are meaningless.
+func removeEmptyParams(query string) string {
+	if !strings.Contains("&"+query+"&", "&=&") {
+		return query
+	}
+
+	pairs := strings.Split(query, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		if pair != "=" {
+			kept = append(kept, pair)
+		}
+	}
+
+	return strings.Join(kept, "&")
+}
+
+// removeParams removes from a raw query the params whose unescaped key
+// matches, keeping the order of the others.
+func removeParams(query string, match func(key string) bool) string {
+	if query == "" {
+		return query
+	}
+
+	pairs := strings.Split(query, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		k := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			k = pair[:i]
+		}
+		if uk, err := url.QueryUnescape(k); err == nil {
+			k = uk
+		}
+		if !match(k) {
+			kept = append(kept, pair)
+		}
+	}
+
+	return strings.Join(kept, "&")
+}
+
+// scheme returns the scheme a request was made with.
+func (c *Client) scheme(r *http.Request) string {
+	if c.forwardedProto != "" {
+		if v := r.Header.Get(c.forwardedProto); v != "" {
+			return strings.ToLower(strings.TrimSpace(strings.Split(v, ",")[0]))
+		}
+	}
+	if r.URL.Scheme != "" {
+		return strings.ToLower(r.URL.Scheme)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// routePath returns the normalized path of a routed request, without dot
+// segments nor duplicate or trailing slashes.
+func routePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	return path.Clean("/" + p)
+}
+
+// keyURL returns the string a request key is generated from. Methods other
+// than GET are prefixed, so they do not share entries with it.
+func keyURL(method string, URL *url.URL) string {
+	if method == "GET" || method == "" {
+		return URL.String()
+	}
+
+	return method + " " + URL.String()
+}
+
+// generateKey returns the 64-bit FNV-1a hash of a URL. The hash is computed
+// inline, which avoids allocating a hash.Hash64 and a copy of the URL.
+func generateKey(URL string) uint64 {
+	hash := uint64(offset64)
+	for i := 0; i < len(URL); i++ {
+		hash ^= uint64(URL[i])
+		hash *= prime64
+	}
+
+	return hash
+}
+
+// NewClient initializes the cache HTTP middleware client with a given
+// configuration.
+func NewClient(cfg *Config) (*Client, error) {
+	if cfg.Adapter == nil {
+		return nil, errors.New("cache client requires an adapter")
+	}
+
+	if int64(cfg.TTL) < 1 {
+		return nil, errors.New("cache client requires a valid ttl")
+	}
+
+	for _, ttl := range cfg.TTLByStatus {
+		if ttl < 1 {
+			return nil, errors.New("cache client requires a valid ttl by status")
+		}
+	}
+
+	if cfg.AbsoluteMaxAge < 0 {
+		return nil, errors.New("cache client requires a valid absolute max age")
+	}
+
+	if cfg.MaxTTL < 0 {
+		return nil, errors.New("cache client requires a valid max ttl")
+	}
+
+	switch cfg.SetFailurePolicy {
+	case "", SetFailureIgnore, SetFailureReport:
+	case SetFailureFallback:
+		if cfg.FallbackAdapter == nil {
+			return nil, errors.New("cache client requires a fallback adapter for the fallback set failure policy")
+		}
+	default:
+		return nil, errors.New("cache client requires a valid set failure policy")
+	}
+
+	_, ok := unwrapAdapter(cfg.Adapter).(ContextAdapter)
+	if !ok && (cfg.SetFailurePolicy == SetFailureReport ||
+		cfg.SetFailurePolicy == SetFailureFallback || cfg.FallbackAdapter != nil) {
+		return nil, errors.New("cache client requires a context adapter for a set failure policy")
+	}
+
+	if cfg.AdapterRetry.MaxAttempts < 0 || cfg.AdapterRetry.BaseDelay < 0 ||
+		cfg.AdapterRetry.MaxDelay < 0 {
+		return nil, errors.New("cache client requires a valid adapter retry policy")
+	}
+
+	if cfg.StaleWhileRevalidate < 0 || cfg.RevalidateWorkers < 0 {
+		return nil, errors.New("cache client requires a valid stale-while-revalidate setting")
+	}
+
+	if cfg.MaxVaryVariants < 0 {
+		return nil, errors.New("cache client requires a valid max vary variants")
+	}
+
+	adapter := cfg.Adapter
+	if cfg.KeyPrefix != "" {
+		pa, ok := adapter.(PrefixableAdapter)
+		if !ok {
+			return nil, errors.New("cache client requires a prefixable adapter for a key prefix")
+		}
+		adapter = pa.WithKeyPrefix(cfg.KeyPrefix)
+	}
+
+	locker, ok := adapter.(LockingAdapter)
+	if cfg.DistributedSingleFlight && !ok {
+		return nil, errors.New("cache client requires a locking adapter for distributed single flight")
+	}
+
+	if cfg.ReleaseDelay < 0 {
+		return nil, errors.New("cache client requires a valid release delay")
+	}
+
+	if _, ok := adapter.(DelayedReleaseAdapter); cfg.ReleaseDelay > 0 && !ok {
+		return nil, errors.New("cache client requires a delayed release adapter for a release delay")
+	}
+
+	if cfg.SingleFlightTimeout < 0 {
+		return nil, errors.New("cache client requires a valid single flight timeout")
+	}
+
+	if cfg.BypassSampleRate < 0 || cfg.BypassSampleRate > 1 {
+		return nil, errors.New("cache client requires a bypass sample rate between 0 and 1")
+	}
+
+	if cfg.MinBodyBytes < 0 || cfg.MaxBodyBytes < 0 ||
+		(cfg.MaxBodyBytes > 0 && cfg.MinBodyBytes > cfg.MaxBodyBytes) {
+		return nil, errors.New("cache client requires a valid body size window")
+	}
+
+	if cfg.MinRequestsBeforeCache < 0 || cfg.MinRequestsWindow < 0 {
+		return nil, errors.New("cache client requires a valid min requests before cache")
+	}
+
+	c := &Client{
+		adapter:          adapter,
+		ttl:              cfg.TTL,
+		ttlBySize:        cfg.TTLBySize,
+		ttlByStatus:      cfg.TTLByStatus,
+		surrogateControl: cfg.SurrogateControl,
+		ttlHeader:        http.CanonicalHeaderKey(cfg.TTLHeader),
+		absoluteMaxAge:   cfg.AbsoluteMaxAge,
+		maxTTL:           cfg.MaxTTL,
+		requestNoCache:   cfg.HonorRequestNoCache,
+		adapterRetry:     cfg.AdapterRetry,
+
+		disablePanicRecovery: cfg.DisableAdapterPanicRecovery,
+		errorLog:             cfg.ErrorLog,
+		onError:              cfg.OnError,
+		verifyChecksum:       cfg.VerifyChecksum,
+
+		releaseKey:      cfg.ReleaseKey,
+		releaseKeys:     cfg.ReleaseKeys,
+		releaseDelay:    cfg.ReleaseDelay,
+		purgeAllKey:     cfg.PurgeAllKey,
+		releaseAuth:     cfg.ReleaseAuth,
+		releaseResponse: cfg.ReleaseResponse,
+
+		includePaths:      cfg.IncludePaths,
+		excludePaths:      cfg.ExcludePaths,
+		skipHTTP10:        cfg.SkipHTTP10,
+		strictGET:         cfg.StrictGET,
+		cacheOptions:      cfg.CacheOptions,
+		varyFunc:          cfg.VaryFunc,
+		routeKeyFunc:      cfg.RouteKeyFunc,
+		varyAccept:        cfg.VaryAccept,
+		acceptBuckets:     lowerTokens(cfg.VaryAcceptBuckets),
+		varyLanguage:      cfg.VaryAcceptLanguage,
+		varyEncoding:      lowerTokens(cfg.VaryAcceptEncoding),
+		defaultVary:       canonicalHeaderKeys(cfg.DefaultVary),
+		maxVaryVariants:   cfg.MaxVaryVariants,
+		keyHeaders:        canonicalHeaderKeys(cfg.KeyHeaders),
+		disableParamSort:  cfg.DisableParamSort,
+		preserveValues:    cfg.PreserveValueOrder,
+		queryEncoder:      cfg.QueryEncoder,
+		keyPathOnly:       cfg.KeyPathOnly,
+		keyScheme:         cfg.KeyIncludesScheme,
+		forwardedProto:    http.CanonicalHeaderKey(cfg.ForwardedProtoHeader),
+		idempotencyHeader: cfg.IdempotencyKeyHeader,
+
+		storeRequestURL: cfg.StoreRequestURL,
+		storeHeaders:    cfg.StoreHeaders,
+		cacheableStatus: cfg.Cacheable,
+		statusFunc:      cfg.StatusFunc,
+		skipEmptyBody:   cfg.SkipEmptyBody,
+		minBodyBytes:    cfg.MinBodyBytes,
+		maxBodyBytes:    cfg.MaxBodyBytes,
+		skipHeader:      http.CanonicalHeaderKey(cfg.SkipResponseHeader),
+		authChallenges:  cfg.CacheAuthChallenges,
+		explicitFresh:   cfg.RequireExplicitFreshness,
+		beforeStore:     cfg.BeforeStore,
+		afterLoad:       cfg.AfterLoad,
+		onEvent:         cfg.OnEvent,
+		onDrift:         cfg.OnDrift,
+		bypassRate:      cfg.BypassSampleRate,
+		serveContent:    cfg.UseServeContent,
+		headFromGet:     cfg.HeadFromGet,
+		compressOnServe: cfg.CompressOnServe,
+		generateETag:    cfg.GenerateETag,
+		now:             cfg.Clock,
+		codec:           cfg.Codec,
+	}
+
+	if cfg.KeySalt != "" {
+		c.keySalt.Store(cfg.KeySalt)
+	}
+
+	if cfg.StaleWhileRevalidate > 0 {
+		c.staleWhileRevalidate = cfg.StaleWhileRevalidate
+		c.revalidator = newRevalidator(cfg.RevalidateWorkers)
+	}
+	c.revalidateWorkers = cfg.RevalidateWorkers
+	c.staleOnTimeout = cfg.ServeStaleOnTimeout
+	c.coalesceCompute = cfg.CoalesceCompute
+
+	if cfg.MinRequestsBeforeCache > 1 {
+		c.minRequests = cfg.MinRequestsBeforeCache
+		window := cfg.MinRequestsWindow
+		if window == 0 {
+			window = defaultMinRequestsWindow
+		}
+		c.requestCounts = newRequestCounter(window)
+	}
+
+	c.setFailure = cfg.SetFailurePolicy
+	if cfg.SetFailurePolicy == SetFailureFallback {
+		c.fallback = cfg.FallbackAdapter
+	}
+
+	if cfg.DistributedSingleFlight {
+		c.locker = locker
+		c.flightTimeout = cfg.SingleFlightTimeout
+		if c.flightTimeout == 0 {
+			c.flightTimeout = defaultFlightTimeout
+		}
 	}
 
 	return c, nil
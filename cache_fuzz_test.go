@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FuzzRequestKey(f *testing.F) {
+	for _, seed := range []string{
+		"http://foo.bar/test-1",
+		"http://foo.bar/test-1?b=2&a=1",
+		"http://foo.bar/test-1?a=2&a=1&a=",
+		"http://foo.bar/test-1?=&a=1&&",
+		"http://foo.bar/test-1?a=%zz&b=1",
+		"http://foo.bar/test-1?a=%00&b=%0",
+		"http://foo.bar/test-1?a=1;b=2",
+		"http://foo.bar/test-1?a+b=c%20d&%3D=%26",
+		"http://foo.bar/%7Etest/../test-1?a=1",
+		"/test-1?" + strings.Repeat("a=1&", 512),
+	} {
+		f.Add(seed)
+	}
+
+	client, _ := NewClient(&Config{
+		Adapter: &adapterMock{store: map[uint64][]byte{}},
+		TTL:     1 * time.Minute,
+	})
+
+	f.Fuzz(func(t *testing.T, rawURL string) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return
+		}
+		r := &http.Request{Method: "GET", URL: u, Header: http.Header{}}
+		orig := *u
+
+		key := client.requestKey(r)
+		if client.requestKey(r) != key {
+			t.Fatalf("requestKey(%q) is not deterministic", rawURL)
+		}
+		if *u != orig {
+			t.Fatalf("requestKey(%q) modified the request URL", rawURL)
+		}
+
+		canonical := client.canonicalURL(r)
+		again := client.canonicalURL(&http.Request{Method: "GET", URL: canonical, Header: http.Header{}})
+		if again.String() != canonical.String() {
+			t.Fatalf("canonicalURL(%q) = %q, then %q", rawURL, canonical, again)
+		}
+
+		if _, err := url.ParseQuery(u.RawQuery); err != nil {
+			if canonical.RawQuery == "" && strings.Trim(u.RawQuery, "&=") != "" {
+				t.Fatalf("canonicalURL(%q) dropped the query", rawURL)
+			}
+			return
+		}
+		if !strings.Contains(u.RawQuery, "&") {
+			return
+		}
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+			pairs[i], pairs[j] = pairs[j], pairs[i]
+		}
+		reordered := *u
+		reordered.RawQuery = strings.Join(pairs, "&")
+		if client.requestKey(&http.Request{Method: "GET", URL: &reordered, Header: http.Header{}}) != key {
+			t.Fatalf("requestKey(%q) differs from the one of %q", rawURL, reordered.String())
+		}
+	})
+}
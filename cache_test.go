@@ -1,10 +1,21 @@
 package cache
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -36,6 +47,172 @@ func (a *adapterMock) Release(key uint64) {
 	delete(a.store, key)
 }
 
+type metaAdapterMock struct {
+	adapterMock
+	expirations map[uint64]time.Time
+}
+
+func (a *metaAdapterMock) GetMeta(key uint64) ([]byte, time.Time, bool) {
+	b, ok := a.Get(key)
+	a.Lock()
+	defer a.Unlock()
+	return b, a.expirations[key], ok
+}
+
+type delayedReleaseAdapterMock struct {
+	adapterMock
+	delays map[uint64]time.Duration
+}
+
+func (a *delayedReleaseAdapterMock) ReleaseAfter(key uint64, d time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.delays[key] = d
+}
+
+type prefixAdapterMock struct {
+	sync.Mutex
+	prefix string
+	store  map[string][]byte
+}
+
+func (a *prefixAdapterMock) Get(key uint64) ([]byte, bool) {
+	a.Lock()
+	defer a.Unlock()
+	b, ok := a.store[a.prefix+strconv.FormatUint(key, 10)]
+	return b, ok
+}
+
+func (a *prefixAdapterMock) Set(key uint64, response []byte, expiration time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	a.store[a.prefix+strconv.FormatUint(key, 10)] = response
+}
+
+func (a *prefixAdapterMock) Release(key uint64) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.store, a.prefix+strconv.FormatUint(key, 10))
+}
+
+func (a *prefixAdapterMock) WithKeyPrefix(prefix string) Adapter {
+	return &prefixAdapterMock{prefix: a.prefix + prefix, store: a.store}
+}
+
+type flakyAdapterMock struct {
+	adapterMock
+	failures int
+	calls    int
+}
+
+func (a *flakyAdapterMock) fail() error {
+	a.Lock()
+	defer a.Unlock()
+	a.calls++
+	if a.calls <= a.failures {
+		return errors.New("transient error")
+	}
+	return nil
+}
+
+func (a *flakyAdapterMock) GetCtx(ctx context.Context, key uint64) ([]byte, bool, error) {
+	if err := a.fail(); err != nil {
+		return nil, false, err
+	}
+	b, ok := a.Get(key)
+	return b, ok, nil
+}
+
+func (a *flakyAdapterMock) SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	if err := a.fail(); err != nil {
+		return err
+	}
+	a.Set(key, response, expiration)
+	return nil
+}
+
+func TestMiddlewareSetFailurePolicy(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		policy       SetFailurePolicy
+		wantErrors   int
+		wantFallback bool
+		wantCode     int
+	}{
+		{
+			"ignores failures by default",
+			"",
+			0,
+			false,
+			200,
+		},
+		{
+			"ignores failures",
+			SetFailureIgnore,
+			0,
+			false,
+			200,
+		},
+		{
+			"reports failures",
+			SetFailureReport,
+			1,
+			false,
+			200,
+		},
+		{
+			"caches to the fallback adapter",
+			SetFailureFallback,
+			0,
+			true,
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errs []error
+			fallback := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter: &flakyAdapterMock{
+					adapterMock: adapterMock{store: map[uint64][]byte{}},
+					failures:    1000,
+				},
+				TTL:              1 * time.Minute,
+				SetFailurePolicy: tt.policy,
+				FallbackAdapter:  fallback,
+				ErrorLog:         log.New(ioutil.Discard, "", 0),
+				OnError: func(err error) {
+					errs = append(errs, err)
+				},
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if len(errs) != tt.wantErrors {
+				t.Errorf("*Client.Middleware() errors = %v, want %v", errs, tt.wantErrors)
+			}
+			if _, ok := fallback.store[14974843192121052621]; ok != tt.wantFallback {
+				t.Errorf("*Client.Middleware() cached to the fallback = %v, want %v", ok, tt.wantFallback)
+			}
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantCode || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want %v new value", w.Code, w.Body.String(), tt.wantCode)
+			}
+		})
+	}
+}
+
 func TestMiddleware(t *testing.T) {
 	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("new value"))
@@ -108,6 +285,12 @@ func TestMiddleware(t *testing.T) {
 			"new value",
 			200,
 		},
+		{
+			"release does not cache the new response",
+			"http://foo.bar/test-2",
+			"new value",
+			200,
+		},
 		{
 			"returns new cached response",
 			"http://foo.bar/test-2",
@@ -137,6 +320,3202 @@ func TestMiddleware(t *testing.T) {
 	}
 }
 
+func TestMiddlewareRelease(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name        string
+		url         string
+		wantKeys    []uint64
+		wantCounter int
+	}{
+		{
+			"release-only url releases the bare url",
+			"http://foo.bar/test-1?rk=true",
+			[]uint64{generateKey("http://foo.bar/test-1?a=1")},
+			1,
+		},
+		{
+			"release plus other params releases the url with the other params",
+			"http://foo.bar/test-1?rk=true&a=1",
+			[]uint64{generateKey("http://foo.bar/test-1")},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter = 0
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					generateKey("http://foo.bar/test-1"): Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(1 * time.Minute),
+					}.Bytes(),
+					generateKey("http://foo.bar/test-1?a=1"): Response{
+						Value:      []byte("value 2"),
+						Expiration: time.Now().Add(1 * time.Minute),
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:    adapter,
+				TTL:        1 * time.Minute,
+				ReleaseKey: "rk",
+			})
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if counter != tt.wantCounter {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", counter, tt.wantCounter)
+			}
+			if len(adapter.store) != len(tt.wantKeys) {
+				t.Errorf("*Client.Middleware() entries = %v, want %v", len(adapter.store), len(tt.wantKeys))
+			}
+			for _, k := range tt.wantKeys {
+				if _, ok := adapter.store[k]; !ok {
+					t.Errorf("*Client.Middleware() released %v, want it kept", k)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareReleaseDelay(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &delayedReleaseAdapterMock{
+		adapterMock: adapterMock{
+			store: map[uint64][]byte{
+				14974843192121052621: Response{
+					Value:      []byte("value 1"),
+					Expiration: time.Now().Add(1 * time.Minute),
+				}.Bytes(),
+			},
+		},
+		delays: map[uint64]time.Duration{},
+	}
+	client, _ := NewClient(&Config{
+		Adapter:      adapter,
+		TTL:          1 * time.Minute,
+		ReleaseKey:   "rk",
+		ReleaseDelay: 5 * time.Second,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1?rk=true", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got := adapter.delays[14974843192121052621]; got != 5*time.Second {
+		t.Errorf("*Client.Middleware() release delay = %v, want 5s", got)
+	}
+
+	r, _ = http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Body.String() != "value 1" {
+		t.Errorf("*Client.Middleware() = %v, want value 1 during the grace period", w.Body.String())
+	}
+}
+
+func TestMiddlewareKeyPrefix(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &prefixAdapterMock{store: map[string][]byte{}}
+	client, err := NewClient(&Config{
+		Adapter:    adapter,
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+		KeyPrefix:  "httpcache:",
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	handler := client.Middleware(httpTestHandler)
+
+	for _, wantCode := range []int{200, 302} {
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != wantCode {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Code, wantCode)
+		}
+		if _, ok := adapter.store["httpcache:14974843192121052621"]; !ok || len(adapter.store) != 1 {
+			t.Errorf("*Client.Middleware() store = %v, want a prefixed key", adapter.store)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1?rk=true", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if _, ok := adapter.store["httpcache:14974843192121052621"]; ok {
+		t.Error("*Client.Middleware() did not release the prefixed key")
+	}
+}
+
+func TestMiddlewareReleaseResponse(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{
+		store: map[uint64][]byte{
+			14974843192121052621: Response{
+				Value:      []byte("value 1"),
+				Expiration: time.Now().Add(1 * time.Minute),
+			}.Bytes(),
+		},
+	}
+	client, _ := NewClient(&Config{
+		Adapter:         adapter,
+		TTL:             1 * time.Minute,
+		ReleaseKey:      "rk",
+		ReleaseResponse: true,
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1?rk=true", nil)
+	w := httptest.NewRecorder()
+	client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+	want := `{"released":true,"key":14974843192121052621}`
+	if w.Code != 200 || w.Body.String() != want {
+		t.Errorf("*Client.Middleware() = %v %v, want 200 %v", w.Code, w.Body.String(), want)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("*Client.Middleware() Content-Type = %v, want application/json", w.Header().Get("Content-Type"))
+	}
+	if counter != 0 {
+		t.Errorf("*Client.Middleware() handler calls = %v, want 0", counter)
+	}
+	if len(adapter.store) != 0 {
+		t.Errorf("*Client.Middleware() entries = %v, want 0", len(adapter.store))
+	}
+}
+
+type flushableAdapterMock struct {
+	adapterMock
+}
+
+func (a *flushableAdapterMock) Flush() {
+	a.Lock()
+	defer a.Unlock()
+	a.store = map[uint64][]byte{}
+}
+
+func TestMiddlewareReleaseKeys(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name        string
+		url         string
+		authorized  bool
+		wantCode    int
+		wantEntries int
+	}{
+		{
+			"single release key",
+			"http://foo.bar/test-1?rk=true",
+			true,
+			200,
+			1,
+		},
+		{
+			"additional release key",
+			"http://foo.bar/test-2?purge=true",
+			true,
+			200,
+			1,
+		},
+		{
+			"purge all flushes the cache",
+			"http://foo.bar/?purge-all=true",
+			true,
+			200,
+			0,
+		},
+		{
+			"unauthorized release is forbidden",
+			"http://foo.bar/test-1?rk=true",
+			false,
+			403,
+			2,
+		},
+		{
+			"unauthorized purge all is forbidden",
+			"http://foo.bar/?purge-all=true",
+			false,
+			403,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &flushableAdapterMock{
+				adapterMock{
+					store: map[uint64][]byte{
+						14974843192121052621: Response{
+							Value:      []byte("value 1"),
+							Expiration: time.Now().Add(1 * time.Minute),
+						}.Bytes(),
+						14974839893586167988: Response{
+							Value:      []byte("value 2"),
+							Expiration: time.Now().Add(1 * time.Minute),
+						}.Bytes(),
+					},
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:     adapter,
+				TTL:         1 * time.Minute,
+				ReleaseKey:  "rk",
+				ReleaseKeys: []string{"purge"},
+				PurgeAllKey: "purge-all",
+				ReleaseAuth: func(r *http.Request) bool {
+					return tt.authorized
+				},
+				ReleaseResponse: true,
+			})
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
+			}
+			if len(adapter.store) != tt.wantEntries {
+				t.Errorf("*Client.Middleware() entries = %v, want %v", len(adapter.store), tt.wantEntries)
+			}
+		})
+	}
+}
+
+func TestMiddlewarePurgeAllRequiresAuth(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &flushableAdapterMock{
+		adapterMock{
+			store: map[uint64][]byte{
+				14974843192121052621: Response{
+					Value:      []byte("value 1"),
+					Expiration: time.Now().Add(1 * time.Minute),
+				}.Bytes(),
+			},
+		},
+	}
+	client, _ := NewClient(&Config{
+		Adapter:     adapter,
+		TTL:         1 * time.Minute,
+		PurgeAllKey: "purge-all",
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/?purge-all=true", nil)
+	client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, ok := adapter.store[14974843192121052621]; !ok {
+		t.Error("*Client.Middleware() flushed the cache without ReleaseAuth")
+	}
+}
+
+func TestMiddlewareRequestURL(t *testing.T) {
+	var got string
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RawQuery
+		w.Write([]byte("new value"))
+	})
+
+	client, _ := NewClient(&Config{
+		Adapter:    &adapterMock{store: map[uint64][]byte{}},
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			"keeps param order",
+			"http://foo.bar/test-1?zaz=baz&baz=zaz",
+			"zaz=baz&baz=zaz",
+		},
+		{
+			"keeps release key",
+			"http://foo.bar/test-1?zaz=baz&rk=true",
+			"zaz=baz&rk=true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if r.URL.RawQuery != tt.want {
+				t.Errorf("*Client.Middleware() RawQuery = %v, want %v", r.URL.RawQuery, tt.want)
+			}
+			if got != tt.want {
+				t.Errorf("*Client.Middleware() next RawQuery = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSkipEmptyBody(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/empty":
+		default:
+			w.Write([]byte("new value"))
+		}
+	})
+
+	tests := []struct {
+		name          string
+		url           string
+		skipEmptyBody bool
+		wantCode      int
+		wantCached    bool
+	}{
+		{
+			"no content is not cached",
+			"http://foo.bar/no-content",
+			true,
+			204,
+			false,
+		},
+		{
+			"empty ok is not cached",
+			"http://foo.bar/empty",
+			true,
+			200,
+			false,
+		},
+		{
+			"ok with body is cached",
+			"http://foo.bar/value",
+			true,
+			200,
+			true,
+		},
+		{
+			"no content is cached by default",
+			"http://foo.bar/no-content",
+			false,
+			204,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:       adapter,
+				TTL:           1 * time.Minute,
+				SkipEmptyBody: tt.skipEmptyBody,
+			})
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareNoOpHandler(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nothing":
+		case "/header-only":
+			w.Header().Set("Content-Type", "text/plain")
+		case "/explicit-ok":
+			w.WriteHeader(http.StatusOK)
+		case "/flush":
+			w.(http.Flusher).Flush()
+		default:
+			io.WriteString(w, "new value")
+		}
+	})
+
+	tests := []struct {
+		name       string
+		url        string
+		wantCached bool
+	}{
+		{
+			"handler writing nothing is not cached",
+			"http://foo.bar/nothing",
+			false,
+		},
+		{
+			"handler only setting headers is not cached",
+			"http://foo.bar/header-only",
+			false,
+		},
+		{
+			"explicit empty ok is cached",
+			"http://foo.bar/explicit-ok",
+			true,
+		},
+		{
+			"flushed empty ok is not cached",
+			"http://foo.bar/flush",
+			false,
+		},
+		{
+			"handler writing a string is cached",
+			"http://foo.bar/value",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+			})
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("*Client.Middleware() = %v, want 200", w.Code)
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareBodySize(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+
+	tests := []struct {
+		name         string
+		minBodyBytes int
+		maxBodyBytes int
+		body         string
+		wantCached   bool
+	}{
+		{
+			"body below the window is not cached",
+			4,
+			8,
+			"err",
+			false,
+		},
+		{
+			"body within the window is cached",
+			4,
+			8,
+			"value",
+			true,
+		},
+		{
+			"body above the window is not cached",
+			4,
+			8,
+			"long value",
+			false,
+		},
+		{
+			"body above the floor is cached without limit",
+			4,
+			0,
+			"long value",
+			true,
+		},
+		{
+			"any body is cached by default",
+			0,
+			0,
+			"err",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:      adapter,
+				TTL:          1 * time.Minute,
+				MinBodyBytes: tt.minBodyBytes,
+				MaxBodyBytes: tt.maxBodyBytes,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/"+tt.body, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != tt.body {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 %v", w.Code, w.Body.String(), tt.body)
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMaxBodyBytesBuffer(t *testing.T) {
+	chunk := strings.Repeat("a", 100)
+
+	tests := []struct {
+		name         string
+		maxBodyBytes int
+		wantBuffered int
+		wantCached   bool
+	}{
+		{
+			"stops buffering past the limit",
+			250,
+			200,
+			false,
+		},
+		{
+			"buffers a body within the limit",
+			2000,
+			1000,
+			true,
+		},
+		{
+			"buffers any body by default",
+			0,
+			1000,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffered := 0
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Debug", "1")
+				for i := 0; i < 10; i++ {
+					w.Write([]byte(chunk))
+					if rec := w.(*recorder); rec.Body != nil && rec.Body.Len() > buffered {
+						buffered = rec.Body.Len()
+					}
+				}
+			})
+
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:      adapter,
+				TTL:          1 * time.Minute,
+				MaxBodyBytes: tt.maxBodyBytes,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != strings.Repeat(chunk, 10) || w.Header().Get("X-Debug") != "1" {
+				t.Errorf("*Client.Middleware() = %v %v %v, want the whole response", w.Code, w.Header(), w.Body.Len())
+			}
+			if buffered != tt.wantBuffered {
+				t.Errorf("*Client.Middleware() buffered = %v, want %v", buffered, tt.wantBuffered)
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMaxBodyBytesCacheHeaders(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Surrogate-Control", "max-age=60")
+		w.Header().Set("X-Cache-Ttl", "60")
+		w.Header().Set("X-Cache-Skip", "1")
+		w.Header().Set("X-Debug", "1")
+		w.Write([]byte(strings.Repeat("a", 1000)))
+	})
+
+	client, _ := NewClient(&Config{
+		Adapter:            &adapterMock{store: map[uint64][]byte{}},
+		TTL:                1 * time.Minute,
+		MaxBodyBytes:       250,
+		SurrogateControl:   true,
+		TTLHeader:          "X-Cache-TTL",
+		SkipResponseHeader: "X-Cache-Skip",
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	w := httptest.NewRecorder()
+	client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.Len() != 1000 || w.Header().Get("X-Debug") != "1" {
+		t.Errorf("*Client.Middleware() = %v %v %v, want the whole response", w.Code, w.Header(), w.Body.Len())
+	}
+	for _, k := range []string{"Surrogate-Control", "X-Cache-Ttl", "X-Cache-Skip"} {
+		if v := w.Header().Get(k); v != "" {
+			t.Errorf("*Client.Middleware() %v = %q, want it stripped", k, v)
+		}
+	}
+}
+
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []string
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushes = append(w.flushes, w.Body.String())
+	w.ResponseRecorder.Flush()
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Surrogate-Control", "max-age=60")
+		w.Header().Set("X-Cache-Ttl", "60")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:          adapter,
+		TTL:              1 * time.Minute,
+		SurrogateControl: true,
+		TTLHeader:        "X-Cache-TTL",
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", "http://foo.bar/events", nil)
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(w, r)
+
+		if w.Code != 200 || w.Header().Get("Content-Type") != "text/event-stream" {
+			t.Errorf("*Client.Middleware() = %v %v, want 200 text/event-stream", w.Code, w.Header())
+		}
+		want := []string{"data: 1\n\n", "data: 1\n\ndata: 2\n\n", "data: 1\n\ndata: 2\n\ndata: 3\n\n"}
+		if !reflect.DeepEqual(w.flushes, want) {
+			t.Errorf("*Client.Middleware() flushes = %q, want %q", w.flushes, want)
+		}
+		if len(adapter.store) > 0 {
+			t.Error("*Client.Middleware() cached a flushed response, want it streamed")
+		}
+		for _, k := range []string{"Surrogate-Control", "X-Cache-Ttl"} {
+			if v := w.Header().Get(k); v != "" {
+				t.Errorf("*Client.Middleware() %v = %q, want it stripped", k, v)
+			}
+		}
+	}
+}
+
+func TestMiddlewareStatusFunc(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := r.URL.Query().Get("upstream"); status != "" {
+			w.Header().Set("X-Upstream-Status", status)
+		}
+		w.Write([]byte("new value"))
+	})
+	upstreamStatus := func(res *http.Response) int {
+		if status, err := strconv.Atoi(res.Header.Get("X-Upstream-Status")); err == nil {
+			return status
+		}
+		return res.StatusCode
+	}
+
+	tests := []struct {
+		name       string
+		statusFunc func(*http.Response) int
+		cacheable  func(int) bool
+		query      string
+		wantCached bool
+	}{
+		{
+			"upstream error is not cached",
+			upstreamStatus,
+			nil,
+			"upstream=502",
+			false,
+		},
+		{
+			"upstream success is cached",
+			upstreamStatus,
+			nil,
+			"upstream=200",
+			true,
+		},
+		{
+			"response without upstream status is cached",
+			upstreamStatus,
+			nil,
+			"",
+			true,
+		},
+		{
+			"upstream status is passed to cacheable",
+			upstreamStatus,
+			func(statusCode int) bool { return statusCode == 404 },
+			"upstream=404",
+			true,
+		},
+		{
+			"status code is used by default",
+			nil,
+			nil,
+			"upstream=502",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:    adapter,
+				TTL:        1 * time.Minute,
+				StatusFunc: tt.statusFunc,
+				Cacheable:  tt.cacheable,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSkipResponseHeader(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/skip" {
+			w.Header().Set("X-Cache-Skip", "1")
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		skipHeader string
+		url        string
+		wantCached bool
+		wantHeader string
+	}{
+		{
+			"skips flagged response",
+			"x-cache-skip",
+			"http://foo.bar/skip",
+			false,
+			"",
+		},
+		{
+			"caches other responses",
+			"x-cache-skip",
+			"http://foo.bar/test-1",
+			true,
+			"",
+		},
+		{
+			"ignores the header by default",
+			"",
+			"http://foo.bar/skip",
+			true,
+			"1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:            adapter,
+				TTL:                1 * time.Minute,
+				SkipResponseHeader: tt.skipHeader,
+			})
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Cache-Skip"); got != tt.wantHeader {
+				t.Errorf("*Client.Middleware() X-Cache-Skip = %v, want %v", got, tt.wantHeader)
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAuthChallenge(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         string
+		cacheChallenge bool
+		wantCached     bool
+		wantStored     bool
+	}{
+		{
+			"skips www-authenticate",
+			"WWW-Authenticate",
+			false,
+			false,
+			false,
+		},
+		{
+			"skips proxy-authenticate",
+			"Proxy-Authenticate",
+			false,
+			false,
+			false,
+		},
+		{
+			"caches other responses",
+			"X-Debug",
+			false,
+			true,
+			true,
+		},
+		{
+			"caches challenges when enabled",
+			"WWW-Authenticate",
+			true,
+			true,
+			true,
+		},
+		{
+			"caches cookie responses without the cookie",
+			"Set-Cookie",
+			false,
+			true,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(tt.header, `Basic realm="foo"`)
+				w.Write([]byte("new value"))
+			})
+
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:             adapter,
+				TTL:                 1 * time.Minute,
+				CacheAuthChallenges: tt.cacheChallenge,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+			stored := BytesToResponse(adapter.store[14974843192121052621]).Header.Get(tt.header) != ""
+			if stored != tt.wantStored {
+				t.Errorf("*Client.Middleware() stored %v = %v, want %v", tt.header, stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestMiddlewareBeforeStore(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Debug", "1")
+		w.Write([]byte("new value"))
+	})
+
+	calls := 0
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+		BeforeStore: func(r *Response) {
+			calls++
+			r.Header.Del("X-Debug")
+		},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for _, wantCode := range []int{200, 302} {
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != wantCode {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Code, wantCode)
+		}
+		if wantCode == 302 && w.Header().Get("X-Debug") != "" {
+			t.Error("*Client.Middleware() replayed X-Debug header")
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("BeforeStore calls = %v, want 1", calls)
+	}
+	if h := BytesToResponse(adapter.store[14974843192121052621]).Header; h.Get("X-Debug") != "" {
+		t.Error("*Client.Middleware() stored X-Debug header")
+	}
+}
+
+func TestMiddlewareAfterLoad(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+		AfterLoad: func(response *Response, r *http.Request) {
+			response.Value = append(response.Value, []byte(" "+r.Header.Get("X-Nonce"))...)
+		},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name     string
+		nonce    string
+		wantBody string
+		wantCode int
+	}{
+		{
+			"miss is not transformed",
+			"1",
+			"new value",
+			200,
+		},
+		{
+			"hit is transformed",
+			"2",
+			"new value 2",
+			302,
+		},
+		{
+			"hit is transformed per request",
+			"3",
+			"new value 3",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Header.Set("X-Nonce", tt.nonce)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if v := BytesToResponse(adapter.store[14974843192121052621]).Value; string(v) != "new value" {
+				t.Errorf("*Client.Middleware() stored = %v, want new value", string(v))
+			}
+		})
+	}
+}
+
+func TestMiddlewarePaths(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		includePaths []string
+		excludePaths []string
+		path         string
+		wantCached   bool
+	}{
+		{
+			"include-only caches included path",
+			[]string{"/api"},
+			nil,
+			"/api/users",
+			true,
+		},
+		{
+			"include-only passes other paths through",
+			[]string{"/api"},
+			nil,
+			"/static/app.js",
+			false,
+		},
+		{
+			"exclude-only passes excluded path through",
+			nil,
+			[]string{"/admin"},
+			"/admin/users",
+			false,
+		},
+		{
+			"exclude-only caches other paths",
+			nil,
+			[]string{"/admin"},
+			"/api/users",
+			true,
+		},
+		{
+			"exclude takes precedence over include",
+			[]string{"/api"},
+			[]string{"/api/private"},
+			"/api/private/users",
+			false,
+		},
+		{
+			"combined caches included path",
+			[]string{"/api"},
+			[]string{"/api/private"},
+			"/api/users",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:      adapter,
+				TTL:          1 * time.Minute,
+				IncludePaths: tt.includePaths,
+				ExcludePaths: tt.excludePaths,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar"+tt.path, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSkipHTTP10(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		skipHTTP10 bool
+		protoMinor int
+		wantCached bool
+	}{
+		{
+			"passes http/1.0 requests through",
+			true,
+			0,
+			false,
+		},
+		{
+			"caches http/1.1 requests",
+			true,
+			1,
+			true,
+		},
+		{
+			"caches http/1.0 requests by default",
+			false,
+			0,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:    adapter,
+				TTL:        1 * time.Minute,
+				SkipHTTP10: tt.skipHTTP10,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.ProtoMajor, r.ProtoMinor = 1, tt.protoMinor
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStrictGET(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		strictGET  bool
+		method     string
+		wantCached bool
+	}{
+		{
+			"passes empty method requests through",
+			true,
+			"",
+			false,
+		},
+		{
+			"caches explicit get requests",
+			true,
+			"GET",
+			true,
+		},
+		{
+			"passes head requests through",
+			true,
+			"HEAD",
+			false,
+		},
+		{
+			"caches empty method requests by default",
+			false,
+			"",
+			true,
+		},
+		{
+			"caches head requests by default",
+			false,
+			"HEAD",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:   adapter,
+				TTL:       1 * time.Minute,
+				StrictGET: tt.strictGET,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Method = tt.method
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 {
+				t.Errorf("*Client.Middleware() code = %v, want 200", w.Code)
+			}
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+
+			wantCode := 200
+			if tt.wantCached {
+				wantCode = 302
+			}
+			w = httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+			if w.Code != wantCode {
+				t.Errorf("*Client.Middleware() second code = %v, want %v", w.Code, wantCode)
+			}
+		})
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	calls := 0
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:    adapter,
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("new value"))
+	}))
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		url         string
+		wantCode    int
+		wantCalls   int
+		wantEntries int
+	}{
+		{
+			"caches while enabled",
+			true,
+			"http://foo.bar/test-1",
+			200,
+			1,
+			1,
+		},
+		{
+			"passes through while disabled",
+			false,
+			"http://foo.bar/test-1",
+			200,
+			2,
+			1,
+		},
+		{
+			"does not store while disabled",
+			false,
+			"http://foo.bar/test-2",
+			200,
+			3,
+			1,
+		},
+		{
+			"does not release while disabled",
+			false,
+			"http://foo.bar/test-1?rk=true",
+			200,
+			4,
+			1,
+		},
+		{
+			"serves kept entries once enabled again",
+			true,
+			"http://foo.bar/test-1",
+			302,
+			4,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.SetEnabled(tt.enabled)
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if len(adapter.store) != tt.wantEntries {
+				t.Errorf("*Client.Middleware() entries = %v, want %v", len(adapter.store), tt.wantEntries)
+			}
+		})
+	}
+}
+
+func TestMiddlewareServeContent(t *testing.T) {
+	lastModified := time.Now().Add(-1 * time.Hour).UTC().Truncate(time.Second)
+	client, _ := NewClient(&Config{
+		Adapter:         &adapterMock{store: map[uint64][]byte{}},
+		TTL:             1 * time.Minute,
+		UseServeContent: true,
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte("new value"))
+	}))
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{
+			"serves the miss from the handler",
+			nil,
+			200,
+			"new value",
+		},
+		{
+			"serves the hit in full",
+			nil,
+			200,
+			"new value",
+		},
+		{
+			"serves a range of the hit",
+			http.Header{"Range": {"bytes=4-8"}},
+			206,
+			"value",
+		},
+		{
+			"serves not modified to a conditional request",
+			http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}},
+			304,
+			"",
+		},
+		{
+			"serves the hit modified since",
+			http.Header{"If-Modified-Since": {lastModified.Add(-1 * time.Hour).Format(http.TimeFormat)}},
+			200,
+			"new value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if tt.wantCode != 304 && w.Header().Get("Content-Type") != "text/plain" {
+				t.Errorf("*Client.Middleware() Content-Type = %v, want text/plain", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestMiddlewareIdempotencyKey(t *testing.T) {
+	calls := 0
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:              adapter,
+		TTL:                  1 * time.Minute,
+		IdempotencyKeyHeader: "Idempotency-Key",
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}))
+
+	tests := []struct {
+		name      string
+		url       string
+		key       string
+		body      string
+		wantBody  string
+		wantCalls int
+	}{
+		{
+			"serves the first request",
+			"http://foo.bar/orders?a=1",
+			"k1",
+			"order 1",
+			"order 1",
+			1,
+		},
+		{
+			"replays the first response to a retry",
+			"http://foo.bar/orders?a=2",
+			"k1",
+			"order 2",
+			"order 1",
+			1,
+		},
+		{
+			"serves a request of another key",
+			"http://foo.bar/orders?a=1",
+			"k2",
+			"order 3",
+			"order 3",
+			2,
+		},
+		{
+			"passes a request without key through",
+			"http://foo.bar/orders?a=1",
+			"",
+			"order 4",
+			"order 4",
+			3,
+		},
+		{
+			"passes a retry without key through",
+			"http://foo.bar/orders?a=1",
+			"",
+			"order 5",
+			"order 5",
+			4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("POST", tt.url, strings.NewReader(tt.body))
+			r.Header.Set("Idempotency-Key", tt.key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	if len(adapter.store) != 2 {
+		t.Errorf("*Client.Middleware() entries = %v, want 2", len(adapter.store))
+	}
+}
+
+func TestHandle(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+	adapter := &adapterMock{store: map[uint64][]byte{
+		14974839893586167988: Response{
+			Value:      []byte("value 2"),
+			Expiration: time.Now().Add(-1 * time.Minute),
+		}.Bytes(),
+	}}
+	client, _ := NewClient(&Config{
+		Adapter:              adapter,
+		TTL:                  1 * time.Minute,
+		StaleWhileRevalidate: 1 * time.Hour,
+		ReleaseKey:           "rk",
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		wantBody string
+		want     Status
+	}{
+		{
+			"misses an uncached response",
+			"GET",
+			"http://foo.bar/test-1",
+			"new value",
+			StatusMiss,
+		},
+		{
+			"hits the cached response",
+			"GET",
+			"http://foo.bar/test-1",
+			"new value",
+			StatusHit,
+		},
+		{
+			"serves a stale response",
+			"GET",
+			"http://foo.bar/test-2",
+			"value 2",
+			StatusStale,
+		},
+		{
+			"bypasses a post",
+			"POST",
+			"http://foo.bar/test-1",
+			"new value",
+			StatusBypass,
+		},
+		{
+			"bypasses a release",
+			"GET",
+			"http://foo.bar/test-1?rk=true",
+			"new value",
+			StatusBypass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, tt.url, nil)
+			w := httptest.NewRecorder()
+			got := client.Handle(w, r, httpTestHandler)
+
+			if got != tt.want {
+				t.Errorf("*Client.Handle() = %v, want %v", got, tt.want)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Handle() body = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareServeStaleOnTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		staleOnTimeout bool
+		timeout        time.Duration
+		delay          time.Duration
+		wantBody       string
+		wantTimeout    bool
+		wantRefreshed  bool
+	}{
+		{
+			"serves the stale response past the deadline",
+			true,
+			20 * time.Millisecond,
+			200 * time.Millisecond,
+			"value 1",
+			true,
+			true,
+		},
+		{
+			"serves the handler response within the deadline",
+			true,
+			200 * time.Millisecond,
+			0,
+			"new value",
+			false,
+			true,
+		},
+		{
+			"waits for the handler without deadline",
+			true,
+			0,
+			50 * time.Millisecond,
+			"new value",
+			false,
+			true,
+		},
+		{
+			"waits for the handler by default",
+			false,
+			20 * time.Millisecond,
+			50 * time.Millisecond,
+			"new value",
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.Write([]byte("new value"))
+			})
+
+			adapter := &adapterMock{store: map[uint64][]byte{
+				14974843192121052621: Response{
+					Value:      []byte("value 1"),
+					Expiration: time.Now().Add(-1 * time.Minute),
+				}.Bytes(),
+			}}
+			var event CacheEvent
+			client, _ := NewClient(&Config{
+				Adapter:             adapter,
+				TTL:                 1 * time.Minute,
+				ServeStaleOnTimeout: tt.staleOnTimeout,
+				OnEvent:             func(e CacheEvent) { event = e },
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			if tt.timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), tt.timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if event.BackendTimeout != tt.wantTimeout {
+				t.Errorf("*Client.Middleware() BackendTimeout = %v, want %v", event.BackendTimeout, tt.wantTimeout)
+			}
+
+			refreshed := false
+			for i := 0; i < 100 && !refreshed && tt.wantRefreshed; i++ {
+				b, _ := adapter.Get(14974843192121052621)
+				refreshed = string(BytesToResponse(b).Value) == "new value"
+				time.Sleep(5 * time.Millisecond)
+			}
+			if refreshed != tt.wantRefreshed {
+				t.Errorf("*Client.Middleware() refreshed = %v, want %v", refreshed, tt.wantRefreshed)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCacheOptions(t *testing.T) {
+	calls := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name         string
+		cacheOptions bool
+		origin       string
+		method       string
+		wantMethods  string
+		wantCalls    int
+	}{
+		{
+			"serves the first preflight",
+			true,
+			"http://foo.bar",
+			"PUT",
+			"PUT",
+			1,
+		},
+		{
+			"replays the cached preflight",
+			true,
+			"http://foo.bar",
+			"PUT",
+			"PUT",
+			1,
+		},
+		{
+			"keys preflights by requested method",
+			true,
+			"http://foo.bar",
+			"DELETE",
+			"DELETE",
+			2,
+		},
+		{
+			"keys preflights by origin",
+			true,
+			"http://bar.foo",
+			"PUT",
+			"PUT",
+			3,
+		},
+		{
+			"passes preflights through by default",
+			false,
+			"http://foo.bar",
+			"PUT",
+			"PUT",
+			4,
+		},
+	}
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:      adapter,
+				TTL:          1 * time.Minute,
+				CacheOptions: tt.cacheOptions,
+			})
+
+			r, _ := http.NewRequest("OPTIONS", "http://foo.bar/test-1", nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", tt.method)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != http.StatusNoContent {
+				t.Errorf("*Client.Middleware() status = %v, want %v", w.Code, http.StatusNoContent)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.origin {
+				t.Errorf("*Client.Middleware() Access-Control-Allow-Origin = %v, want %v", got, tt.origin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("*Client.Middleware() Access-Control-Allow-Methods = %v, want %v", got, tt.wantMethods)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	if len(adapter.store) != 3 {
+		t.Errorf("*Client.Middleware() entries = %v, want 3", len(adapter.store))
+	}
+}
+
+func TestMiddlewareBypassSampleRate(t *testing.T) {
+	tests := []struct {
+		name             string
+		bypassSampleRate float64
+		random           func() float64
+		body             string
+		wantBody         string
+		wantDrift        bool
+	}{
+		{
+			"never bypasses with rate 0",
+			0,
+			nil,
+			"new value",
+			"value 1",
+			false,
+		},
+		{
+			"always bypasses with rate 1",
+			1,
+			nil,
+			"new value",
+			"new value",
+			true,
+		},
+		{
+			"does not report identical bodies",
+			1,
+			nil,
+			"value 1",
+			"value 1",
+			false,
+		},
+		{
+			"bypasses sampled requests",
+			0.5,
+			func() float64 { return 0.4 },
+			"new value",
+			"new value",
+			true,
+		},
+		{
+			"serves requests not sampled",
+			0.5,
+			func() float64 { return 0.6 },
+			"new value",
+			"value 1",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var drift []string
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(1 * time.Minute),
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Minute,
+				BypassSampleRate: tt.bypassSampleRate,
+				OnDrift: func(r *http.Request, cached, fresh []byte) {
+					drift = append(drift, string(cached), string(fresh))
+				},
+			})
+			client.random = tt.random
+			handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if got := string(BytesToResponse(adapter.store[14974843192121052621]).Value); got != tt.wantBody {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", got, tt.wantBody)
+			}
+			if (len(drift) > 0) != tt.wantDrift {
+				t.Errorf("*Client.Middleware() drift = %v, want %v", drift, tt.wantDrift)
+			}
+			if tt.wantDrift && (drift[0] != "value 1" || drift[1] != tt.body) {
+				t.Errorf("*Client.Middleware() drift = %v, want [value 1 %v]", drift, tt.body)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMethods(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+
+	r, _ := http.NewRequest("POST", "http://foo.bar/test-1", nil)
+	w := httptest.NewRecorder()
+	client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+	if w.Code != 201 || w.Body.String() != "created" {
+		t.Errorf("*Client.Middleware() = %v %v, want 201 created", w.Code, w.Body.String())
+	}
+	if len(adapter.store) != 0 {
+		t.Errorf("*Client.Middleware() entries = %v, want 0", len(adapter.store))
+	}
+}
+
+func TestMiddlewareHeadFromGet(t *testing.T) {
+	calls := map[string]int{}
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.Method]++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name        string
+		headFromGet bool
+		populate    bool
+		wantCode    int
+		wantHeads   int
+	}{
+		{
+			"head is answered from the cached get",
+			true,
+			true,
+			302,
+			0,
+		},
+		{
+			"head reaches the handler without a cached get",
+			true,
+			false,
+			200,
+			1,
+		},
+		{
+			"head reaches the handler by default",
+			false,
+			true,
+			200,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = map[string]int{}
+			client, _ := NewClient(&Config{
+				Adapter:     &adapterMock{store: map[uint64][]byte{}},
+				TTL:         1 * time.Minute,
+				HeadFromGet: tt.headFromGet,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			if tt.populate {
+				r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+
+			r, _ := http.NewRequest("HEAD", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.Len() != 0 {
+				t.Errorf("*Client.Middleware() = %v %q, want %v and no body", w.Code, w.Body.String(), tt.wantCode)
+			}
+			if got := w.Header().Get("Content-Length"); got != "9" {
+				t.Errorf("*Client.Middleware() Content-Length = %v, want 9", got)
+			}
+			if got := w.Header().Get("Content-Type"); got != "text/plain" {
+				t.Errorf("*Client.Middleware() Content-Type = %v, want text/plain", got)
+			}
+			if calls["HEAD"] != tt.wantHeads {
+				t.Errorf("*Client.Middleware() head handler calls = %v, want %v", calls["HEAD"], tt.wantHeads)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCancelledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial value"))
+		cancel()
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+	if len(adapter.store) != 0 {
+		t.Errorf("*Client.Middleware() entries = %v, want 0", len(adapter.store))
+	}
+}
+
+func TestMiddlewareDisableParamSort(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	})
+
+	tests := []struct {
+		name             string
+		disableParamSort bool
+		wantEntries      int
+	}{
+		{
+			"sorted params share an entry",
+			false,
+			1,
+		},
+		{
+			"unsorted params are distinct entries",
+			true,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Minute,
+				ReleaseKey:       "rk",
+				DisableParamSort: tt.disableParamSort,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			for _, u := range []string{"http://foo.bar/test-1?b=2&a=1", "http://foo.bar/test-1?a=1&b=2"} {
+				r, _ := http.NewRequest("GET", u, nil)
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+
+			if len(adapter.store) != tt.wantEntries {
+				t.Errorf("*Client.Middleware() entries = %v, want %v", len(adapter.store), tt.wantEntries)
+			}
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1?b=2&rk=true&a=1", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(adapter.store) != tt.wantEntries-1 {
+				t.Errorf("*Client.Middleware() entries after release = %v, want %v", len(adapter.store), tt.wantEntries-1)
+			}
+		})
+	}
+}
+
+func TestPreserveValueOrder(t *testing.T) {
+	tests := []struct {
+		name               string
+		preserveValueOrder bool
+		urls               []string
+		same               bool
+	}{
+		{
+			"key order does not matter",
+			true,
+			[]string{"/x?ids=3&ids=1&a=1", "/x?a=1&ids=3&ids=1", "/x?ids=3&a=1&ids=1"},
+			true,
+		},
+		{
+			"value order matters",
+			true,
+			[]string{"/x?ids=3&ids=1", "/x?ids=1&ids=3"},
+			false,
+		},
+		{
+			"value order does not matter by default",
+			false,
+			[]string{"/x?ids=3&ids=1", "/x?ids=1&ids=3"},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:            &adapterMock{store: map[uint64][]byte{}},
+				TTL:                1 * time.Minute,
+				PreserveValueOrder: tt.preserveValueOrder,
+			})
+
+			want, _ := client.KeyForURL("GET", tt.urls[0])
+			for _, u := range tt.urls[1:] {
+				got, _ := client.KeyForURL("GET", u)
+				if (got == want) != tt.same {
+					t.Errorf("*Client.KeyForURL(%q) = %v, key of %q = %v", u, got, tt.urls[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryEncoder(t *testing.T) {
+	lowercase := func(params url.Values) string {
+		q := params.Encode()
+		for i := 0; i+2 < len(q); i++ {
+			if q[i] == '%' {
+				q = q[:i+1] + strings.ToLower(q[i+1:i+3]) + q[i+3:]
+			}
+		}
+		return q
+	}
+
+	tests := []struct {
+		name      string
+		encoder   func(url.Values) string
+		urls      []string
+		wantQuery string
+	}{
+		{
+			"spaces are encoded as %20",
+			nil,
+			[]string{"/x?q=a+b", "/x?q=a%20b"},
+			"q=a%20b",
+		},
+		{
+			"percent-encoding is uppercase",
+			nil,
+			[]string{"/x?q=%c3%a9", "/x?q=%C3%A9", "/x?q=%c3%A9"},
+			"q=%C3%A9",
+		},
+		{
+			"unreserved characters are not escaped",
+			nil,
+			[]string{"/x?q=%7e", "/x?q=~"},
+			"q=~",
+		},
+		{
+			"plus signs are escaped",
+			nil,
+			[]string{"/x?q=a%2Bb", "/x?q=a%2bb"},
+			"q=a%2Bb",
+		},
+		{
+			"custom encoder is used",
+			lowercase,
+			[]string{"/x?q=%C3%A9+b", "/x?q=%c3%a9%20b"},
+			"q=%c3%a9+b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:      &adapterMock{store: map[uint64][]byte{}},
+				TTL:          1 * time.Minute,
+				QueryEncoder: tt.encoder,
+			})
+
+			want, _ := client.KeyForURL("GET", tt.urls[0])
+			for _, u := range tt.urls {
+				got, _ := client.KeyForURL("GET", u)
+				if got != want {
+					t.Errorf("*Client.KeyForURL(%q) = %v, key of %q = %v", u, got, tt.urls[0], want)
+				}
+
+				r, _ := http.NewRequest("GET", u, nil)
+				if query := client.canonicalURL(r).RawQuery; query != tt.wantQuery {
+					t.Errorf("*Client.canonicalURL(%q) query = %v, want %v", u, query, tt.wantQuery)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyQueryKeys(t *testing.T) {
+	tests := []struct {
+		name             string
+		disableParamSort bool
+		urls             []string
+		same             bool
+	}{
+		{
+			"empty queries share the key of no query",
+			false,
+			[]string{"/x", "/x?", "/x?=", "/x?&", "/x?=&=", "/x?rk=true&="},
+			true,
+		},
+		{
+			"empty params are dropped from queries",
+			false,
+			[]string{"/x?a=1", "/x?a=1&=", "/x?=&a=1"},
+			true,
+		},
+		{
+			"params with an empty key and a value are kept",
+			false,
+			[]string{"/x", "/x?=1"},
+			false,
+		},
+		{
+			"empty query shares the key of no query in raw mode",
+			true,
+			[]string{"/x", "/x?"},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:          &adapterMock{store: map[uint64][]byte{}},
+				TTL:              1 * time.Minute,
+				ReleaseKey:       "rk",
+				DisableParamSort: tt.disableParamSort,
+			})
+
+			want, _ := client.KeyForURL("GET", tt.urls[0])
+			for _, u := range tt.urls[1:] {
+				got, _ := client.KeyForURL("GET", u)
+				if (got == want) != tt.same {
+					t.Errorf("*Client.KeyForURL(%q) = %v, key of %q = %v", u, got, tt.urls[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareKeyPathOnly(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte("new value"))
+	})
+	always := func(r *http.Request) bool {
+		return true
+	}
+	tracking := func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/track")
+	}
+
+	tests := []struct {
+		name        string
+		keyPathOnly func(*http.Request) bool
+		urls        []string
+		wantCalls   int
+	}{
+		{
+			"query strings share one entry when enabled",
+			always,
+			[]string{"/other", "/other?utm=1", "/other?utm=2&ref=a"},
+			1,
+		},
+		{
+			"paths still get separate entries",
+			always,
+			[]string{"/track/x?utm=1", "/track/y?utm=1"},
+			2,
+		},
+		{
+			"query strings share one entry on a matching route",
+			tracking,
+			[]string{"/track/x", "/track/x?utm=1", "/track/x?utm=2&ref=a"},
+			1,
+		},
+		{
+			"query strings get separate entries on other routes",
+			tracking,
+			[]string{"/other?utm=1", "/other?utm=2"},
+			2,
+		},
+		{
+			"query strings get separate entries by default",
+			nil,
+			[]string{"/track/x?utm=1", "/track/x?utm=2"},
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter = 0
+			client, _ := NewClient(&Config{
+				Adapter:     &adapterMock{store: map[uint64][]byte{}},
+				TTL:         1 * time.Minute,
+				KeyPathOnly: tt.keyPathOnly,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			for _, u := range tt.urls {
+				r, _ := http.NewRequest("GET", "http://foo.bar"+u, nil)
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+			if counter != tt.wantCalls {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", counter, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRemoveParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			"removes matching param keeping order",
+			"b=2&rk=1&a=1",
+			"b=2&a=1",
+		},
+		{
+			"removes escaped and valueless params",
+			"r%6B=1&b=2&rk",
+			"b=2",
+		},
+		{
+			"keeps query without matching param",
+			"b=2&a=1",
+			"b=2&a=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := removeParams(tt.query, func(k string) bool { return k == "rk" })
+			if got != tt.want {
+				t.Errorf("removeParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type panickingAdapterMock struct{}
+
+func (a panickingAdapterMock) Get(key uint64) ([]byte, bool) {
+	panic("get")
+}
+
+func (a panickingAdapterMock) Set(key uint64, response []byte, expiration time.Time) {
+	panic("set")
+}
+
+func (a panickingAdapterMock) Release(key uint64) {
+	panic("release")
+}
+
+func TestMiddlewareAdapterPanics(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	client, _ := NewClient(&Config{
+		Adapter:    panickingAdapterMock{},
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+		ErrorLog:   log.New(ioutil.Discard, "", 0),
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for _, u := range []string{"http://foo.bar/test-1", "http://foo.bar/test-1?rk=true"} {
+		r, _ := http.NewRequest("GET", u, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != 200 || w.Body.String() != "new value" {
+			t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+		}
+	}
+}
+
+type panickingContextAdapterMock struct {
+	panickingAdapterMock
+}
+
+func (a panickingContextAdapterMock) GetCtx(ctx context.Context, key uint64) ([]byte, bool, error) {
+	panic("get")
+}
+
+func (a panickingContextAdapterMock) SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	panic("set")
+}
+
+func TestClientAdapterPanicsMiss(t *testing.T) {
+	tests := []struct {
+		name    string
+		adapter Adapter
+	}{
+		{
+			"adapter",
+			panickingAdapterMock{},
+		},
+		{
+			"context adapter",
+			panickingContextAdapterMock{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:  tt.adapter,
+				TTL:      1 * time.Minute,
+				ErrorLog: log.New(ioutil.Discard, "", 0),
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			if _, ok := client.Inspect(r); ok {
+				t.Error("*Client.Inspect() = true, want a miss")
+			}
+			if _, ok := client.TTL(r); ok {
+				t.Error("*Client.TTL() = true, want a miss")
+			}
+		})
+	}
+}
+
+func TestMiddlewareAdapterPanicsDisabledRecovery(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	client, _ := NewClient(&Config{
+		Adapter:                     panickingAdapterMock{},
+		TTL:                         1 * time.Minute,
+		DisableAdapterPanicRecovery: true,
+	})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("*Client.Middleware() recovered from the adapter panic")
+		}
+	}()
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMiddlewareContentLength(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1")
+		w.Write([]byte("chunk 1 "))
+		w.Write([]byte("chunk 2"))
+	})
+
+	client, _ := NewClient(&Config{
+		Adapter: &adapterMock{store: map[uint64][]byte{}},
+		TTL:     1 * time.Minute,
+	})
+
+	server := httptest.NewServer(client.Middleware(httpTestHandler))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		wantCode int
+	}{
+		{
+			"miss has correct content length",
+			"GET",
+			200,
+		},
+		{
+			"hit has correct content length",
+			"GET",
+			302,
+		},
+		{
+			"head miss has correct content length",
+			"HEAD",
+			200,
+		},
+		{
+			"head hit has correct content length",
+			"HEAD",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, server.URL+"/chunked", nil)
+			transport := &http.Transport{}
+			resp, err := transport.RoundTrip(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("*Client.Middleware() = %v, want %v", resp.StatusCode, tt.wantCode)
+				return
+			}
+			if resp.ContentLength != 15 {
+				t.Errorf("*Client.Middleware() Content-Length = %v, want 15", resp.ContentLength)
+			}
+		})
+	}
+}
+
+func TestMiddlewareContentLengthEncoded(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/encoded" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", "1")
+		w.Write([]byte("new value, long enough to be worth compressing"))
+	})
+
+	tests := []struct {
+		name            string
+		path            string
+		serveContent    bool
+		compressOnServe bool
+	}{
+		{
+			"hit of an encoded response",
+			"/encoded",
+			false,
+			false,
+		},
+		{
+			"hit of an encoded response served as content",
+			"/encoded",
+			true,
+			false,
+		},
+		{
+			"hit compressed on serve",
+			"/plain",
+			false,
+			true,
+		},
+		{
+			"hit compressed on serve served as content",
+			"/plain",
+			true,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:         &adapterMock{store: map[uint64][]byte{}},
+				TTL:             1 * time.Minute,
+				UseServeContent: tt.serveContent,
+				CompressOnServe: tt.compressOnServe,
+			})
+			server := httptest.NewServer(client.Middleware(httpTestHandler))
+			defer server.Close()
+
+			for i := 0; i < 2; i++ {
+				r, _ := http.NewRequest("GET", server.URL+tt.path, nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				resp, err := (&http.Transport{}).RoundTrip(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) > 0 {
+					t.Errorf("*Client.Middleware() Content-Length = %v, Transfer-Encoding = %v, want %v", resp.ContentLength, resp.TransferEncoding, len(body))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareVaryFunc(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte(r.Header.Get("X-Bucket")))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+		VaryFunc: func(r *http.Request) string {
+			return r.Header.Get("X-Bucket")
+		},
+	})
+
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name        string
+		bucket      string
+		wantBody    string
+		wantCode    int
+		wantCounter int
+	}{
+		{
+			"bucket a is not cached",
+			"a",
+			"a",
+			200,
+			1,
+		},
+		{
+			"bucket b is not cached",
+			"b",
+			"b",
+			200,
+			2,
+		},
+		{
+			"bucket a is cached",
+			"a",
+			"a",
+			302,
+			2,
+		},
+		{
+			"bucket b is cached",
+			"b",
+			"b",
+			302,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-vary", nil)
+			r.Header.Set("X-Bucket", tt.bucket)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
+				return
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if counter != tt.wantCounter {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", counter, tt.wantCounter)
+			}
+		})
+	}
+
+	if len(adapter.store) != 2 {
+		t.Errorf("*Client.Middleware() entries = %v, want 2", len(adapter.store))
+	}
+}
+
+func TestRouteKeyFunc(t *testing.T) {
+	client, _ := NewClient(&Config{
+		Adapter: &adapterMock{store: map[uint64][]byte{}},
+		TTL:     1 * time.Minute,
+		RouteKeyFunc: func(r *http.Request) (string, bool) {
+			if strings.HasPrefix(r.URL.Path, "/users") {
+				return "/users/{id}", true
+			}
+			return "", false
+		},
+	})
+
+	tests := []struct {
+		name string
+		urls []string
+		same bool
+	}{
+		{
+			"normalizes routed paths",
+			[]string{"/users/1", "/users/1/", "/users//1", "/users/%31", "/users/./1"},
+			true,
+		},
+		{
+			"keeps concrete values apart",
+			[]string{"/users/1", "/users/2"},
+			false,
+		},
+		{
+			"keeps query strings apart",
+			[]string{"/users/1?a=1", "/users/1?a=2"},
+			false,
+		},
+		{
+			"does not normalize unrouted paths",
+			[]string{"/other/1", "/other/1/"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, _ := client.KeyForURL("GET", tt.urls[0])
+			for _, u := range tt.urls[1:] {
+				got, _ := client.KeyForURL("GET", u)
+				if (got == want) != tt.same {
+					t.Errorf("*Client.KeyForURL(%q) = %v, key of %q = %v", u, got, tt.urls[0], want)
+				}
+			}
+		})
+	}
+
+	plain, _ := NewClient(&Config{
+		Adapter: &adapterMock{store: map[uint64][]byte{}},
+		TTL:     1 * time.Minute,
+	})
+	routed, _ := client.KeyForURL("GET", "/users/1")
+	if unrouted, _ := plain.KeyForURL("GET", "/users/1"); routed == unrouted {
+		t.Error("*Client.KeyForURL() does not fold the route template into the key")
+	}
+}
+
+func TestKeyIncludesScheme(t *testing.T) {
+	tests := []struct {
+		name           string
+		includeScheme  bool
+		forwardedProto string
+		requests       []func() *http.Request
+		same           bool
+	}{
+		{
+			"http and https requests get distinct entries",
+			true,
+			"",
+			[]func() *http.Request{
+				func() *http.Request { return httptest.NewRequest("GET", "/test-1", nil) },
+				func() *http.Request { return httptest.NewRequest("GET", "https://foo.bar/test-1", nil) },
+			},
+			false,
+		},
+		{
+			"forwarded proto is the scheme",
+			true,
+			"X-Forwarded-Proto",
+			[]func() *http.Request{
+				func() *http.Request {
+					r := httptest.NewRequest("GET", "/test-1", nil)
+					r.Header.Set("X-Forwarded-Proto", "HTTPS")
+					return r
+				},
+				func() *http.Request {
+					r := httptest.NewRequest("GET", "/test-1", nil)
+					r.TLS = &tls.ConnectionState{}
+					return r
+				},
+			},
+			true,
+		},
+		{
+			"forwarded proto splits entries of the same url",
+			true,
+			"X-Forwarded-Proto",
+			[]func() *http.Request{
+				func() *http.Request { return httptest.NewRequest("GET", "/test-1", nil) },
+				func() *http.Request {
+					r := httptest.NewRequest("GET", "/test-1", nil)
+					r.Header.Set("X-Forwarded-Proto", "https")
+					return r
+				},
+			},
+			false,
+		},
+		{
+			"scheme is ignored by default",
+			false,
+			"X-Forwarded-Proto",
+			[]func() *http.Request{
+				func() *http.Request { return httptest.NewRequest("GET", "/test-1", nil) },
+				func() *http.Request {
+					r := httptest.NewRequest("GET", "/test-1", nil)
+					r.Header.Set("X-Forwarded-Proto", "https")
+					return r
+				},
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:              &adapterMock{store: map[uint64][]byte{}},
+				TTL:                  1 * time.Minute,
+				KeyIncludesScheme:    tt.includeScheme,
+				ForwardedProtoHeader: tt.forwardedProto,
+			})
+
+			r0, r1 := tt.requests[0](), tt.requests[1]()
+			r1.URL.Scheme, r1.URL.Host = "", ""
+			if got := client.KeyFor(r0) == client.KeyFor(r1); got != tt.same {
+				t.Errorf("*Client.KeyFor() same = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestKeyFor(t *testing.T) {
+	var key uint64
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:    adapter,
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+		VaryFunc: func(r *http.Request) string {
+			return r.Header.Get("X-Bucket")
+		},
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		bucket string
+		keyURL string
+	}{
+		{
+			"matches the key of a get request",
+			"GET",
+			"/test-1?b=2&a=1",
+			"",
+			"/test-1?a=1&rk=true&b=2",
+		},
+		{
+			"matches the key of a head request",
+			"HEAD",
+			"/test-1",
+			"",
+			"/test-1",
+		},
+		{
+			"matches the key of a request variation",
+			"GET",
+			"/test-1",
+			"a",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k := range adapter.store {
+				delete(adapter.store, k)
+			}
+
+			r, _ := http.NewRequest(tt.method, tt.url, nil)
+			r.Header.Set("X-Bucket", tt.bucket)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			for k := range adapter.store {
+				key = k
+			}
+
+			if got := client.KeyFor(r); got != key {
+				t.Errorf("*Client.KeyFor() = %v, want %v", got, key)
+			}
+			if tt.keyURL == "" {
+				return
+			}
+			got, err := client.KeyForURL(tt.method, tt.keyURL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got != key {
+				t.Errorf("*Client.KeyForURL() = %v, want %v", got, key)
+			}
+		})
+	}
+
+	if _, err := client.KeyForURL("GET", "%zz"); err == nil {
+		t.Error("*Client.KeyForURL() error = nil, want error")
+	}
+}
+
+func TestKeySalt(t *testing.T) {
+	tests := []struct {
+		name    string
+		keySalt string
+		setSalt string
+		want    uint64
+	}{
+		{
+			"keeps keys unsalted by default",
+			"",
+			"",
+			14974843192121052621,
+		},
+		{
+			"salts keys",
+			"v1",
+			"",
+			generateKey("v1\x00http://foo.bar/test-1"),
+		},
+		{
+			"salts keys with the replaced salt",
+			"v1",
+			"v2",
+			generateKey("v2\x00http://foo.bar/test-1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter: &adapterMock{store: map[uint64][]byte{}},
+				TTL:     1 * time.Minute,
+				KeySalt: tt.keySalt,
+			})
+			if tt.setSalt != "" {
+				client.SetKeySalt(tt.setSalt)
+			}
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			if got := client.KeyFor(r); got != tt.want {
+				t.Errorf("*Client.KeyFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareKeySaltRotation(t *testing.T) {
+	client, _ := NewClient(&Config{
+		Adapter: &adapterMock{store: map[uint64][]byte{}},
+		TTL:     1 * time.Minute,
+		KeySalt: "v1",
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	}))
+
+	for _, step := range []struct {
+		salt     string
+		wantCode int
+	}{
+		{"", 200},
+		{"", 302},
+		{"v2", 200},
+		{"v1", 302},
+	} {
+		if step.salt != "" {
+			client.SetKeySalt(step.salt)
+		}
+
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != step.wantCode {
+			t.Errorf("*Client.Middleware() with salt %q = %v, want %v", step.salt, w.Code, step.wantCode)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	tests := []struct {
+		name    string
+		adapter Adapter
+		wantErr bool
+	}{
+		{
+			"flushes the adapter",
+			&flushableAdapterMock{
+				adapterMock{
+					store: map[uint64][]byte{
+						1: Response{Value: []byte("value 1")}.Bytes(),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"returns error for unsupported adapter",
+			&adapterMock{
+				store: map[uint64][]byte{
+					1: Response{Value: []byte("value 1")}.Bytes(),
+				},
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter: tt.adapter,
+				TTL:     1 * time.Minute,
+			})
+
+			err := client.Flush()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("*Client.Flush() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if _, ok := tt.adapter.Get(1); ok == !tt.wantErr {
+				t.Errorf("*Client.Flush() entry found = %v, want %v", ok, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name            string
+		storeRequestURL bool
+		wantURL         string
+	}{
+		{
+			"stores request url",
+			true,
+			"http://foo.bar/test-1?a=1&b=2",
+		},
+		{
+			"does not store request url",
+			false,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:         &adapterMock{store: map[uint64][]byte{}},
+				TTL:             1 * time.Minute,
+				StoreRequestURL: tt.storeRequestURL,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1?b=2&a=1", nil)
+			if _, ok := client.Inspect(r); ok {
+				t.Error("*Client.Inspect() ok = true, want false")
+				return
+			}
+
+			client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			r, _ = http.NewRequest("GET", "http://foo.bar/test-1?b=2&a=1", nil)
+			got, ok := client.Inspect(r)
+			if !ok {
+				t.Error("*Client.Inspect() ok = false, want true")
+				return
+			}
+			if got.URL != tt.wantURL {
+				t.Errorf("*Client.Inspect() URL = %v, want %v", got.URL, tt.wantURL)
+			}
+			if string(got.Value) != "new value" {
+				t.Errorf("*Client.Inspect() Value = %v, want new value", string(got.Value))
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		store  map[uint64][]byte
+		want   time.Duration
+		wantOk bool
+	}{
+		{
+			"returns the remaining freshness",
+			map[uint64][]byte{
+				14974843192121052621: Response{
+					Value:      []byte("value 1"),
+					Expiration: now.Add(1 * time.Minute),
+				}.Bytes(),
+			},
+			1 * time.Minute,
+			true,
+		},
+		{
+			"expired response has no ttl",
+			map[uint64][]byte{
+				14974843192121052621: Response{
+					Value:      []byte("value 1"),
+					Expiration: now.Add(-1 * time.Minute),
+				}.Bytes(),
+			},
+			0,
+			false,
+		},
+		{
+			"absent response has no ttl",
+			map[uint64][]byte{},
+			0,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter: &adapterMock{store: tt.store},
+				TTL:     1 * time.Minute,
+				Clock:   func() time.Time { return now },
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			got, ok := client.TTL(r)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("*Client.TTL() = %v %v, want %v %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestAdapterRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantOk    bool
+		wantCalls int
+	}{
+		{
+			"succeeds without retries",
+			0,
+			3,
+			true,
+			1,
+		},
+		{
+			"succeeds after retries",
+			2,
+			3,
+			true,
+			3,
+		},
+		{
+			"gives up when attempts are exhausted",
+			5,
+			3,
+			false,
+			3,
+		},
+		{
+			"does not retry without a policy",
+			1,
+			0,
+			false,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &flakyAdapterMock{
+				adapterMock: adapterMock{
+					store: map[uint64][]byte{
+						1: Response{Value: []byte("value 1")}.Bytes(),
+					},
+				},
+				failures: tt.failures,
+			}
+			client, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+				AdapterRetry: RetryPolicy{
+					MaxAttempts: tt.attempts,
+					BaseDelay:   1 * time.Millisecond,
+				},
+			})
+
+			_, ok := client.get(context.Background(), 1)
+			if ok != tt.wantOk {
+				t.Errorf("*Client.get() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if adapter.calls != tt.wantCalls {
+				t.Errorf("*Client.get() calls = %v, want %v", adapter.calls, tt.wantCalls)
+			}
+
+			adapter.calls = 0
+			adapter.Release(2)
+			client.set(context.Background(), 2, []byte("value 2"), time.Now().Add(1*time.Minute))
+			if _, ok := adapter.Get(2); ok != tt.wantOk {
+				t.Errorf("*Client.set() stored = %v, want %v", ok, tt.wantOk)
+			}
+			if adapter.calls != tt.wantCalls {
+				t.Errorf("*Client.set() calls = %v, want %v", adapter.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestAdapterRetryContext(t *testing.T) {
+	adapter := &flakyAdapterMock{
+		adapterMock: adapterMock{store: map[uint64][]byte{}},
+		failures:    10,
+	}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+		AdapterRetry: RetryPolicy{
+			MaxAttempts: 10,
+			BaseDelay:   1 * time.Hour,
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, ok := client.get(ctx, 1); ok {
+		t.Error("*Client.get() ok = true, want false")
+	}
+	if time.Since(start) > 1*time.Second {
+		t.Error("*Client.get() did not respect the context deadline")
+	}
+	if adapter.calls != 1 {
+		t.Errorf("*Client.get() calls = %v, want 1", adapter.calls)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{
+		BaseDelay: 10 * time.Millisecond,
+		MaxDelay:  40 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name  string
+		retry int
+		max   time.Duration
+	}{
+		{
+			"first retry uses the base delay",
+			0,
+			10 * time.Millisecond,
+		},
+		{
+			"delay doubles",
+			1,
+			20 * time.Millisecond,
+		},
+		{
+			"delay is capped",
+			10,
+			40 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.delay(tt.retry)
+			if got < tt.max/2 || got > tt.max {
+				t.Errorf("RetryPolicy.delay() = %v, want between %v and %v", got, tt.max/2, tt.max)
+			}
+		})
+	}
+}
+
 func TestBytesToResponse(t *testing.T) {
 	r := Response{
 		Value:      []byte("value 1"),
@@ -198,6 +3577,7 @@ func TestResponseToBytes(t *testing.T) {
 
 func TestSortURLParams(t *testing.T) {
 	u, _ := url.Parse("http://test.com?zaz=bar&foo=zaz&boo=foo&boo=baz")
+	invalid, _ := url.Parse("http://test.com?zaz=%zz&foo=zaz")
 	tests := []struct {
 		name string
 		URL  *url.URL
@@ -208,6 +3588,11 @@ func TestSortURLParams(t *testing.T) {
 			u,
 			"http://test.com?boo=baz&boo=foo&foo=zaz&zaz=bar",
 		},
+		{
+			"keeps querystring failing to parse",
+			invalid,
+			"http://test.com?zaz=%zz&foo=zaz",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -251,6 +3636,350 @@ func TestGenerateKey(t *testing.T) {
 	}
 }
 
+func TestSortURLParamsStability(t *testing.T) {
+	queries := []string{
+		"",
+		"a=1&b=2",
+		"a=2&a=1",
+		"b=1&a=1",
+		"a=1&a",
+		"a=1&&b=2",
+		"a=1&",
+		"a=b+c",
+		"a=b%20c",
+		"a=%7e&b=~",
+		"k%C3%A9y=v",
+		"a=1;b=2",
+		"a=%zz&b=1",
+		"=1",
+	}
+	for _, q := range queries {
+		t.Run(q, func(t *testing.T) {
+			u := &url.URL{Path: "/", RawQuery: q}
+			params, err := url.ParseQuery(q)
+			for _, param := range params {
+				sort.Strings(param)
+			}
+			want := RFC3986QueryEncoder(params)
+			if err != nil {
+				want = q
+			}
+
+			sortURLParams(u)
+			if u.RawQuery != want {
+				t.Errorf("sortURLParams() = %v, want %v", u.RawQuery, want)
+			}
+		})
+	}
+}
+
+func TestGenerateKeyStability(t *testing.T) {
+	urls := []string{
+		"",
+		"http://foo.bar/test-1",
+		"http://foo.bar/test-1?a=1&b=2",
+		"/k\xc3\xa9y?\x00",
+	}
+	for _, u := range urls {
+		hash := fnv.New64a()
+		hash.Write([]byte(u))
+		if got, want := generateKey(u), hash.Sum64(); got != want {
+			t.Errorf("generateKey(%q) = %v, want %v", u, got, want)
+		}
+	}
+}
+
+func BenchmarkGenerateKey(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		generateKey("http://foo.bar/test-1?a=1&b=2&c=3")
+	}
+}
+
+func BenchmarkSortURLParams(b *testing.B) {
+	b.Run("sorted", func(b *testing.B) {
+		b.ReportAllocs()
+		u := &url.URL{Path: "/test-1", RawQuery: "a=1&b=2&c=3"}
+		for i := 0; i < b.N; i++ {
+			sortURLParams(u)
+		}
+	})
+	b.Run("unsorted", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			u := &url.URL{Path: "/test-1", RawQuery: "c=3&b=2&a=1"}
+			sortURLParams(u)
+		}
+	})
+}
+
+func TestMiddlewareAbsoluteMaxAge(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name     string
+		storedAt time.Duration
+		wantBody string
+		wantCode int
+	}{
+		{
+			"entry stored past the absolute max age is regenerated",
+			-2 * time.Hour,
+			"new value",
+			200,
+		},
+		{
+			"entry stored within the absolute max age is served",
+			-30 * time.Minute,
+			"value 1",
+			302,
+		},
+		{
+			"entry without storage date is served",
+			0,
+			"value 1",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := Response{
+				Value:      []byte("value 1"),
+				Expiration: time.Now().Add(24 * time.Hour),
+			}
+			if tt.storedAt != 0 {
+				response.StoredAt = time.Now().Add(tt.storedAt)
+			}
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: response.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:        adapter,
+				TTL:            1 * time.Minute,
+				AbsoluteMaxAge: 1 * time.Hour,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+type expirationAdapterMock struct {
+	adapterMock
+	expirations map[uint64]time.Time
+}
+
+func (a *expirationAdapterMock) Set(key uint64, response []byte, expiration time.Time) {
+	a.adapterMock.Set(key, response, expiration)
+	a.Lock()
+	defer a.Unlock()
+	a.expirations[key] = expiration
+}
+
+func TestMiddlewareMaxTTL(t *testing.T) {
+	tests := []struct {
+		name          string
+		ttl           string
+		cacheControl  string
+		wantTTL       time.Duration
+		wantHard      time.Duration
+		wantRetention time.Duration
+	}{
+		{
+			"ttl past the max ttl is capped",
+			"172800",
+			"",
+			24 * time.Hour,
+			24 * time.Hour,
+			24 * time.Hour,
+		},
+		{
+			"stale window past the max ttl is capped",
+			"82800",
+			"",
+			23 * time.Hour,
+			24 * time.Hour,
+			24 * time.Hour,
+		},
+		{
+			"stale-if-error window past the max ttl is capped",
+			"172800",
+			"stale-if-error=604800",
+			24 * time.Hour,
+			24 * time.Hour,
+			24 * time.Hour,
+		},
+		{
+			"ttl within the max ttl is kept",
+			"3600",
+			"stale-if-error=3600",
+			1 * time.Hour,
+			3 * time.Hour,
+			3 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			adapter := &expirationAdapterMock{
+				adapterMock: adapterMock{store: map[uint64][]byte{}},
+				expirations: map[uint64]time.Time{},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:              adapter,
+				TTL:                  1 * time.Minute,
+				TTLHeader:            "X-Cache-TTL",
+				StaleWhileRevalidate: 2 * time.Hour,
+				MaxTTL:               24 * time.Hour,
+				Clock:                func() time.Time { return now },
+			})
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Cache-TTL", tt.ttl)
+				if tt.cacheControl != "" {
+					w.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				w.Write([]byte("new value"))
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			response, _ := client.Inspect(r)
+			if got := response.Expiration.Sub(now); got != tt.wantTTL {
+				t.Errorf("*Client.Middleware() cached for %v, want %v", got, tt.wantTTL)
+			}
+			if got := response.HardExpiration.Sub(now); got != tt.wantHard {
+				t.Errorf("*Client.Middleware() kept for %v, want %v", got, tt.wantHard)
+			}
+			if got := adapter.expirations[14974843192121052621].Sub(now); got != tt.wantRetention {
+				t.Errorf("*Client.Middleware() set with expiration in %v, want %v", got, tt.wantRetention)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMetaAdapter(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		expiration   time.Duration
+		cacheControl string
+		wantBody     string
+	}{
+		{
+			"response past its stored expiration is regenerated",
+			-1 * time.Minute,
+			"",
+			"new value",
+		},
+		{
+			"response past its stored expiration is decoded for max-stale",
+			-1 * time.Minute,
+			"max-stale",
+			"value 1",
+		},
+		{
+			"response before its stored expiration is served",
+			1 * time.Minute,
+			"",
+			"value 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &metaAdapterMock{
+				adapterMock: adapterMock{
+					store: map[uint64][]byte{
+						14974843192121052621: Response{
+							Value:      []byte("value 1"),
+							Expiration: time.Now().Add(1 * time.Minute),
+						}.Bytes(),
+					},
+				},
+				expirations: map[uint64]time.Time{
+					14974843192121052621: time.Now().Add(tt.expiration),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Header.Set("Cache-Control", tt.cacheControl)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func BenchmarkMiddlewareExpiredMiss(b *testing.B) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+	expired := Response{
+		Value:      make([]byte, 64<<10),
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Expiration: time.Now().Add(-1 * time.Minute),
+	}.Bytes()
+
+	adapters := []struct {
+		name    string
+		adapter Adapter
+	}{
+		{
+			"decode",
+			&adapterMock{store: map[uint64][]byte{}},
+		},
+		{
+			"meta",
+			&metaAdapterMock{
+				adapterMock: adapterMock{store: map[uint64][]byte{}},
+				expirations: map[uint64]time.Time{},
+			},
+		},
+	}
+	for _, a := range adapters {
+		b.Run(a.name, func(b *testing.B) {
+			client, _ := NewClient(&Config{
+				Adapter: a.adapter,
+				TTL:     1 * time.Minute,
+			})
+			handler := client.Middleware(httpTestHandler)
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				switch adapter := a.adapter.(type) {
+				case *adapterMock:
+					adapter.store[14974843192121052621] = expired
+				case *metaAdapterMock:
+					adapter.store[14974843192121052621] = expired
+					adapter.expirations[14974843192121052621] = time.Now().Add(-1 * time.Minute)
+				}
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+		})
+	}
+}
+
 func TestNewClient(t *testing.T) {
 	adapter := &adapterMock{}
 
@@ -304,6 +4033,161 @@ func TestNewClient(t *testing.T) {
 			nil,
 			true,
 		},
+		{
+			"returns error",
+			&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Millisecond,
+				AdapterRetry: RetryPolicy{
+					MaxAttempts: 3,
+					BaseDelay:   -1 * time.Millisecond,
+				},
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Millisecond,
+				BypassSampleRate: 1.5,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:      adapter,
+				TTL:          1 * time.Millisecond,
+				MinBodyBytes: 10,
+				MaxBodyBytes: 5,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:        adapter,
+				TTL:            1 * time.Millisecond,
+				AbsoluteMaxAge: -1 * time.Minute,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Millisecond,
+				MaxTTL:  -1 * time.Minute,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:         adapter,
+				TTL:             1 * time.Millisecond,
+				MaxVaryVariants: -1,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:     adapter,
+				TTL:         1 * time.Millisecond,
+				TTLByStatus: map[int]time.Duration{404: 0},
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Millisecond,
+				SetFailurePolicy: "RETRY",
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:                adapter,
+				TTL:                    1 * time.Millisecond,
+				MinRequestsBeforeCache: -1,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Millisecond,
+				SetFailurePolicy: SetFailureFallback,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Millisecond,
+				SetFailurePolicy: SetFailureReport,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:          adapter,
+				TTL:              1 * time.Millisecond,
+				SetFailurePolicy: SetFailureFallback,
+				FallbackAdapter:  &adapterMock{store: map[uint64][]byte{}},
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:      adapter,
+				TTL:          1 * time.Millisecond,
+				ReleaseDelay: 1 * time.Second,
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:   adapter,
+				TTL:       1 * time.Millisecond,
+				KeyPrefix: "httpcache:",
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			&Config{
+				Adapter:                 adapter,
+				TTL:                     1 * time.Millisecond,
+				DistributedSingleFlight: true,
+			},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,97 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of Cache-Control headers, by lowercase
+// name. Directives without argument have an empty value.
+type cacheControl map[string]string
+
+// parseCacheControl parses every Cache-Control line of a header.
+func parseCacheControl(header http.Header) cacheControl {
+	return parseDirectives(header["Cache-Control"])
+}
+
+// parseDirectives parses the lines of a header with the syntax of
+// Cache-Control, such as Surrogate-Control.
+func parseDirectives(lines []string) cacheControl {
+	cc := cacheControl{}
+	for _, line := range lines {
+		for _, directive := range strings.Split(line, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+
+	return cc
+}
+
+// has reports whether a directive is present.
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// duration returns the delta-seconds argument of a directive. It returns false
+// when the directive is absent or its argument is not a number of seconds.
+func (cc cacheControl) duration(name string) (time.Duration, bool) {
+	return parseSeconds(cc[name])
+}
+
+// explicitFreshness reports whether a response header declares the freshness
+// of its response, or carries a validator to revalidate it with.
+func explicitFreshness(header http.Header) bool {
+	cc := parseCacheControl(header)
+	if cc.has("max-age") || cc.has("s-maxage") {
+		return true
+	}
+
+	return header.Get("Expires") != "" || header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// parseSeconds parses a non-negative integer number of seconds, such as the
+// delta-seconds argument of a directive.
+func parseSeconds(v string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,1014 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareImmutable(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		honor      bool
+		immutable  bool
+		expiration time.Duration
+		wantBody   string
+		wantCode   int
+	}{
+		{
+			"immutable entry is served despite no-cache",
+			true,
+			true,
+			1 * time.Minute,
+			"value 1",
+			302,
+		},
+		{
+			"mutable entry is regenerated on no-cache",
+			true,
+			false,
+			1 * time.Minute,
+			"new value",
+			200,
+		},
+		{
+			"expired immutable entry is regenerated",
+			true,
+			true,
+			-1 * time.Minute,
+			"new value",
+			200,
+		},
+		{
+			"mutable entry is served on no-cache by default",
+			false,
+			false,
+			1 * time.Minute,
+			"value 1",
+			302,
+		},
+		{
+			"immutable entry is served on no-cache by default",
+			false,
+			true,
+			1 * time.Minute,
+			"value 1",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(tt.expiration),
+						Immutable:  tt.immutable,
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:             adapter,
+				TTL:                 1 * time.Minute,
+				HonorRequestNoCache: tt.honor,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Header.Set("Cache-Control", "no-cache")
+
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMaxStale(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		expiration   time.Duration
+		wantBody     string
+		wantWarning  string
+	}{
+		{
+			"stale entry within max-stale is served",
+			"max-stale=30",
+			-20 * time.Second,
+			"value 1",
+			`110 - "Response is Stale"`,
+		},
+		{
+			"stale entry beyond max-stale is regenerated",
+			"max-stale=30",
+			-40 * time.Second,
+			"new value",
+			"",
+		},
+		{
+			"max-stale without value accepts any staleness",
+			"max-stale",
+			-24 * time.Hour,
+			"value 1",
+			`110 - "Response is Stale"`,
+		},
+		{
+			"invalid max-stale is ignored",
+			"max-stale=soon",
+			-20 * time.Second,
+			"new value",
+			"",
+		},
+		{
+			"fresh entry is served without warning",
+			"max-stale=30",
+			1 * time.Minute,
+			"value 1",
+			"",
+		},
+		{
+			"stale entry is regenerated without max-stale",
+			"",
+			-20 * time.Second,
+			"new value",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(tt.expiration),
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Header.Set("Cache-Control", tt.cacheControl)
+
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+			if got := w.Header().Get("Warning"); got != tt.wantWarning {
+				t.Errorf("*Client.Middleware() Warning = %v, want %v", got, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestMiddlewareMinFresh(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		immutable    bool
+		wantBody     string
+	}{
+		{
+			"entry not fresh long enough is regenerated",
+			"min-fresh=60",
+			false,
+			"new value",
+		},
+		{
+			"immutable entry not fresh long enough is regenerated",
+			"min-fresh=60",
+			true,
+			"new value",
+		},
+		{
+			"entry fresh long enough is served",
+			"min-fresh=5",
+			false,
+			"value 1",
+		},
+		{
+			"invalid min-fresh is ignored",
+			"min-fresh=later",
+			false,
+			"value 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(10 * time.Second),
+						Immutable:  tt.immutable,
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Header.Set("Cache-Control", tt.cacheControl)
+
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSurrogateControl(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path != "/plain" {
+			w.Header().Set("Surrogate-Control", "max-age=300")
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name             string
+		surrogateControl bool
+		path             string
+		wantTTL          time.Duration
+		wantHeader       string
+	}{
+		{
+			"uses surrogate-control max-age as ttl",
+			true,
+			"/test-1",
+			300 * time.Second,
+			"",
+		},
+		{
+			"uses the configured ttl without surrogate-control",
+			true,
+			"/plain",
+			10 * time.Second,
+			"",
+		},
+		{
+			"ignores surrogate-control by default",
+			false,
+			"/test-1",
+			10 * time.Second,
+			"max-age=300",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:          adapter,
+				TTL:              10 * time.Second,
+				SurrogateControl: tt.surrogateControl,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			for _, wantCode := range []int{200, 302} {
+				r, _ := http.NewRequest("GET", "http://foo.bar"+tt.path, nil)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != wantCode {
+					t.Errorf("*Client.Middleware() = %v, want %v", w.Code, wantCode)
+				}
+				if got := w.Header().Get("Surrogate-Control"); got != tt.wantHeader {
+					t.Errorf("*Client.Middleware() Surrogate-Control = %v, want %v", got, tt.wantHeader)
+				}
+				if got := w.Header().Get("Cache-Control"); got != "max-age=60" {
+					t.Errorf("*Client.Middleware() Cache-Control = %v, want max-age=60", got)
+				}
+			}
+
+			for _, b := range adapter.store {
+				got := time.Until(BytesToResponse(b).Expiration)
+				if got < tt.wantTTL-5*time.Second || got > tt.wantTTL {
+					t.Errorf("*Client.Middleware() ttl = %v, want %v", got, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareTTLHeader(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Surrogate-Control", "max-age=300")
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			w.Header().Set("X-Cache-TTL", v)
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name    string
+		ttl     string
+		wantTTL time.Duration
+	}{
+		{
+			"uses a valid ttl header",
+			"120",
+			120 * time.Second,
+		},
+		{
+			"ignores an invalid ttl header",
+			"soon",
+			300 * time.Second,
+		},
+		{
+			"falls back without ttl header",
+			"",
+			300 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:          adapter,
+				TTL:              10 * time.Second,
+				SurrogateControl: true,
+				TTLHeader:        "x-cache-ttl",
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1?ttl="+tt.ttl, nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if got := w.Header().Get("X-Cache-TTL"); got != "" {
+				t.Errorf("*Client.Middleware() X-Cache-TTL = %v, want none", got)
+			}
+			for _, b := range adapter.store {
+				got := time.Until(BytesToResponse(b).Expiration)
+				if got < tt.wantTTL-5*time.Second || got > tt.wantTTL {
+					t.Errorf("*Client.Middleware() ttl = %v, want %v", got, tt.wantTTL)
+				}
+			}
+			if len(adapter.store) != 1 {
+				t.Errorf("*Client.Middleware() stored %v responses, want 1", len(adapter.store))
+			}
+		})
+	}
+}
+
+func TestMiddlewareTTLBySize(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Write(make([]byte, 2<<20))
+			return
+		}
+		if r.URL.Path == "/override" {
+			w.Header().Set("X-Cache-TTL", "30")
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		ttlBySize func(int) time.Duration
+		wantTTL   time.Duration
+	}{
+		{
+			"large body gets a long ttl",
+			"/large",
+			func(size int) time.Duration {
+				if size > 1<<20 {
+					return 1 * time.Hour
+				}
+				return 60 * time.Second
+			},
+			1 * time.Hour,
+		},
+		{
+			"small body gets a short ttl",
+			"/small",
+			func(size int) time.Duration {
+				if size > 1<<20 {
+					return 1 * time.Hour
+				}
+				return 60 * time.Second
+			},
+			60 * time.Second,
+		},
+		{
+			"non-positive ttl falls back to the configured one",
+			"/small",
+			func(int) time.Duration { return 0 },
+			10 * time.Second,
+		},
+		{
+			"ttl header takes precedence",
+			"/override",
+			func(int) time.Duration { return 1 * time.Hour },
+			30 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:   adapter,
+				TTL:       10 * time.Second,
+				TTLBySize: tt.ttlBySize,
+				TTLHeader: "X-Cache-TTL",
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar"+tt.path, nil)
+			client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(adapter.store) != 1 {
+				t.Fatalf("*Client.Middleware() stored %v responses, want 1", len(adapter.store))
+			}
+			for _, b := range adapter.store {
+				got := time.Until(BytesToResponse(b).Expiration)
+				if got < tt.wantTTL-5*time.Second || got > tt.wantTTL {
+					t.Errorf("*Client.Middleware() ttl = %v, want %v", got, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareTTLByStatus(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		if r.URL.Query().Get("ttl") != "" {
+			w.Header().Set("X-Cache-TTL", r.URL.Query().Get("ttl"))
+		}
+		w.WriteHeader(code)
+		w.Write([]byte("new value"))
+	})
+
+	ttlByStatus := map[int]time.Duration{
+		200: 5 * time.Minute,
+		301: 1 * time.Hour,
+		308: 1 * time.Hour,
+		404: 30 * time.Second,
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		wantTTL time.Duration
+	}{
+		{
+			"200 gets the ttl of its class",
+			"code=200",
+			5 * time.Minute,
+		},
+		{
+			"203 gets the ttl of its class",
+			"code=203",
+			5 * time.Minute,
+		},
+		{
+			"301 gets its own ttl",
+			"code=301",
+			1 * time.Hour,
+		},
+		{
+			"308 gets its own ttl",
+			"code=308",
+			1 * time.Hour,
+		},
+		{
+			"302 falls back to the configured ttl",
+			"code=302",
+			10 * time.Second,
+		},
+		{
+			"404 gets its own ttl",
+			"code=404",
+			30 * time.Second,
+		},
+		{
+			"ttl header takes precedence",
+			"code=404&ttl=90",
+			90 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:     adapter,
+				TTL:         10 * time.Second,
+				TTLByStatus: ttlByStatus,
+				TTLHeader:   "X-Cache-TTL",
+				Cacheable: func(statusCode int) bool {
+					return statusCode < 400 || statusCode == 404
+				},
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1?"+tt.query, nil)
+			client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(adapter.store) != 1 {
+				t.Fatalf("*Client.Middleware() stored %v responses, want 1", len(adapter.store))
+			}
+			for _, b := range adapter.store {
+				got := time.Until(BytesToResponse(b).Expiration)
+				if got < tt.wantTTL-5*time.Second || got > tt.wantTTL {
+					t.Errorf("*Client.Middleware() ttl = %v, want %v", got, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareStaleIfError(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		url          string
+		staleIfError time.Duration
+		expiration   time.Duration
+		wantCode     int
+		wantBody     string
+		wantWarning  string
+	}{
+		{
+			"stale entry is served on error within the window",
+			"http://foo.bar/test-1?fail=1",
+			600 * time.Second,
+			-5 * time.Minute,
+			302,
+			"value 1",
+			`110 - "Response is Stale"`,
+		},
+		{
+			"error is served beyond the window",
+			"http://foo.bar/test-1?fail=1",
+			600 * time.Second,
+			-20 * time.Minute,
+			500,
+			"new value",
+			"",
+		},
+		{
+			"error is served without stale-if-error",
+			"http://foo.bar/test-1?fail=1",
+			0,
+			-5 * time.Minute,
+			500,
+			"new value",
+			"",
+		},
+		{
+			"regenerated response is served within the window",
+			"http://foo.bar/test-1",
+			600 * time.Second,
+			-5 * time.Minute,
+			200,
+			"new value",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			client, _ := NewClient(&Config{
+				Adapter: &adapterMock{store: map[uint64][]byte{}},
+				TTL:     1 * time.Minute,
+			})
+			client.adapter.Set(client.KeyFor(r), Response{
+				Value:        []byte("value 1"),
+				Expiration:   time.Now().Add(tt.expiration),
+				StaleIfError: tt.staleIfError,
+			}.Bytes(), time.Now().Add(1*time.Hour))
+
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if got := w.Header().Get("Warning"); got != tt.wantWarning {
+				t.Errorf("*Client.Middleware() Warning = %v, want %v", got, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStoresStaleIfError(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+	if got := BytesToResponse(adapter.store[14974843192121052621]).StaleIfError; got != 600*time.Second {
+		t.Errorf("*Client.Middleware() stored stale-if-error = %v, want 10m0s", got)
+	}
+}
+
+func TestMiddlewareStaleWhileRevalidateDirective(t *testing.T) {
+	tests := []struct {
+		name                 string
+		staleWhileRevalidate time.Duration
+		cacheControl         string
+		wantWindow           time.Duration
+	}{
+		{
+			"uses the window of the response",
+			0,
+			"max-age=60, stale-while-revalidate=30",
+			30 * time.Second,
+		},
+		{
+			"overrides the window of the client",
+			5 * time.Minute,
+			"max-age=60, stale-while-revalidate=30",
+			30 * time.Second,
+		},
+		{
+			"falls back to the window of the client",
+			5 * time.Minute,
+			"max-age=60",
+			5 * time.Minute,
+		},
+		{
+			"ignores an invalid window",
+			5 * time.Minute,
+			"stale-while-revalidate=soon",
+			5 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Write([]byte("new value"))
+			})
+
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:              adapter,
+				TTL:                  1 * time.Minute,
+				StaleWhileRevalidate: tt.staleWhileRevalidate,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			stored := BytesToResponse(adapter.store[14974843192121052621])
+			if got := stored.HardExpiration.Sub(stored.Expiration); got != tt.wantWindow {
+				t.Errorf("*Client.Middleware() stale-while-revalidate window = %v, want %v", got, tt.wantWindow)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStaleWhileRevalidateDirectiveRefresh(t *testing.T) {
+	refreshed := make(chan struct{}, 1)
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+		refreshed <- struct{}{}
+	})
+
+	tests := []struct {
+		name           string
+		hardExpiration time.Duration
+		wantCode       int
+		wantBody       string
+	}{
+		{
+			"stale entry within its own window is served and refreshed",
+			20 * time.Second,
+			302,
+			"value 1",
+		},
+		{
+			"stale entry beyond its own window is regenerated",
+			-5 * time.Second,
+			200,
+			"new value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: Response{
+						Value:          []byte("value 1"),
+						Expiration:     time.Now().Add(-10 * time.Second),
+						HardExpiration: time.Now().Add(tt.hardExpiration),
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			select {
+			case <-refreshed:
+			case <-time.After(1 * time.Second):
+				t.Error("*Client.Middleware() did not regenerate the stale entry")
+			}
+		})
+	}
+}
+
+func TestMiddlewareStoresImmutable(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, Immutable")
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+	if !BytesToResponse(adapter.store[14974843192121052621]).Immutable {
+		t.Error("*Client.Middleware() did not store the immutable flag")
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	header := http.Header{
+		"Cache-Control": {`public, Max-Age=60, no-cache="Set-Cookie"`, "immutable"},
+	}
+
+	want := cacheControl{
+		"public":    "",
+		"max-age":   "60",
+		"no-cache":  "Set-Cookie",
+		"immutable": "",
+	}
+	if got := parseCacheControl(header); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCacheControl() = %v, want %v", got, want)
+	}
+}
+
+func TestCacheControlDuration(t *testing.T) {
+	cc := cacheControl{"max-age": "60", "max-stale": "", "min-fresh": "-1", "s-maxage": "1.5"}
+
+	tests := []struct {
+		name      string
+		directive string
+		want      time.Duration
+		ok        bool
+	}{
+		{
+			"parses delta-seconds",
+			"max-age",
+			60 * time.Second,
+			true,
+		},
+		{
+			"rejects missing argument",
+			"max-stale",
+			0,
+			false,
+		},
+		{
+			"rejects negative argument",
+			"min-fresh",
+			0,
+			false,
+		},
+		{
+			"rejects fractional argument",
+			"s-maxage",
+			0,
+			false,
+		},
+		{
+			"rejects absent directive",
+			"no-cache",
+			0,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cc.duration(tt.directive)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("cacheControl.duration() = %v %v, want %v %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMiddlewareOnlyIfCached(t *testing.T) {
+	called := false
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		url          string
+		cacheControl string
+		expiration   time.Duration
+		wantBody     string
+		wantCode     int
+	}{
+		{
+			"fresh entry is served",
+			"http://foo.bar/test-1",
+			"only-if-cached",
+			1 * time.Minute,
+			"value 1",
+			302,
+		},
+		{
+			"missing entry is a gateway timeout",
+			"http://foo.bar/test-2",
+			"only-if-cached",
+			1 * time.Minute,
+			"Gateway Timeout\n",
+			504,
+		},
+		{
+			"stale entry is a gateway timeout",
+			"http://foo.bar/test-1",
+			"only-if-cached",
+			-1 * time.Minute,
+			"Gateway Timeout\n",
+			504,
+		},
+		{
+			"stale entry within max-stale is served",
+			"http://foo.bar/test-1",
+			"only-if-cached, max-stale=120",
+			-1 * time.Minute,
+			"value 1",
+			302,
+		},
+		{
+			"no-cache entry is served without regenerating it",
+			"http://foo.bar/test-1",
+			"only-if-cached, no-cache",
+			1 * time.Minute,
+			"value 1",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			adapter := &adapterMock{
+				store: map[uint64][]byte{
+					14974843192121052621: Response{
+						Value:      []byte("value 1"),
+						Expiration: time.Now().Add(tt.expiration),
+					}.Bytes(),
+				},
+			}
+			client, _ := NewClient(&Config{
+				Adapter:              adapter,
+				TTL:                  1 * time.Minute,
+				StaleWhileRevalidate: 5 * time.Minute,
+			})
+
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			r.Header.Set("Cache-Control", tt.cacheControl)
+
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %q, want %v %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if called {
+				t.Error("*Client.Middleware() called the handler, want the cache only")
+			}
+		})
+	}
+}
+
+func TestMiddlewareRequireExplicitFreshness(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		require    bool
+		wantCached bool
+	}{
+		{
+			"response with max-age is cached",
+			http.Header{"Cache-Control": []string{"public, max-age=60"}},
+			true,
+			true,
+		},
+		{
+			"response with s-maxage is cached",
+			http.Header{"Cache-Control": []string{"s-maxage=60"}},
+			true,
+			true,
+		},
+		{
+			"response with expires is cached",
+			http.Header{"Expires": []string{"Thu, 01 Dec 2039 16:00:00 GMT"}},
+			true,
+			true,
+		},
+		{
+			"response with an etag is cached",
+			http.Header{"Etag": []string{`"v1"`}},
+			true,
+			true,
+		},
+		{
+			"response with last-modified is cached",
+			http.Header{"Last-Modified": []string{"Thu, 01 Dec 2016 16:00:00 GMT"}},
+			true,
+			true,
+		},
+		{
+			"response without freshness information is not cached",
+			http.Header{"Cache-Control": []string{"public"}},
+			true,
+			false,
+		},
+		{
+			"response without freshness information is cached by default",
+			http.Header{},
+			false,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.Write([]byte("new value"))
+			})
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:                  adapter,
+				TTL:                      1 * time.Minute,
+				RequireExplicitFreshness: tt.require,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+			if w.Code != 200 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+			}
+			if _, ok := adapter.store[14974843192121052621]; ok != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", ok, tt.wantCached)
+			}
+		})
+	}
+}
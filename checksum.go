@@ -0,0 +1,47 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// checksum returns the SHA-256 hash of a body.
+func checksum(body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return sum[:]
+}
+
+// verified reports whether the body of a cached response matches its
+// checksum, when VerifyChecksum is set. Mismatches are logged.
+func (c *Client) verified(key uint64, response Response) bool {
+	if !c.verifyChecksum || bytes.Equal(response.Checksum, checksum(response.Value)) {
+		return true
+	}
+
+	c.logf("cache: checksum mismatch of the response cached for key %d", key)
+	return false
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareVerifyChecksum(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		verify     bool
+		tamper     func(b []byte) []byte
+		wantBody   string
+		wantCode   int
+		wantErrors int
+	}{
+		{
+			"intact response is served",
+			true,
+			func(b []byte) []byte { return b },
+			"new value",
+			302,
+			0,
+		},
+		{
+			"tampered response is a miss",
+			true,
+			func(b []byte) []byte {
+				b[bytes.Index(b, []byte("new value"))] ^= 1
+				return b
+			},
+			"new value",
+			200,
+			1,
+		},
+		{
+			"response without checksum is a miss",
+			true,
+			func(b []byte) []byte {
+				response := BytesToResponse(b)
+				response.Checksum = nil
+				return response.Bytes()
+			},
+			"new value",
+			200,
+			1,
+		},
+		{
+			"tampered response is served without verification",
+			false,
+			func(b []byte) []byte {
+				b[bytes.Index(b, []byte("new value"))] ^= 1
+				return b
+			},
+			"oew value",
+			302,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errs []error
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:        adapter,
+				TTL:            1 * time.Minute,
+				VerifyChecksum: tt.verify,
+				ErrorLog:       log.New(ioutil.Discard, "", 0),
+				OnError: func(err error) {
+					errs = append(errs, err)
+				},
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			b, ok := adapter.store[14974843192121052621]
+			if !ok {
+				t.Fatal("*Client.Middleware() did not cache the response")
+			}
+			adapter.store[14974843192121052621] = tt.tamper(b)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if len(errs) != tt.wantErrors {
+				t.Errorf("*Client.Middleware() errors = %v, want %v", errs, tt.wantErrors)
+			}
+			if got := BytesToResponse(adapter.store[14974843192121052621]); tt.verify && !bytes.Equal(got.Checksum, checksum(got.Value)) {
+				t.Error("*Client.Middleware() cached a response failing its checksum, want it replaced")
+			}
+		})
+	}
+}
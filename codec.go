@@ -0,0 +1,313 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Codec encodes the responses cached by the adapter into bytes, and decodes
+// them back.
+type Codec interface {
+	// Encode returns the bytes of a response.
+	Encode(r Response) []byte
+
+	// Decode returns the response of bytes returned by Encode. Bytes which
+	// fail to decode yield the zero Response.
+	Decode(b []byte) Response
+}
+
+// GobCodec is the default codec, encoding responses with encoding/gob like
+// Response.Bytes. It decodes the bytes of BinaryCodec too.
+type GobCodec struct{}
+
+// Encode implements the Codec interface Encode method.
+func (GobCodec) Encode(r Response) []byte {
+	return r.Bytes()
+}
+
+// Decode implements the Codec interface Decode method.
+func (GobCodec) Decode(b []byte) Response {
+	return BytesToResponse(b)
+}
+
+// BinaryCodec is a compact codec, encoding the fields of responses as
+// length-prefixed varints and bytes, without the type information gob writes
+// along each response. Its bytes are smaller and faster to encode, and are
+// decoded by BytesToResponse like gob ones, so adapters decoding responses
+// such as the memory one support both. It decodes the bytes of GobCodec too,
+// e.g. the responses cached before switching codec.
+type BinaryCodec struct{}
+
+// binaryMagic prefixes the bytes of BinaryCodec, followed by the version of
+// their format. Gob bytes never start with a zero byte.
+var binaryMagic = []byte("\x00hc")
+
+// binaryVersion is the version of the format of BinaryCodec.
+const binaryVersion = 1
+
+// Encode implements the Codec interface Encode method.
+func (BinaryCodec) Encode(r Response) []byte {
+	w := &binaryWriter{b: make([]byte, 0, 64+len(r.Value))}
+	w.b = append(w.b, binaryMagic...)
+	w.b = append(w.b, binaryVersion)
+
+	w.bytes(r.Value)
+	w.header(r.Header)
+	w.header(r.Trailer)
+	w.varint(int64(r.StatusCode))
+	w.bool(r.Immutable)
+	w.time(r.LastModified)
+	w.time(r.StoredAt)
+	w.string(r.URL)
+	w.time(r.Expiration)
+	w.time(r.HardExpiration)
+	w.strings(r.Vary)
+	w.uvarint(uint64(len(r.Variants)))
+	for _, k := range r.Variants {
+		w.uvarint(k)
+	}
+	w.varint(int64(r.StaleIfError))
+	w.time(r.LastAccess)
+	w.varint(int64(r.Frequency))
+	w.bytes(r.Checksum)
+
+	return w.b
+}
+
+// Decode implements the Codec interface Decode method.
+func (BinaryCodec) Decode(b []byte) Response {
+	return BytesToResponse(b)
+}
+
+// decodeBinary decodes the bytes of BinaryCodec.
+func decodeBinary(b []byte) Response {
+	b = b[len(binaryMagic):]
+	if len(b) == 0 || b[0] != binaryVersion {
+		return Response{}
+	}
+	rd := &binaryReader{b: b[1:]}
+
+	var r Response
+	r.Value = rd.bytes()
+	r.Header = rd.header()
+	r.Trailer = rd.header()
+	r.StatusCode = int(rd.varint())
+	r.Immutable = rd.bool()
+	r.LastModified = rd.time()
+	r.StoredAt = rd.time()
+	r.URL = rd.string()
+	r.Expiration = rd.time()
+	r.HardExpiration = rd.time()
+	r.Vary = rd.strings()
+	if n := rd.count(); n > 0 {
+		r.Variants = make([]uint64, n)
+		for i := range r.Variants {
+			r.Variants[i] = rd.uvarint()
+		}
+	}
+	r.StaleIfError = time.Duration(rd.varint())
+	r.LastAccess = rd.time()
+	r.Frequency = int(rd.varint())
+	r.Checksum = rd.bytes()
+
+	if rd.failed {
+		return Response{}
+	}
+	return r
+}
+
+// binaryWriter appends the fields of a response to bytes.
+type binaryWriter struct {
+	b   []byte
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.buf[:], v)
+	w.b = append(w.b, w.buf[:n]...)
+}
+
+func (w *binaryWriter) varint(v int64) {
+	n := binary.PutVarint(w.buf[:], v)
+	w.b = append(w.b, w.buf[:n]...)
+}
+
+func (w *binaryWriter) bool(v bool) {
+	if v {
+		w.b = append(w.b, 1)
+	} else {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *binaryWriter) bytes(v []byte) {
+	w.uvarint(uint64(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *binaryWriter) string(v string) {
+	w.uvarint(uint64(len(v)))
+	w.b = append(w.b, v...)
+}
+
+func (w *binaryWriter) strings(v []string) {
+	w.uvarint(uint64(len(v)))
+	for _, s := range v {
+		w.string(s)
+	}
+}
+
+// time writes the zero time as false, and others as true followed by their
+// Unix time in nanoseconds.
+func (w *binaryWriter) time(v time.Time) {
+	w.bool(!v.IsZero())
+	if !v.IsZero() {
+		w.varint(v.UnixNano())
+	}
+}
+
+// header writes the keys of a header in order, so that equal headers are
+// encoded the same.
+func (w *binaryWriter) header(h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		w.string(k)
+		w.strings(h[k])
+	}
+}
+
+// binaryReader reads the fields of a response from bytes. Once it failed, on
+// truncated or invalid bytes, it reads zero values.
+type binaryReader struct {
+	b      []byte
+	failed bool
+}
+
+func (rd *binaryReader) uvarint() uint64 {
+	v, n := binary.Uvarint(rd.b)
+	if n <= 0 {
+		rd.failed = true
+		return 0
+	}
+	rd.b = rd.b[n:]
+	return v
+}
+
+func (rd *binaryReader) varint() int64 {
+	v, n := binary.Varint(rd.b)
+	if n <= 0 {
+		rd.failed = true
+		return 0
+	}
+	rd.b = rd.b[n:]
+	return v
+}
+
+func (rd *binaryReader) bool() bool {
+	if rd.failed || len(rd.b) == 0 {
+		rd.failed = true
+		return false
+	}
+	v := rd.b[0] == 1
+	rd.b = rd.b[1:]
+	return v
+}
+
+// count reads the length of a list, each item of which takes a byte at least.
+func (rd *binaryReader) count() int {
+	n := rd.uvarint()
+	if n > uint64(len(rd.b)) {
+		rd.failed = true
+		return 0
+	}
+	return int(n)
+}
+
+// bytes reads a copy of length-prefixed bytes, so that the response does not
+// share the memory of the adapter. Empty bytes are read as nil, as gob does.
+func (rd *binaryReader) bytes() []byte {
+	n := rd.count()
+	if n == 0 {
+		return nil
+	}
+	v := append([]byte(nil), rd.b[:n]...)
+	rd.b = rd.b[n:]
+	return v
+}
+
+func (rd *binaryReader) string() string {
+	n := rd.count()
+	v := string(rd.b[:n])
+	rd.b = rd.b[n:]
+	return v
+}
+
+func (rd *binaryReader) strings() []string {
+	n := rd.count()
+	if n == 0 {
+		return nil
+	}
+	v := make([]string, n)
+	for i := range v {
+		v[i] = rd.string()
+	}
+	return v
+}
+
+func (rd *binaryReader) time() time.Time {
+	if !rd.bool() {
+		return time.Time{}
+	}
+	return time.Unix(0, rd.varint())
+}
+
+func (rd *binaryReader) header() http.Header {
+	n := rd.count()
+	if n == 0 {
+		return nil
+	}
+	h := make(http.Header, n)
+	for i := 0; i < n && !rd.failed; i++ {
+		k := rd.string()
+		h[k] = rd.strings()
+	}
+	return h
+}
+
+// isBinary reports whether bytes were encoded by BinaryCodec.
+func isBinary(b []byte) bool {
+	return bytes.HasPrefix(b, binaryMagic)
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func codecTestResponse() Response {
+	now := time.Unix(1700000000, 123456789)
+	return Response{
+		Value:          []byte(strings.Repeat("value ", 10)),
+		Header:         http.Header{"Content-Type": []string{"text/plain"}, "Vary": []string{"Accept", "Accept-Language"}},
+		Trailer:        http.Header{"X-Checksum": []string{"abc"}},
+		StatusCode:     203,
+		Immutable:      true,
+		LastModified:   now.Add(-1 * time.Hour),
+		StoredAt:       now,
+		URL:            "http://foo.bar/test-1?a=1",
+		Expiration:     now.Add(1 * time.Minute),
+		HardExpiration: now.Add(2 * time.Minute),
+		Vary:           []string{"Accept"},
+		Variants:       []uint64{1, 14974843192121052621},
+		StaleIfError:   30 * time.Second,
+		LastAccess:     now.Add(10 * time.Second),
+		Frequency:      42,
+		Checksum:       []byte{1, 2, 3},
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	full := codecTestResponse()
+
+	tests := []struct {
+		name     string
+		response Response
+	}{
+		{
+			"round-trips every field",
+			full,
+		},
+		{
+			"round-trips the zero response",
+			Response{},
+		},
+		{
+			"round-trips a response without body",
+			Response{StatusCode: 204, Expiration: full.Expiration},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := BinaryCodec{}.Encode(tt.response)
+			if got := (BinaryCodec{}).Decode(b); !reflect.DeepEqual(got, tt.response) {
+				t.Errorf("BinaryCodec.Decode() = %+v, want %+v", got, tt.response)
+			}
+			if got := BytesToResponse(b); !reflect.DeepEqual(got, tt.response) {
+				t.Errorf("BytesToResponse() = %+v, want %+v", got, tt.response)
+			}
+		})
+	}
+}
+
+func TestCodecCrossVersion(t *testing.T) {
+	response := codecTestResponse()
+	binary := BinaryCodec{}.Encode(response)
+
+	tests := []struct {
+		name  string
+		codec Codec
+		b     []byte
+		want  Response
+	}{
+		{
+			"binary codec decodes gob bytes",
+			BinaryCodec{},
+			response.Bytes(),
+			response,
+		},
+		{
+			"gob codec decodes binary bytes",
+			GobCodec{},
+			binary,
+			response,
+		},
+		{
+			"unknown format version decodes to the zero response",
+			BinaryCodec{},
+			append(append([]byte(nil), binaryMagic...), binaryVersion+1),
+			Response{},
+		},
+		{
+			"truncated bytes decode to the zero response",
+			BinaryCodec{},
+			binary[:len(binary)-2],
+			Response{},
+		},
+		{
+			"bytes with a corrupt length decode to the zero response",
+			BinaryCodec{},
+			append(append([]byte(nil), binaryMagic...), binaryVersion, 0xff, 0xff, 0x03),
+			Response{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotResponse := tt.codec.Decode(tt.b)
+			if tt.want.Expiration.IsZero() {
+				if !reflect.DeepEqual(gotResponse, Response{}) {
+					t.Errorf("%T.Decode() = %+v, want the zero response", tt.codec, gotResponse)
+				}
+				return
+			}
+			if string(gotResponse.Value) != string(tt.want.Value) || !gotResponse.Expiration.Equal(tt.want.Expiration) ||
+				!reflect.DeepEqual(gotResponse.Header, tt.want.Header) || !reflect.DeepEqual(gotResponse.Variants, tt.want.Variants) ||
+				gotResponse.Frequency != tt.want.Frequency {
+				t.Errorf("%T.Decode() = %+v, want %+v", tt.codec, gotResponse, tt.want)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecSize(t *testing.T) {
+	response := codecTestResponse()
+	gob, binary := len(response.Bytes()), len(BinaryCodec{}.Encode(response))
+	t.Logf("gob: %v bytes, binary: %v bytes", gob, binary)
+	if binary*2 > gob {
+		t.Errorf("BinaryCodec.Encode() = %v bytes, want less than half of the %v of gob", binary, gob)
+	}
+}
+
+func TestMiddlewareCodec(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		storeCodec Codec
+		readCodec  Codec
+	}{
+		{
+			"binary codec serves its responses",
+			BinaryCodec{},
+			BinaryCodec{},
+		},
+		{
+			"binary codec serves the responses of gob",
+			nil,
+			BinaryCodec{},
+		},
+		{
+			"gob codec serves the responses of binary",
+			BinaryCodec{},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			storeClient, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+				Codec:   tt.storeCodec,
+			})
+			readClient, _ := NewClient(&Config{
+				Adapter: adapter,
+				TTL:     1 * time.Minute,
+				Codec:   tt.readCodec,
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			storeClient.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			if binary := isBinary(adapter.store[14974843192121052621]); binary != (tt.storeCodec != nil) {
+				t.Errorf("*Client.Middleware() cached binary bytes = %v, want %v", binary, tt.storeCodec != nil)
+			}
+
+			w := httptest.NewRecorder()
+			readClient.Middleware(httpTestHandler).ServeHTTP(w, r)
+			if w.Code != 302 || w.Body.String() != "new value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 302 new value", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	response := codecTestResponse()
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{
+			"gob",
+			GobCodec{},
+		},
+		{
+			"binary",
+			BinaryCodec{},
+		},
+	}
+	for _, c := range codecs {
+		encoded := c.codec.Encode(response)
+		b.Run(c.name+"/encode", func(b *testing.B) {
+			b.SetBytes(int64(len(encoded)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.codec.Encode(response)
+			}
+		})
+		b.Run(c.name+"/decode", func(b *testing.B) {
+			b.SetBytes(int64(len(encoded)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.codec.Decode(encoded)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressed returns the response to serve on a hit with CompressOnServe: the
+// gzip-compressed variant of a cached response for clients accepting gzip, or
+// the response itself for others. Both vary on Accept-Encoding.
+func (c *Client) compressed(r *http.Request, key uint64, response Response) Response {
+	if len(response.Value) == 0 || response.Header.Get("Content-Encoding") != "" {
+		return response
+	}
+
+	response.Header = storedHeader(response.Header, nil)
+	if !varies(response.Header, "Accept-Encoding") {
+		response.Header.Add("Vary", "Accept-Encoding")
+	}
+	if !accepts(r.Header.Get("Accept-Encoding"), "gzip") {
+		return response
+	}
+
+	return c.gzipVariant(r.Context(), key, response)
+}
+
+// gzipVariant returns the gzip-compressed variant of a cached response. It is
+// cached under its own key along with the response, so that each response is
+// compressed once.
+func (c *Client) gzipVariant(ctx context.Context, key uint64, response Response) Response {
+	variantKey := generateKey(strconv.FormatUint(key, 16) + "\x00gzip")
+	if b, ok := c.get(ctx, variantKey); ok {
+		if variant := c.decode(b); variant.Expiration.Equal(response.Expiration) && c.verified(variantKey, variant) {
+			return variant
+		}
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(response.Value)
+	gw.Close()
+
+	variant := response
+	variant.Value = buf.Bytes()
+	variant.Header = storedHeader(response.Header, nil)
+	variant.Header.Set("Content-Encoding", "gzip")
+	variant.Header.Del("Content-Length")
+	if c.verifyChecksum {
+		variant.Checksum = checksum(variant.Value)
+	}
+	c.set(ctx, variantKey, c.encode(variant), c.retention(response))
+
+	return variant
+}
+
+// varies reports whether a response header lists a request header in Vary.
+func varies(header http.Header, key string) bool {
+	for _, v := range header["Vary"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k == "*" || strings.EqualFold(k, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareCompressOnServe(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/encoded" {
+			w.Header().Set("Content-Encoding", "br")
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+		wantVary       string
+		wantStored     int
+	}{
+		{
+			"compresses hits for gzip-accepting clients",
+			"/test-1",
+			"br, gzip;q=0.8",
+			"gzip",
+			"Accept-Encoding",
+			2,
+		},
+		{
+			"serves hits uncompressed to other clients",
+			"/test-1",
+			"gzip;q=0, br",
+			"",
+			"Accept-Encoding",
+			1,
+		},
+		{
+			"serves hits uncompressed without accept-encoding",
+			"/test-1",
+			"",
+			"",
+			"Accept-Encoding",
+			1,
+		},
+		{
+			"does not compress encoded responses",
+			"/encoded",
+			"gzip",
+			"br",
+			"",
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:         adapter,
+				TTL:             1 * time.Minute,
+				CompressOnServe: true,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			for i, wantCode := range []int{200, 302, 302} {
+				r, _ := http.NewRequest("GET", "http://foo.bar"+tt.path, nil)
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != wantCode {
+					t.Errorf("*Client.Middleware() = %v, want %v", w.Code, wantCode)
+				}
+				if i == 0 {
+					continue
+				}
+				if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+					t.Errorf("*Client.Middleware() Content-Encoding = %v, want %v", got, tt.wantEncoding)
+				}
+				if got := w.Header().Get("Vary"); got != tt.wantVary {
+					t.Errorf("*Client.Middleware() Vary = %v, want %v", got, tt.wantVary)
+				}
+
+				body := w.Body.String()
+				if tt.wantEncoding == "gzip" {
+					gr, err := gzip.NewReader(w.Body)
+					if err != nil {
+						t.Fatalf("*Client.Middleware() body is not gzipped: %v", err)
+					}
+					b, _ := ioutil.ReadAll(gr)
+					body = string(b)
+				}
+				if body != "new value" {
+					t.Errorf("*Client.Middleware() decoded body = %v, want new value", body)
+				}
+			}
+
+			if len(adapter.store) != tt.wantStored {
+				t.Errorf("*Client.Middleware() stored %v responses, want %v", len(adapter.store), tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCompressOnServeRegenerated(t *testing.T) {
+	value := "value 1"
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(value))
+	})
+
+	client, _ := NewClient(&Config{
+		Adapter:         &adapterMock{store: map[uint64][]byte{}},
+		TTL:             1 * time.Minute,
+		ReleaseKey:      "rk",
+		CompressOnServe: true,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for _, u := range []string{"/test-1", "/test-1", "/test-1?rk=true", "/test-1", "/test-1"} {
+		if u == "/test-1?rk=true" {
+			value = "value 2"
+		}
+		r, _ := http.NewRequest("GET", "http://foo.bar"+u, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("*Client.Middleware() body is not gzipped: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(gr); string(b) != "value 2" {
+		t.Errorf("*Client.Middleware() decoded body = %v, want value 2", string(b))
+	}
+}
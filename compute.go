@@ -0,0 +1,130 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// computeCall is a compute run by GetOrCompute, awaited by the concurrent
+// calls for the same key when CoalesceCompute is set.
+type computeCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// GetOrCompute returns the value cached for a key, or computes, caches and
+// returns it on a miss. Values are kept for the TTL of the client, and
+// compute errors are returned without being cached. It shares the adapter of
+// the middleware, so keys must not collide with the ones of requests. If
+// compute panics, the coalesced calls waiting for it return an error.
+func (c *Client) GetOrCompute(key uint64, compute func() ([]byte, error)) ([]byte, error) {
+	if atomic.LoadInt32(&c.disabled) == 1 {
+		return compute()
+	}
+	if value, ok := c.computed(key); ok {
+		return value, nil
+	}
+	if !c.coalesceCompute {
+		return c.compute(key, compute)
+	}
+
+	c.computeMu.Lock()
+	if call, ok := c.computes[key]; ok {
+		c.computeMu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &computeCall{done: make(chan struct{})}
+	if c.computes == nil {
+		c.computes = map[uint64]*computeCall{}
+	}
+	c.computes[key] = call
+	c.computeMu.Unlock()
+
+	defer func() {
+		if err := recover(); err != nil {
+			call.value, call.err = nil, fmt.Errorf("cache: compute panicked: %v", err)
+			c.finishCompute(key, call)
+			panic(err)
+		}
+		c.finishCompute(key, call)
+	}()
+
+	// The value may have been cached by a call completed since the miss.
+	if value, ok := c.computed(key); ok {
+		call.value = value
+		return value, nil
+	}
+	call.value, call.err = c.compute(key, compute)
+
+	return call.value, call.err
+}
+
+// finishCompute hands the result of a compute call to the calls awaiting it.
+func (c *Client) finishCompute(key uint64, call *computeCall) {
+	c.computeMu.Lock()
+	delete(c.computes, key)
+	c.computeMu.Unlock()
+	close(call.done)
+}
+
+// computed returns the fresh value cached for a key by GetOrCompute, if any.
+func (c *Client) computed(key uint64) ([]byte, bool) {
+	b, ok := c.get(context.Background(), key)
+	if !ok {
+		return nil, false
+	}
+
+	response := c.decode(b)
+	if !response.Expiration.After(c.clock()) || !c.verified(key, response) {
+		return nil, false
+	}
+
+	return response.Value, true
+}
+
+// compute runs compute and caches its value, unless it fails.
+func (c *Client) compute(key uint64, compute func() ([]byte, error)) ([]byte, error) {
+	value, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.clock()
+	c.store(context.Background(), key, Response{
+		Value:          value,
+		Expiration:     now.Add(c.ttl),
+		HardExpiration: now.Add(c.ttl),
+		StoredAt:       now,
+		LastAccess:     now,
+		Frequency:      1,
+	})
+
+	return value, nil
+}
@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrCompute(t *testing.T) {
+	now := time.Now()
+	adapter := &adapterMock{
+		store: map[uint64][]byte{
+			1: Response{
+				Value:      []byte("cached"),
+				Expiration: now.Add(1 * time.Minute),
+			}.Bytes(),
+			2: Response{
+				Value:      []byte("expired"),
+				Expiration: now.Add(-1 * time.Minute),
+			}.Bytes(),
+		},
+	}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+
+	tests := []struct {
+		name         string
+		key          uint64
+		value        string
+		err          error
+		want         string
+		wantErr      error
+		wantComputed bool
+		wantCached   bool
+	}{
+		{
+			"returns the cached value",
+			1,
+			"computed",
+			nil,
+			"cached",
+			nil,
+			false,
+			true,
+		},
+		{
+			"computes an expired value",
+			2,
+			"computed",
+			nil,
+			"computed",
+			nil,
+			true,
+			true,
+		},
+		{
+			"computes and caches a missing value",
+			3,
+			"computed",
+			nil,
+			"computed",
+			nil,
+			true,
+			true,
+		},
+		{
+			"returns compute errors without caching",
+			4,
+			"",
+			errors.New("compute failed"),
+			"",
+			errors.New("compute failed"),
+			true,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			computed := false
+			got, err := client.GetOrCompute(tt.key, func() ([]byte, error) {
+				computed = true
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return []byte(tt.value), nil
+			})
+			if string(got) != tt.want {
+				t.Errorf("Client.GetOrCompute() = %q, want %q", got, tt.want)
+			}
+			if (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("Client.GetOrCompute() error = %v, want %v", err, tt.wantErr)
+			}
+			if computed != tt.wantComputed {
+				t.Errorf("Client.GetOrCompute() computed = %v, want %v", computed, tt.wantComputed)
+			}
+			if _, ok := client.computed(tt.key); ok != tt.wantCached {
+				t.Errorf("Client.GetOrCompute() cached = %v, want %v", ok, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestGetOrComputeCoalesce(t *testing.T) {
+	tests := []struct {
+		name         string
+		coalesce     bool
+		wantComputes int32
+	}{
+		{
+			"coalesces concurrent computes",
+			true,
+			1,
+		},
+		{
+			"computes concurrently without coalescing",
+			false,
+			10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:         &adapterMock{store: map[uint64][]byte{}},
+				TTL:             1 * time.Minute,
+				CoalesceCompute: tt.coalesce,
+			})
+
+			var computes int32
+			release := make(chan struct{})
+			var started, wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				started.Add(1)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					started.Done()
+					got, err := client.GetOrCompute(1, func() ([]byte, error) {
+						atomic.AddInt32(&computes, 1)
+						<-release
+						return []byte("computed"), nil
+					})
+					if err != nil || string(got) != "computed" {
+						t.Errorf("Client.GetOrCompute() = %q %v, want computed", got, err)
+					}
+				}()
+			}
+			started.Wait()
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if got := atomic.LoadInt32(&computes); got != tt.wantComputes {
+				t.Errorf("Client.GetOrCompute() computes = %v, want %v", got, tt.wantComputes)
+			}
+		})
+	}
+}
+
+func TestGetOrComputePanic(t *testing.T) {
+	client, _ := NewClient(&Config{
+		Adapter:         &adapterMock{store: map[uint64][]byte{}},
+		TTL:             1 * time.Minute,
+		CoalesceCompute: true,
+	})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if recover() == nil {
+				t.Error("Client.GetOrCompute() recovered from the compute panic")
+			}
+		}()
+		client.GetOrCompute(1, func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("compute")
+		})
+	}()
+
+	<-started
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := client.GetOrCompute(1, func() ([]byte, error) {
+				return []byte("computed"), nil
+			})
+			if err == nil || got != nil {
+				t.Errorf("Client.GetOrCompute() = %q %v, want an error", got, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got, err := client.GetOrCompute(1, func() ([]byte, error) {
+		return []byte("computed"), nil
+	}); err != nil || string(got) != "computed" {
+		t.Errorf("Client.GetOrCompute() = %q %v, want computed", got, err)
+	}
+}
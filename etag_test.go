@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{
+			"matches the same etag",
+			`"v1"`,
+			`"v1"`,
+			true,
+		},
+		{
+			"matches one of a list",
+			`"v0", "v1"`,
+			`"v1"`,
+			true,
+		},
+		{
+			"matches weakly",
+			`W/"v1"`,
+			`"v1"`,
+			true,
+		},
+		{
+			"matches any etag with a wildcard",
+			"*",
+			`"v1"`,
+			true,
+		},
+		{
+			"does not match another etag",
+			`"v0"`,
+			`"v1"`,
+			false,
+		},
+		{
+			"does not match without if-none-match",
+			"",
+			`"v1"`,
+			false,
+		},
+		{
+			"does not match without etag",
+			"*",
+			"",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+				t.Errorf("etagMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareGenerateETag(t *testing.T) {
+	const generated = `"9c51d0b0f64dfb3662ed85ce945dd1e8"`
+
+	tests := []struct {
+		name         string
+		generate     bool
+		originETag   string
+		ifNoneMatch  string
+		wantMissETag string
+		wantCode     int
+		wantBody     string
+	}{
+		{
+			"generates an etag served on misses and hits",
+			true,
+			"",
+			"",
+			generated,
+			302,
+			"new value",
+		},
+		{
+			"answers a matching conditional hit with 304",
+			true,
+			"",
+			generated,
+			generated,
+			304,
+			"",
+		},
+		{
+			"serves a conditional hit not matching",
+			true,
+			"",
+			`"other"`,
+			generated,
+			302,
+			"new value",
+		},
+		{
+			"keeps the etag of the origin",
+			true,
+			`"origin"`,
+			`"origin"`,
+			`"origin"`,
+			304,
+			"",
+		},
+		{
+			"generates no etag by default",
+			false,
+			"",
+			generated,
+			"",
+			302,
+			"new value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.originETag != "" {
+					w.Header().Set("ETag", tt.originETag)
+				}
+				w.Write([]byte("new value"))
+			})
+			client, _ := NewClient(&Config{
+				Adapter:      &adapterMock{store: map[uint64][]byte{}},
+				TTL:          1 * time.Minute,
+				GenerateETag: tt.generate,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("ETag"); got != tt.wantMissETag {
+				t.Errorf("*Client.Middleware() miss ETag = %v, want %v", got, tt.wantMissETag)
+			}
+
+			r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantMissETag {
+				t.Errorf("*Client.Middleware() hit ETag = %v, want %v", got, tt.wantMissETag)
+			}
+		})
+	}
+}
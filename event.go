@@ -0,0 +1,109 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// Status is the way the cache handled a request.
+type Status string
+
+const (
+	// StatusHit is the status of requests served a fresh cached response.
+	StatusHit Status = "HIT"
+
+	// StatusStale is the status of requests served a stale cached response.
+	StatusStale Status = "STALE"
+
+	// StatusMiss is the status of requests served a response generated by
+	// the handler, whether it was then cached or not, or a 504 Gateway
+	// Timeout for only-if-cached requests.
+	StatusMiss Status = "MISS"
+
+	// StatusBypass is the status of requests passed through to the handler
+	// without being looked up, such as POST or release requests.
+	StatusBypass Status = "BYPASS"
+)
+
+// CacheEvent describes how the cache handled a request.
+type CacheEvent struct {
+	// Key is the cache key of the request. It is zero for bypassed
+	// requests, which are not looked up.
+	Key uint64
+
+	// Request is the handled request.
+	Request *http.Request
+
+	// Status is the way the cache handled the request.
+	Status Status
+
+	// Size is the size in bytes of the body served from the cache or
+	// generated by the handler. It is zero for bypassed requests.
+	Size int
+
+	// Duration is how long the request took to be handled.
+	Duration time.Duration
+
+	// BackendError reports whether the handler failed to serve a miss, with
+	// a 5xx status code.
+	BackendError bool
+
+	// BackendTimeout reports whether the deadline of the request passed
+	// before the handler served a miss, a stale response being served
+	// instead.
+	BackendTimeout bool
+}
+
+// statusClass is the category of a status code, shared by the decisions
+// depending on whether a response is a success or an error.
+type statusClass int
+
+const (
+	// classFresh is the class of successful responses, below 400.
+	classFresh statusClass = iota
+
+	// classNegative is the class of client errors, 4xx, which are results
+	// of the request, e.g. 404 Not Found, rather than failures of the
+	// handler.
+	classNegative
+
+	// classError is the class of server errors, 5xx and beyond, which are
+	// failures of the handler.
+	classError
+)
+
+// classify returns the class of a status code.
+func classify(statusCode int) statusClass {
+	switch {
+	case statusCode < 400:
+		return classFresh
+	case statusCode < 500:
+		return classNegative
+	default:
+		return classError
+	}
+}
@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareOnEvent(t *testing.T) {
+	var events []CacheEvent
+	adapter := &adapterMock{
+		store: map[uint64][]byte{
+			14974839893586167988: Response{
+				Value:      []byte("stale value"),
+				Expiration: time.Now().Add(-1 * time.Minute),
+			}.Bytes(),
+		},
+	}
+	client, _ := NewClient(&Config{
+		Adapter:    adapter,
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+		OnEvent: func(e CacheEvent) {
+			events = append(events, e)
+		},
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	}))
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		cacheControl string
+		wantKey      uint64
+		wantStatus   Status
+		wantSize     int
+	}{
+		{
+			"miss",
+			"GET",
+			"http://foo.bar/test-1",
+			"",
+			14974843192121052621,
+			StatusMiss,
+			9,
+		},
+		{
+			"hit",
+			"GET",
+			"http://foo.bar/test-1",
+			"",
+			14974843192121052621,
+			StatusHit,
+			9,
+		},
+		{
+			"stale",
+			"GET",
+			"http://foo.bar/test-2",
+			"max-stale",
+			14974839893586167988,
+			StatusStale,
+			11,
+		},
+		{
+			"bypass of uncacheable method",
+			"POST",
+			"http://foo.bar/test-1",
+			"",
+			0,
+			StatusBypass,
+			0,
+		},
+		{
+			"bypass of release",
+			"GET",
+			"http://foo.bar/test-1?rk=true",
+			"",
+			0,
+			StatusBypass,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events = nil
+
+			r, _ := http.NewRequest(tt.method, tt.url, nil)
+			r.Header.Set("Cache-Control", tt.cacheControl)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(events) != 1 {
+				t.Errorf("*Client.Middleware() events = %v, want 1", len(events))
+				return
+			}
+			e := events[0]
+			if e.Key != tt.wantKey || e.Status != tt.wantStatus || e.Size != tt.wantSize {
+				t.Errorf("*Client.Middleware() event = %v %v %v, want %v %v %v",
+					e.Key, e.Status, e.Size, tt.wantKey, tt.wantStatus, tt.wantSize)
+			}
+			if e.Request != r {
+				t.Error("*Client.Middleware() event request is not the handled one")
+			}
+			if e.Duration < 0 {
+				t.Errorf("*Client.Middleware() event duration = %v", e.Duration)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		want       statusClass
+	}{
+		{
+			"ok is fresh",
+			200,
+			classFresh,
+		},
+		{
+			"no content is fresh",
+			204,
+			classFresh,
+		},
+		{
+			"moved permanently is fresh",
+			301,
+			classFresh,
+		},
+		{
+			"not modified is fresh",
+			304,
+			classFresh,
+		},
+		{
+			"bad request is negative",
+			400,
+			classNegative,
+		},
+		{
+			"not found is negative",
+			404,
+			classNegative,
+		},
+		{
+			"gone is negative",
+			410,
+			classNegative,
+		},
+		{
+			"internal server error is an error",
+			500,
+			classError,
+		},
+		{
+			"service unavailable is an error",
+			503,
+			classError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(tt.statusCode); got != tt.want {
+				t.Errorf("classify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCacheable(t *testing.T) {
+	var events []CacheEvent
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/failing":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name             string
+		cacheable        func(int) bool
+		path             string
+		wantCached       bool
+		wantBackendError bool
+	}{
+		{
+			"caches success by default",
+			nil,
+			"/test-1",
+			true,
+			false,
+		},
+		{
+			"does not cache not found by default",
+			nil,
+			"/missing",
+			false,
+			false,
+		},
+		{
+			"caches not found when cacheable",
+			func(statusCode int) bool { return statusCode < 400 || statusCode == 404 },
+			"/missing",
+			true,
+			false,
+		},
+		{
+			"reports backend errors",
+			nil,
+			"/failing",
+			false,
+			true,
+		},
+		{
+			"does not cache success when not cacheable",
+			func(statusCode int) bool { return false },
+			"/test-1",
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events = nil
+			adapter := &adapterMock{store: map[uint64][]byte{}}
+			client, _ := NewClient(&Config{
+				Adapter:   adapter,
+				TTL:       1 * time.Minute,
+				Cacheable: tt.cacheable,
+				OnEvent: func(e CacheEvent) {
+					events = append(events, e)
+				},
+			})
+
+			r, _ := http.NewRequest("GET", "http://foo.bar"+tt.path, nil)
+			client.Middleware(httpTestHandler).ServeHTTP(httptest.NewRecorder(), r)
+
+			if cached := len(adapter.store) > 0; cached != tt.wantCached {
+				t.Errorf("*Client.Middleware() cached = %v, want %v", cached, tt.wantCached)
+			}
+			if len(events) != 1 || events[0].BackendError != tt.wantBackendError {
+				t.Errorf("*Client.Middleware() events = %v, want BackendError %v", events, tt.wantBackendError)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// flightPollInterval is how often a client waiting for another one to cache
+// a response polls the adapter.
+const flightPollInterval = 25 * time.Millisecond
+
+// defaultFlightTimeout is the default of Config.SingleFlightTimeout.
+const defaultFlightTimeout = 5 * time.Second
+
+// LockingAdapter is implemented by adapters able to lock a key across every
+// client sharing their store, such as the Redis one. It makes distributed
+// single flight possible.
+type LockingAdapter interface {
+	Adapter
+
+	// LockKey acquires the lock of a given key until it is unlocked or ttl
+	// elapsed. It returns false if the lock is held by someone else.
+	LockKey(key uint64, ttl time.Duration) (bool, error)
+
+	// UnlockKey releases the lock of a given key acquired by LockKey.
+	UnlockKey(key uint64) error
+}
+
+// awaitFlight acquires the lock of a key to regenerate its response, or waits
+// for the lock holder to cache it. It returns the response cached meanwhile if
+// any, else whether the lock was acquired. The response is regenerated without
+// the lock once the timeout elapsed, the request is done or the adapter fails.
+func (c *Client) awaitFlight(r *http.Request, key uint64) (Response, bool, bool) {
+	deadline := time.Now().Add(c.flightTimeout)
+	for {
+		locked, err := c.locker.LockKey(key, c.flightTimeout)
+		if err != nil {
+			c.logf("cache: adapter LockKey failed: %v", err)
+			return Response{}, false, false
+		}
+
+		// The response may have been cached by a lock holder since the
+		// request missed it.
+		if response, ok := c.flightResponse(r, key); ok {
+			if locked {
+				c.unlock(key)
+			}
+			return response, true, false
+		}
+		if locked {
+			return Response{}, false, true
+		}
+
+		if !time.Now().Before(deadline) {
+			return Response{}, false, false
+		}
+		select {
+		case <-r.Context().Done():
+			return Response{}, false, false
+		case <-time.After(flightPollInterval):
+		}
+	}
+}
+
+// flightResponse returns the fresh response cached for a key, if any.
+func (c *Client) flightResponse(r *http.Request, key uint64) (Response, bool) {
+	b, ok := c.get(r.Context(), key)
+	if !ok {
+		return Response{}, false
+	}
+
+	_, response, ok := c.variant(r, key, c.decode(b), func(k uint64) ([]byte, bool) {
+		return c.get(r.Context(), k)
+	})
+	if !ok {
+		return Response{}, false
+	}
+
+	now := c.clock()
+	if !response.Expiration.After(now) || c.exceedsMaxAge(response, now) {
+		return Response{}, false
+	}
+
+	return response, true
+}
+
+// unlock releases the lock of a key acquired by awaitFlight.
+func (c *Client) unlock(key uint64) {
+	if err := c.locker.UnlockKey(key); err != nil {
+		c.logf("cache: adapter UnlockKey failed: %v", err)
+	}
+}
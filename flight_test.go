@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type lockingAdapterMock struct {
+	adapterMock
+	locks   map[uint64]time.Time
+	lockErr error
+}
+
+func (a *lockingAdapterMock) LockKey(key uint64, ttl time.Duration) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.lockErr != nil {
+		return false, a.lockErr
+	}
+	if until, ok := a.locks[key]; ok && until.After(time.Now()) {
+		return false, nil
+	}
+	a.locks[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (a *lockingAdapterMock) UnlockKey(key uint64) error {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.locks, key)
+	return nil
+}
+
+func TestMiddlewareDistributedSingleFlight(t *testing.T) {
+	var calls int32
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		heldLock  bool
+		lockErr   error
+		wantCalls int32
+	}{
+		{
+			"one client regenerates a shared miss",
+			1 * time.Second,
+			false,
+			nil,
+			1,
+		},
+		{
+			"clients regenerate once the lock holder timed out",
+			50 * time.Millisecond,
+			true,
+			nil,
+			4,
+		},
+		{
+			"clients regenerate when locking fails",
+			1 * time.Second,
+			false,
+			errors.New("lock error"),
+			4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			adapter := &lockingAdapterMock{
+				adapterMock: adapterMock{store: map[uint64][]byte{}},
+				locks:       map[uint64]time.Time{},
+				lockErr:     tt.lockErr,
+			}
+			if tt.heldLock {
+				adapter.locks[14974843192121052621] = time.Now().Add(1 * time.Hour)
+			}
+
+			var handlers []http.Handler
+			for i := 0; i < 2; i++ {
+				client, _ := NewClient(&Config{
+					Adapter:                 adapter,
+					TTL:                     1 * time.Minute,
+					DistributedSingleFlight: true,
+					SingleFlightTimeout:     tt.timeout,
+					ErrorLog:                log.New(ioutil.Discard, "", 0),
+				})
+				handlers = append(handlers, client.Middleware(httpTestHandler))
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(handler http.Handler) {
+					defer wg.Done()
+					r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, r)
+					if w.Body.String() != "new value" {
+						t.Errorf("*Client.Middleware() = %v, want new value", w.Body.String())
+					}
+				}(handlers[i%2])
+			}
+			wg.Wait()
+
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are the headers meaningful only for a single transport-level
+// connection, which must not be stored nor replayed (RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// privateHeaders are the headers meant for a single client, such as its
+// session cookies, which must not be stored nor replayed to others.
+var privateHeaders = []string{
+	"Set-Cookie",
+	"Set-Cookie2",
+}
+
+// bodyHeaders are the headers describing how the stored bytes of a body are
+// encoded, always cached along with it so that clients can decode it.
+var bodyHeaders = []string{
+	"Content-Encoding",
+}
+
+// storedHeader returns a copy of a response header to be cached, without the
+// hop-by-hop headers. If allowed is not nil, only the headers it lists and the
+// body headers are kept.
+func storedHeader(header http.Header, allowed []string) http.Header {
+	stored := make(http.Header, len(header))
+	if allowed == nil {
+		for k, v := range header {
+			stored[k] = v
+		}
+	} else {
+		for _, k := range append(bodyHeaders, allowed...) {
+			if v, ok := header[http.CanonicalHeaderKey(k)]; ok {
+				stored[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+	}
+
+	removeHopByHopHeaders(stored)
+
+	return stored
+}
+
+// sharedHeader returns a copy of a response header to be cached or served from
+// the cache, as returned by storedHeader but also without the private headers.
+func sharedHeader(header http.Header, allowed []string) http.Header {
+	shared := storedHeader(header, allowed)
+	for _, k := range privateHeaders {
+		shared.Del(k)
+	}
+
+	return shared
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers of a header, including
+// the ones listed by its Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				header.Del(k)
+			}
+		}
+	}
+	for _, k := range hopByHopHeaders {
+		header.Del(k)
+	}
+}
+
+// storedTrailer returns a copy of a response trailer to be cached, or nil if
+// it is empty.
+func storedTrailer(trailer http.Header) http.Header {
+	if len(trailer) == 0 {
+		return nil
+	}
+
+	stored := make(http.Header, len(trailer))
+	for k, v := range trailer {
+		stored[k] = v
+	}
+
+	return stored
+}
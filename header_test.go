@@ -0,0 +1,315 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareHopByHopHeaders(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "keep-alive, X-Custom-Hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("X-Custom-Hop", "1")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for _, wantCode := range []int{200, 302} {
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != wantCode {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Code, wantCode)
+		}
+		for _, k := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "X-Custom-Hop"} {
+			if _, ok := w.Header()[k]; ok {
+				t.Errorf("*Client.Middleware() header %v is replayed", k)
+			}
+		}
+		if w.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("*Client.Middleware() Content-Type = %v, want text/plain", w.Header().Get("Content-Type"))
+		}
+	}
+
+	stored := BytesToResponse(adapter.store[14974843192121052621]).Header
+	if !reflect.DeepEqual(stored, http.Header{"Content-Type": {"text/plain"}}) {
+		t.Errorf("*Client.Middleware() stored header = %v", stored)
+	}
+}
+
+func TestMiddlewareLinkPreload(t *testing.T) {
+	links := []string{"</style.css>; rel=preload; as=style", "</app.js>; rel=preload; as=script"}
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, l := range links {
+			w.Header().Add("Link", l)
+		}
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name         string
+		storeHeaders []string
+		wantLinks    []string
+	}{
+		{
+			"replays preload links",
+			nil,
+			links,
+		},
+		{
+			"replays preload links listed in the stored headers",
+			[]string{"link"},
+			links,
+		},
+		{
+			"drops preload links not listed in the stored headers",
+			[]string{"Content-Type"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:      &adapterMock{store: map[uint64][]byte{}},
+				TTL:          1 * time.Minute,
+				StoreHeaders: tt.storeHeaders,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test-1", nil))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/test-1", nil))
+
+			if w.Code != 302 {
+				t.Errorf("*Client.Middleware() = %v, want 302", w.Code)
+			}
+			if got := w.Header()["Link"]; !reflect.DeepEqual(got, tt.wantLinks) {
+				t.Errorf("*Client.Middleware() Link = %v, want %v", got, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestMiddlewareContentEncoding(t *testing.T) {
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("new value"))
+	gw.Close()
+
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(gzipped.Bytes())
+	})
+
+	tests := []struct {
+		name         string
+		storeHeaders []string
+	}{
+		{
+			"replays content encoding with every header stored",
+			nil,
+		},
+		{
+			"replays content encoding with headers not allowed",
+			[]string{"Content-Type"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:      &adapterMock{store: map[uint64][]byte{}},
+				TTL:          1 * time.Minute,
+				StoreHeaders: tt.storeHeaders,
+			})
+			handler := client.Middleware(httpTestHandler)
+
+			for _, wantCode := range []int{200, 302} {
+				r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != wantCode {
+					t.Errorf("*Client.Middleware() = %v, want %v", w.Code, wantCode)
+				}
+				if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Errorf("*Client.Middleware() Content-Encoding = %v, want gzip", got)
+				}
+				gr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Errorf("*Client.Middleware() body is not gzipped: %v", err)
+					continue
+				}
+				if b, _ := ioutil.ReadAll(gr); string(b) != "new value" {
+					t.Errorf("*Client.Middleware() decoded body = %v, want new value", string(b))
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareSetCookie(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session="+r.Header.Get("X-User")+"-secret")
+		w.Header().Set("Set-Cookie2", "legacy="+r.Header.Get("X-User"))
+		w.Write([]byte("new value"))
+	})
+
+	tests := []struct {
+		name       string
+		user       string
+		wantCode   int
+		wantCookie string
+	}{
+		{
+			"first client gets its cookie",
+			"user-a",
+			200,
+			"session=user-a-secret",
+		},
+		{
+			"second client does not get the cookie of the first",
+			"user-b",
+			302,
+			"",
+		},
+	}
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:      adapter,
+		TTL:          1 * time.Minute,
+		StoreHeaders: []string{"Set-Cookie"},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			r.Header.Set("X-User", tt.user)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Header().Get("Set-Cookie") != tt.wantCookie {
+				t.Errorf("*Client.Middleware() = %v with Set-Cookie %q, want %v with %q", w.Code, w.Header().Get("Set-Cookie"), tt.wantCode, tt.wantCookie)
+			}
+			if tt.wantCookie == "" && w.Header().Get("Set-Cookie2") != "" {
+				t.Errorf("*Client.Middleware() Set-Cookie2 = %q, want none", w.Header().Get("Set-Cookie2"))
+			}
+		})
+	}
+
+	response := Response{
+		Value:      []byte("value 1"),
+		Header:     http.Header{"Set-Cookie": {"session=user-a-secret"}},
+		Expiration: time.Now().Add(1 * time.Minute),
+	}
+	adapter.store[14974839893586167988] = response.Bytes()
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-2", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != 302 || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("*Client.Middleware() replayed %v with Set-Cookie %q, want 302 with none", w.Code, w.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestStoredHeader(t *testing.T) {
+	header := http.Header{
+		"Connection":       {"close"},
+		"Content-Encoding": {"gzip"},
+		"Content-Type":     {"text/plain"},
+		"Etag":             {`"1"`},
+		"Upgrade":          {"h2c"},
+	}
+
+	tests := []struct {
+		name    string
+		allowed []string
+		want    http.Header
+	}{
+		{
+			"strips hop-by-hop headers",
+			nil,
+			http.Header{
+				"Content-Encoding": {"gzip"},
+				"Content-Type":     {"text/plain"},
+				"Etag":             {`"1"`},
+			},
+		},
+		{
+			"keeps allowed and body headers only",
+			[]string{"content-type", "Connection"},
+			http.Header{
+				"Content-Encoding": {"gzip"},
+				"Content-Type":     {"text/plain"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := storedHeader(header, tt.allowed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("storedHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareTrailer(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc-web")
+		w.Write([]byte("new value"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter: adapter,
+		TTL:     1 * time.Minute,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	want := http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}}
+	for _, wantCode := range []int{200, 302} {
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		res := w.Result()
+		if res.StatusCode != wantCode || w.Body.String() != "new value" {
+			t.Errorf("*Client.Middleware() = %v %v, want %v new value", res.StatusCode, w.Body.String(), wantCode)
+		}
+		if !reflect.DeepEqual(res.Trailer, want) {
+			t.Errorf("*Client.Middleware() trailer = %v, want %v", res.Trailer, want)
+		}
+		if got := w.Header().Get("Content-Length"); got != "" {
+			t.Errorf("*Client.Middleware() Content-Length = %v, want none", got)
+		}
+	}
+
+	stored := BytesToResponse(adapter.store[14974843192121052621])
+	if !reflect.DeepEqual(stored.Trailer, want) {
+		t.Errorf("*Client.Middleware() stored trailer = %v, want %v", stored.Trailer, want)
+	}
+	for _, k := range []string{"Trailer", "Grpc-Status"} {
+		if _, ok := stored.Header[k]; ok {
+			t.Errorf("*Client.Middleware() stored header %v", k)
+		}
+	}
+}
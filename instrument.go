@@ -0,0 +1,115 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// InstrumentedAdapter is an adapter wrapper which times every operation of the
+// adapter it wraps, e.g. to feed a latency histogram of a networked backend.
+type InstrumentedAdapter struct {
+	Adapter
+	observe func(op string, d time.Duration)
+}
+
+// Get implements the Adapter interface Get method, timed as "Get".
+func (a *InstrumentedAdapter) Get(key uint64) ([]byte, bool) {
+	start := time.Now()
+	response, ok := a.Adapter.Get(key)
+	a.observe("Get", time.Since(start))
+
+	return response, ok
+}
+
+// Set implements the Adapter interface Set method, timed as "Set".
+func (a *InstrumentedAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	start := time.Now()
+	a.Adapter.Set(key, response, expiration)
+	a.observe("Set", time.Since(start))
+}
+
+// Release implements the Adapter interface Release method, timed as
+// "Release".
+func (a *InstrumentedAdapter) Release(key uint64) {
+	start := time.Now()
+	a.Adapter.Release(key)
+	a.observe("Release", time.Since(start))
+}
+
+// GetCtx implements the ContextAdapter interface GetCtx method, timed as
+// "Get".
+func (a *InstrumentedAdapter) GetCtx(ctx context.Context, key uint64) ([]byte, bool, error) {
+	start := time.Now()
+	response, ok, err := getCtx(ctx, a.Adapter, key)
+	a.observe("Get", time.Since(start))
+
+	return response, ok, err
+}
+
+// SetCtx implements the ContextAdapter interface SetCtx method, timed as
+// "Set".
+func (a *InstrumentedAdapter) SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	start := time.Now()
+	err := setCtx(ctx, a.Adapter, key, response, expiration)
+	a.observe("Set", time.Since(start))
+
+	return err
+}
+
+// ReleaseCtx frees cache for a given key honouring the context, timed as
+// "Release".
+func (a *InstrumentedAdapter) ReleaseCtx(ctx context.Context, key uint64) error {
+	start := time.Now()
+	err := releaseCtx(ctx, a.Adapter, key)
+	a.observe("Release", time.Since(start))
+
+	return err
+}
+
+// Flush implements the FlushableAdapter interface Flush method, timed as
+// "Flush". The client only calls it when the wrapped adapter supports it.
+func (a *InstrumentedAdapter) Flush() {
+	fa, ok := a.Adapter.(FlushableAdapter)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	fa.Flush()
+	a.observe("Flush", time.Since(start))
+}
+
+func (a *InstrumentedAdapter) unwrap() Adapter {
+	return a.Adapter
+}
+
+// NewInstrumentedAdapter wraps an adapter so that observe is called with the
+// name and duration of each of its operations. observe is called on the
+// request path, so it must be fast, e.g. recording into a histogram.
+func NewInstrumentedAdapter(adapter Adapter, observe func(op string, d time.Duration)) Adapter {
+	return &InstrumentedAdapter{adapter, observe}
+}
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type slowAdapterMock struct {
+	adapterMock
+	delay time.Duration
+}
+
+func (a *slowAdapterMock) Get(key uint64) ([]byte, bool) {
+	time.Sleep(a.delay)
+	return a.adapterMock.Get(key)
+}
+
+func TestInstrumentedAdapter(t *testing.T) {
+	var ops []string
+	var durations []time.Duration
+	mock := &slowAdapterMock{
+		adapterMock: adapterMock{store: map[uint64][]byte{}},
+		delay:       10 * time.Millisecond,
+	}
+	a := NewInstrumentedAdapter(mock, func(op string, d time.Duration) {
+		ops = append(ops, op)
+		durations = append(durations, d)
+	})
+
+	a.Set(1, []byte("value 1"), time.Now().Add(1*time.Minute))
+	if b, ok := a.Get(1); !ok || string(b) != "value 1" {
+		t.Errorf("InstrumentedAdapter.Get() = %v %v, want value 1 true", string(b), ok)
+	}
+	a.Release(1)
+	if _, ok := a.Get(1); ok {
+		t.Error("InstrumentedAdapter.Get() ok = true, want false")
+	}
+
+	if want := []string{"Set", "Get", "Release", "Get"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("InstrumentedAdapter ops = %v, want %v", ops, want)
+	}
+	if durations[1] < 10*time.Millisecond || durations[3] < 10*time.Millisecond {
+		t.Errorf("InstrumentedAdapter Get durations = %v %v, want at least 10ms", durations[1], durations[3])
+	}
+}
+
+func TestInstrumentedAdapterContext(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	var ops []string
+	mock := &flakyAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}, failures: 1}
+	client, _ := NewClient(&Config{
+		Adapter: NewInstrumentedAdapter(mock, func(op string, d time.Duration) {
+			ops = append(ops, op)
+		}),
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+		AdapterRetry: RetryPolicy{
+			MaxAttempts: 2,
+			BaseDelay:   1 * time.Millisecond,
+		},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	for _, u := range []string{"http://foo.bar/test-1", "http://foo.bar/test-1", "http://foo.bar/test-1?rk=true"} {
+		r, _ := http.NewRequest("GET", u, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if mock.calls != 6 {
+		t.Errorf("InstrumentedAdapter context calls = %v, want 6", mock.calls)
+	}
+	if want := []string{"Get", "Get", "Set", "Get", "Set", "Get", "Release"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("InstrumentedAdapter ops = %v, want %v", ops, want)
+	}
+	if len(mock.store) != 0 {
+		t.Errorf("InstrumentedAdapter.ReleaseCtx() kept %v responses, want 0", len(mock.store))
+	}
+}
+
+func TestInstrumentedAdapterFlush(t *testing.T) {
+	tests := []struct {
+		name    string
+		adapter Adapter
+		wantErr bool
+		wantOps []string
+	}{
+		{
+			"flushes a flushable adapter",
+			&flushableAdapterMock{adapterMock{store: map[uint64][]byte{}}},
+			false,
+			[]string{"Flush"},
+		},
+		{
+			"returns error for an adapter not supporting flushing",
+			&adapterMock{store: map[uint64][]byte{}},
+			true,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []string
+			client, _ := NewClient(&Config{
+				Adapter: NewInstrumentedAdapter(tt.adapter, func(op string, d time.Duration) {
+					ops = append(ops, op)
+				}),
+				TTL: 1 * time.Minute,
+			})
+
+			if err := client.Flush(); (err != nil) != tt.wantErr {
+				t.Errorf("*Client.Flush() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Errorf("InstrumentedAdapter ops = %v, want %v", ops, tt.wantOps)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// MirrorAdapter is an adapter wrapper which writes to a secondary adapter as
+// well as to the primary one, e.g. to warm up a new backend while migrating to
+// it. Cached responses are only read from the primary adapter. Failures of the
+// secondary adapter are logged and do not affect the primary one.
+type MirrorAdapter struct {
+	Adapter
+	secondary Adapter
+	errorLog  *log.Logger
+}
+
+// Set implements the Adapter interface Set method, on both adapters.
+func (a *MirrorAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	a.Adapter.Set(key, response, expiration)
+
+	a.mirror("Set", func() error {
+		return setCtx(context.Background(), a.secondary, key, response, expiration)
+	})
+}
+
+// Release implements the Adapter interface Release method, on both adapters.
+func (a *MirrorAdapter) Release(key uint64) {
+	a.Adapter.Release(key)
+
+	a.mirror("Release", func() error {
+		return releaseCtx(context.Background(), a.secondary, key)
+	})
+}
+
+// GetCtx implements the ContextAdapter interface GetCtx method, on the primary
+// adapter.
+func (a *MirrorAdapter) GetCtx(ctx context.Context, key uint64) ([]byte, bool, error) {
+	return getCtx(ctx, a.Adapter, key)
+}
+
+// SetCtx implements the ContextAdapter interface SetCtx method, on both
+// adapters. Only the errors of the primary adapter are returned.
+func (a *MirrorAdapter) SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	err := setCtx(ctx, a.Adapter, key, response, expiration)
+
+	a.mirror("SetCtx", func() error {
+		return setCtx(ctx, a.secondary, key, response, expiration)
+	})
+
+	return err
+}
+
+// ReleaseCtx frees cache for a given key on both adapters, honouring the
+// context. Only the errors of the primary adapter are returned.
+func (a *MirrorAdapter) ReleaseCtx(ctx context.Context, key uint64) error {
+	err := releaseCtx(ctx, a.Adapter, key)
+
+	a.mirror("ReleaseCtx", func() error {
+		return releaseCtx(ctx, a.secondary, key)
+	})
+
+	return err
+}
+
+// Flush implements the FlushableAdapter interface Flush method, on the
+// adapters supporting it. The client only calls it when the primary adapter
+// does.
+func (a *MirrorAdapter) Flush() {
+	if fa, ok := a.Adapter.(FlushableAdapter); ok {
+		fa.Flush()
+	}
+
+	a.mirror("Flush", func() error {
+		if fa, ok := a.secondary.(FlushableAdapter); ok {
+			fa.Flush()
+		}
+		return nil
+	})
+}
+
+func (a *MirrorAdapter) unwrap() Adapter {
+	return a.Adapter
+}
+
+// mirror calls the secondary adapter, logging its errors and panics.
+func (a *MirrorAdapter) mirror(op string, fn func() error) {
+	defer func() {
+		if err := recover(); err != nil {
+			a.logf("cache: secondary adapter %s panicked: %v", op, err)
+		}
+	}()
+
+	if err := fn(); err != nil {
+		a.logf("cache: secondary adapter %s failed: %v", op, err)
+	}
+}
+
+func (a *MirrorAdapter) logf(format string, args ...interface{}) {
+	if a.errorLog != nil {
+		a.errorLog.Printf(format, args...)
+		return
+	}
+
+	log.Printf(format, args...)
+}
+
+// NewMirrorAdapter wraps a primary adapter so that its writes are mirrored to
+// a secondary one. Failures of the secondary adapter are logged with errorLog,
+// or with the standard logger when nil.
+func NewMirrorAdapter(primary, secondary Adapter, errorLog *log.Logger) Adapter {
+	return &MirrorAdapter{primary, secondary, errorLog}
+}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorAdapter(t *testing.T) {
+	primary := &adapterMock{store: map[uint64][]byte{}}
+	secondary := &adapterMock{store: map[uint64][]byte{}}
+	a := NewMirrorAdapter(primary, secondary, nil)
+
+	a.Set(1, []byte("value 1"), time.Now().Add(1*time.Minute))
+	a.Set(2, []byte("value 2"), time.Now().Add(1*time.Minute))
+	if len(primary.store) != 2 || len(secondary.store) != 2 {
+		t.Errorf("MirrorAdapter.Set() stored %v and %v responses, want 2 and 2", len(primary.store), len(secondary.store))
+	}
+
+	a.Release(1)
+	if _, ok := secondary.store[1]; ok {
+		t.Error("MirrorAdapter.Release() did not release the secondary response")
+	}
+
+	secondary.store[3] = []byte("value 3")
+	primary.store[2] = []byte("primary value 2")
+	tests := []struct {
+		name string
+		key  uint64
+		want string
+		ok   bool
+	}{
+		{
+			"reads from primary",
+			2,
+			"primary value 2",
+			true,
+		},
+		{
+			"does not read from secondary",
+			3,
+			"",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := a.Get(tt.key)
+			if string(b) != tt.want || ok != tt.ok {
+				t.Errorf("MirrorAdapter.Get() = %v %v, want %v %v", string(b), ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMirrorAdapterSecondaryFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		secondary Adapter
+		wantLog   string
+	}{
+		{
+			"logs secondary errors",
+			&flakyAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}, failures: 1},
+			"secondary adapter Set failed: transient error",
+		},
+		{
+			"logs secondary panics",
+			panickingAdapterMock{},
+			"secondary adapter Set panicked: set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			primary := &adapterMock{store: map[uint64][]byte{}}
+			a := NewMirrorAdapter(primary, tt.secondary, log.New(&logs, "", 0))
+
+			a.Set(1, []byte("value 1"), time.Now().Add(1*time.Minute))
+			if _, ok := primary.store[1]; !ok {
+				t.Error("MirrorAdapter.Set() did not store the primary response")
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("MirrorAdapter.Set() logged %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestMirrorAdapterContext(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	var logs bytes.Buffer
+	primary := &flakyAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}, failures: 1}
+	secondary := &flakyAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}, failures: 1}
+	client, _ := NewClient(&Config{
+		Adapter:    NewMirrorAdapter(primary, secondary, log.New(&logs, "", 0)),
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+		AdapterRetry: RetryPolicy{
+			MaxAttempts: 2,
+			BaseDelay:   1 * time.Millisecond,
+		},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if primary.calls != 3 || len(primary.store) != 1 {
+		t.Errorf("MirrorAdapter primary calls = %v with %v responses, want 3 with 1", primary.calls, len(primary.store))
+	}
+	if want := "secondary adapter SetCtx failed: transient error"; !strings.Contains(logs.String(), want) {
+		t.Errorf("MirrorAdapter.SetCtx() logged %q, want %q", logs.String(), want)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != 302 || w.Body.String() != "new value" {
+		t.Errorf("*Client.Middleware() = %v %v, want 302 new value", w.Code, w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "http://foo.bar/test-1?rk=true", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if len(primary.store) != 0 {
+		t.Errorf("MirrorAdapter.ReleaseCtx() kept %v primary responses, want 0", len(primary.store))
+	}
+}
+
+func TestMirrorAdapterFlush(t *testing.T) {
+	tests := []struct {
+		name          string
+		primary       Adapter
+		secondary     Adapter
+		wantErr       bool
+		wantPrimary   bool
+		wantSecondary bool
+	}{
+		{
+			"flushes both adapters",
+			&flushableAdapterMock{adapterMock{store: map[uint64][]byte{}}},
+			&flushableAdapterMock{adapterMock{store: map[uint64][]byte{}}},
+			false,
+			false,
+			false,
+		},
+		{
+			"flushes the primary adapter only",
+			&flushableAdapterMock{adapterMock{store: map[uint64][]byte{}}},
+			&adapterMock{store: map[uint64][]byte{}},
+			false,
+			false,
+			true,
+		},
+		{
+			"returns error for a primary adapter not supporting flushing",
+			&adapterMock{store: map[uint64][]byte{}},
+			&flushableAdapterMock{adapterMock{store: map[uint64][]byte{}}},
+			true,
+			true,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter: NewMirrorAdapter(tt.primary, tt.secondary, nil),
+				TTL:     1 * time.Minute,
+			})
+			tt.primary.Set(1, []byte("value 1"), time.Now().Add(1*time.Minute))
+			tt.secondary.Set(1, []byte("value 1"), time.Now().Add(1*time.Minute))
+
+			if err := client.Flush(); (err != nil) != tt.wantErr {
+				t.Errorf("*Client.Flush() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := tt.primary.Get(1); ok != tt.wantPrimary {
+				t.Errorf("MirrorAdapter.Flush() kept the primary response = %v, want %v", ok, tt.wantPrimary)
+			}
+			if _, ok := tt.secondary.Get(1); ok != tt.wantSecondary {
+				t.Errorf("MirrorAdapter.Flush() kept the secondary response = %v, want %v", ok, tt.wantSecondary)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// NamespacedAdapter is an adapter wrapper which isolates the responses cached
+// for each namespace, e.g. each tenant of a service, by salting their keys with
+// the namespace. Identical URLs of different namespaces never share a response.
+//
+// The namespace of a call is read from the request context, which the client
+// passes to context adapters. Calls without context, through the Adapter
+// methods, are in the empty namespace, whose keys are left unsalted.
+type NamespacedAdapter struct {
+	Adapter
+	namespace func(context.Context) string
+}
+
+// Get implements the Adapter interface Get method, in the empty namespace.
+func (a *NamespacedAdapter) Get(key uint64) ([]byte, bool) {
+	b, ok, _ := a.GetCtx(context.Background(), key)
+	return b, ok
+}
+
+// Set implements the Adapter interface Set method, in the empty namespace.
+func (a *NamespacedAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	a.SetCtx(context.Background(), key, response, expiration)
+}
+
+// Release implements the Adapter interface Release method, in the empty
+// namespace.
+func (a *NamespacedAdapter) Release(key uint64) {
+	a.ReleaseCtx(context.Background(), key)
+}
+
+// GetCtx implements the ContextAdapter interface GetCtx method, in the
+// namespace of the context.
+func (a *NamespacedAdapter) GetCtx(ctx context.Context, key uint64) ([]byte, bool, error) {
+	key = a.key(ctx, key)
+	if ca, ok := a.Adapter.(ContextAdapter); ok {
+		return ca.GetCtx(ctx, key)
+	}
+
+	b, ok := a.Adapter.Get(key)
+	return b, ok, nil
+}
+
+// SetCtx implements the ContextAdapter interface SetCtx method, in the
+// namespace of the context.
+func (a *NamespacedAdapter) SetCtx(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	key = a.key(ctx, key)
+	if ca, ok := a.Adapter.(ContextAdapter); ok {
+		return ca.SetCtx(ctx, key, response, expiration)
+	}
+
+	a.Adapter.Set(key, response, expiration)
+	return nil
+}
+
+// ReleaseCtx frees the cached response of a key in the namespace of the
+// context.
+func (a *NamespacedAdapter) ReleaseCtx(ctx context.Context, key uint64) error {
+	key = a.key(ctx, key)
+	if cr, ok := a.Adapter.(contextReleaser); ok {
+		return cr.ReleaseCtx(ctx, key)
+	}
+
+	a.Adapter.Release(key)
+	return nil
+}
+
+// key salts a key with the namespace of a context.
+func (a *NamespacedAdapter) key(ctx context.Context, key uint64) uint64 {
+	namespace := a.namespace(ctx)
+	if namespace == "" {
+		return key
+	}
+
+	hash := uint64(offset64)
+	for i := 0; i < len(namespace); i++ {
+		hash ^= uint64(namespace[i])
+		hash *= prime64
+	}
+	for i := uint(0); i < 64; i += 8 {
+		hash ^= (key >> i) & 0xff
+		hash *= prime64
+	}
+
+	return hash
+}
+
+// NewNamespacedAdapter wraps an adapter so that responses are cached in the
+// namespace that a function reads from the request context, e.g. a tenant
+// set by an authentication middleware.
+func NewNamespacedAdapter(adapter Adapter, namespace func(context.Context) string) Adapter {
+	return &NamespacedAdapter{adapter, namespace}
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type tenantKey struct{}
+
+func tenant(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+func TestNamespacedAdapter(t *testing.T) {
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:    NewNamespacedAdapter(adapter, tenant),
+		TTL:        1 * time.Minute,
+		ReleaseKey: "rk",
+	})
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("value of " + tenant(r.Context())))
+	}))
+
+	tests := []struct {
+		name        string
+		tenant      string
+		url         string
+		wantCode    int
+		wantBody    string
+		wantEntries int
+	}{
+		{
+			"caches the response of the first tenant",
+			"a",
+			"http://foo.bar/test-1",
+			200,
+			"value of a",
+			1,
+		},
+		{
+			"does not share the response with the second tenant",
+			"b",
+			"http://foo.bar/test-1",
+			200,
+			"value of b",
+			2,
+		},
+		{
+			"serves the response of the first tenant",
+			"a",
+			"http://foo.bar/test-1",
+			302,
+			"value of a",
+			2,
+		},
+		{
+			"releases the response of the second tenant only",
+			"b",
+			"http://foo.bar/test-1?rk=true",
+			200,
+			"value of b",
+			1,
+		},
+		{
+			"still serves the response of the first tenant",
+			"a",
+			"http://foo.bar/test-1",
+			302,
+			"value of a",
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, tt.tenant))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if len(adapter.store) != tt.wantEntries {
+				t.Errorf("*Client.Middleware() entries = %v, want %v", len(adapter.store), tt.wantEntries)
+			}
+		})
+	}
+}
+
+func TestNamespacedAdapterEmptyNamespace(t *testing.T) {
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	a := NewNamespacedAdapter(adapter, tenant)
+
+	a.Set(1, []byte("value 1"), time.Now().Add(1*time.Minute))
+	if _, ok := adapter.store[1]; !ok {
+		t.Error("NamespacedAdapter.Set() salted a key of the empty namespace")
+	}
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "a")
+	if _, ok, _ := a.(ContextAdapter).GetCtx(ctx, 1); ok {
+		t.Error("NamespacedAdapter.GetCtx() found a key of another namespace")
+	}
+
+	a.Release(1)
+	if len(adapter.store) != 0 {
+		t.Error("NamespacedAdapter.Release() did not release the key")
+	}
+}
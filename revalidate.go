@@ -0,0 +1,111 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// revalidateQueueSize is the maximum number of refreshes waiting for a
+// worker. Refreshes beyond it are dropped; the stale response is still
+// served and the key is queued again by a later request.
+const revalidateQueueSize = 1024
+
+// revalidator runs background refreshes in a bounded pool of workers. Keys
+// already queued or being refreshed are not queued again.
+type revalidator struct {
+	sync.Mutex
+	pending map[uint64]struct{}
+	jobs    chan revalidation
+}
+
+type revalidation struct {
+	key     uint64
+	refresh func()
+}
+
+func newRevalidator(workers int) *revalidator {
+	if workers < 1 {
+		workers = 1
+	}
+
+	rv := &revalidator{
+		pending: make(map[uint64]struct{}),
+		jobs:    make(chan revalidation, revalidateQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go rv.work()
+	}
+
+	return rv
+}
+
+// enqueue queues the refresh of a key, unless it is already pending. It
+// never blocks.
+func (rv *revalidator) enqueue(key uint64, refresh func()) {
+	rv.Lock()
+	defer rv.Unlock()
+
+	if _, ok := rv.pending[key]; ok {
+		return
+	}
+
+	select {
+	case rv.jobs <- revalidation{key, refresh}:
+		rv.pending[key] = struct{}{}
+	default:
+	}
+}
+
+func (rv *revalidator) work() {
+	for job := range rv.jobs {
+		job.refresh()
+
+		rv.Lock()
+		delete(rv.pending, job.key)
+		rv.Unlock()
+	}
+}
+
+// detachedContext is a context keeping the values of a request context, such
+// as the namespace of a NamespacedAdapter, but not its cancellation, which
+// comes with the end of the client response.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
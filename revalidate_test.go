@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		calls       = map[string]int{}
+		running     int
+		maxRunning  int
+		release     = make(chan struct{})
+		refreshDone sync.WaitGroup
+	)
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		w.Write([]byte("new value"))
+		refreshDone.Done()
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:              adapter,
+		TTL:                  1 * time.Minute,
+		StaleWhileRevalidate: 1 * time.Minute,
+		RevalidateWorkers:    2,
+	})
+
+	keys := 10
+	for i := 0; i < keys; i++ {
+		adapter.store[generateKey(fmt.Sprintf("http://foo.bar/test-%v", i))] = Response{
+			Value:      []byte("stale value"),
+			Expiration: time.Now().Add(-1 * time.Second),
+		}.Bytes()
+	}
+
+	handler := client.Middleware(httpTestHandler)
+	refreshDone.Add(keys)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10*keys; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r, _ := http.NewRequest("GET", fmt.Sprintf("http://foo.bar/test-%v", i%keys), nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != 302 || w.Body.String() != "stale value" {
+				t.Errorf("*Client.Middleware() = %v %v, want 302 stale value", w.Code, w.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(release)
+	refreshDone.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if maxRunning > 2 {
+		t.Errorf("concurrent refreshes = %v, want at most 2", maxRunning)
+	}
+	for path, n := range calls {
+		if n != 1 {
+			t.Errorf("refreshes of %v = %v, want 1", path, n)
+		}
+	}
+}
+
+func TestStaleWhileRevalidateExpired(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{
+		store: map[uint64][]byte{
+			14974843192121052621: Response{
+				Value:      []byte("value 1"),
+				Expiration: time.Now().Add(-2 * time.Minute),
+			}.Bytes(),
+		},
+	}
+	client, _ := NewClient(&Config{
+		Adapter:              adapter,
+		TTL:                  1 * time.Minute,
+		StaleWhileRevalidate: 1 * time.Minute,
+	})
+
+	r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+	w := httptest.NewRecorder()
+	client.Middleware(httpTestHandler).ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.String() != "new value" {
+		t.Errorf("*Client.Middleware() = %v %v, want 200 new value", w.Code, w.Body.String())
+	}
+}
+
+func waitRevalidations(c *Client) {
+	for {
+		c.revalidator.Lock()
+		n := len(c.revalidator.pending)
+		c.revalidator.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestSoftAndHardExpiration(t *testing.T) {
+	refreshed := make(chan struct{}, 1)
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+		refreshed <- struct{}{}
+	})
+
+	base := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := Response{
+		Value:          []byte("value 1"),
+		Expiration:     base.Add(1 * time.Minute),
+		HardExpiration: base.Add(2 * time.Minute),
+	}.Bytes()
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:              adapter,
+		TTL:                  1 * time.Minute,
+		StaleWhileRevalidate: 1 * time.Minute,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name          string
+		now           time.Time
+		wantBody      string
+		wantCode      int
+		wantRefreshed bool
+	}{
+		{
+			"within soft ttl serves directly",
+			base.Add(59 * time.Second),
+			"value 1",
+			302,
+			false,
+		},
+		{
+			"between soft and hard ttl serves and revalidates",
+			base.Add(61 * time.Second),
+			"value 1",
+			302,
+			true,
+		},
+		{
+			"past hard ttl is treated as absent",
+			base.Add(121 * time.Second),
+			"new value",
+			200,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter.Set(14974843192121052621, entry, time.Time{})
+			client.now = func() time.Time { return tt.now }
+
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+
+			select {
+			case <-refreshed:
+				if !tt.wantRefreshed {
+					t.Error("*Client.Middleware() called the handler, want no call")
+				}
+				waitRevalidations(client)
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantRefreshed {
+					t.Error("*Client.Middleware() did not call the handler")
+				}
+			}
+		})
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), tenantKey{}, "a"))
+	ctx := detachedContext{parent}
+	cancel()
+
+	if ctx.Err() != nil {
+		t.Errorf("detachedContext.Err() = %v, want nil", ctx.Err())
+	}
+	if tenant(ctx) != "a" {
+		t.Errorf("detachedContext.Value() = %v, want a", tenant(ctx))
+	}
+}
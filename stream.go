@@ -0,0 +1,67 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+// StreamAdapter is implemented by adapters able to cache a response as it is
+// written, e.g. into a file, which avoids a copy of large bodies in memory.
+// The bytes written are decoded by BytesToResponse, so Get returns them as
+// they were written.
+type StreamAdapter interface {
+	Adapter
+
+	// SetStream returns a writer of the response to be cached for a given
+	// key until an expiration date. The response is cached once the writer
+	// is closed without error.
+	SetStream(key uint64, expiration time.Time) io.WriteCloser
+}
+
+// stream caches a response through a stream adapter: the response without its
+// body is encoded first, then the body is written as is, without being copied
+// into the encoding. Failures are logged and the response is not cached.
+func (c *Client) stream(sa StreamAdapter, key uint64, response Response) {
+	defer c.recoverAdapter("SetStream")
+
+	body := response.Value
+	response.Value = nil
+
+	wc := sa.SetStream(key, c.retention(response))
+	err := gob.NewEncoder(wc).Encode(&response)
+	if err == nil {
+		_, err = wc.Write(body)
+	}
+	if cerr := wc.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		c.logf("cache: adapter SetStream failed: %v", err)
+	}
+}
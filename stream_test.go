@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamAdapterMock struct {
+	adapterMock
+	failure error
+	sets    int
+}
+
+type streamWriterMock struct {
+	bytes.Buffer
+	a   *streamAdapterMock
+	key uint64
+}
+
+func (w *streamWriterMock) Close() error {
+	if w.a.failure != nil {
+		return w.a.failure
+	}
+	w.a.adapterMock.Set(w.key, w.Bytes(), time.Time{})
+	return nil
+}
+
+func (a *streamAdapterMock) Set(key uint64, response []byte, expiration time.Time) {
+	a.sets++
+	a.adapterMock.Set(key, response, expiration)
+}
+
+func (a *streamAdapterMock) SetStream(key uint64, expiration time.Time) io.WriteCloser {
+	return &streamWriterMock{a: a, key: key}
+}
+
+func TestMiddlewareStreamAdapter(t *testing.T) {
+	tests := []struct {
+		name       string
+		failure    error
+		wantCached bool
+		wantLog    string
+	}{
+		{
+			"streams responses to the adapter",
+			nil,
+			true,
+			"",
+		},
+		{
+			"logs stream failures",
+			errors.New("disk full"),
+			false,
+			"adapter SetStream failed: disk full",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			adapter := &streamAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}, failure: tt.failure}
+			client, _ := NewClient(&Config{
+				Adapter:  adapter,
+				TTL:      1 * time.Minute,
+				ErrorLog: log.New(&logs, "", 0),
+			})
+			handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("new value"))
+			}))
+
+			for _, wantCode := range []int{200, 302} {
+				if !tt.wantCached {
+					wantCode = 200
+				}
+
+				r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != wantCode || w.Body.String() != "new value" {
+					t.Errorf("*Client.Middleware() = %v %v, want %v new value", w.Code, w.Body.String(), wantCode)
+				}
+				if w.Header().Get("Content-Type") != "text/plain" {
+					t.Errorf("*Client.Middleware() Content-Type = %v, want text/plain", w.Header().Get("Content-Type"))
+				}
+			}
+			if adapter.sets != 0 {
+				t.Errorf("*Client.Middleware() Set calls = %v, want 0", adapter.sets)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("*Client.Middleware() logged %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+type discardStreamAdapterMock struct {
+	adapterMock
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (a *discardStreamAdapterMock) SetStream(key uint64, expiration time.Time) io.WriteCloser {
+	return nopWriteCloser{ioutil.Discard}
+}
+
+func TestStreamAllocation(t *testing.T) {
+	response := Response{
+		Value:      bytes.Repeat([]byte("a"), 8<<20),
+		Expiration: time.Now().Add(1 * time.Minute),
+	}
+
+	allocated := func(adapter Adapter) uint64 {
+		client, _ := NewClient(&Config{Adapter: adapter, TTL: 1 * time.Minute})
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		client.store(context.Background(), 1, response)
+		runtime.ReadMemStats(&after)
+
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	buffered := allocated(&adapterMock{store: map[uint64][]byte{}})
+	streamed := allocated(&discardStreamAdapterMock{})
+	if buffered < uint64(len(response.Value)) || streamed > uint64(len(response.Value))/8 {
+		t.Errorf("*Client.store() allocated %v bytes streamed, %v buffered", streamed, buffered)
+	}
+}
+
+func TestBytesToResponseStreamed(t *testing.T) {
+	adapter := &streamAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}}
+	client, _ := NewClient(&Config{Adapter: adapter, TTL: 1 * time.Minute})
+	client.stream(adapter, 1, Response{Value: []byte("value 1"), Frequency: 2})
+
+	r := BytesToResponse(adapter.store[1])
+	if string(r.Value) != "value 1" || r.Frequency != 2 {
+		t.Errorf("BytesToResponse() = %v %v, want value 1 2", string(r.Value), r.Frequency)
+	}
+}
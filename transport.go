@@ -0,0 +1,144 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// roundTripper caches the responses of outbound requests with the client.
+type roundTripper struct {
+	c    *Client
+	next http.RoundTripper
+}
+
+// RoundTripper returns an http.RoundTripper caching the responses of next,
+// or of http.DefaultTransport if next is nil, the way Middleware caches
+// the responses of a handler. Cached responses are served while fresh.
+func (c *Client) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &roundTripper{c: c, next: next}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, event, err := t.roundTrip(req)
+
+	if err == nil && t.c.onEvent != nil {
+		event.Request = req
+		event.Duration = time.Since(start)
+		t.c.onEvent(event)
+	}
+
+	return resp, err
+}
+
+func (t *roundTripper) roundTrip(req *http.Request) (*http.Response, CacheEvent, error) {
+	c := t.c
+	if !c.cacheableRequest(req) {
+		resp, err := t.next.RoundTrip(req)
+		return resp, CacheEvent{Status: StatusBypass}, err
+	}
+
+	key := c.requestKey(req)
+	if variant, response, ok := c.lookupResponse(req, key); ok {
+		now := c.clock()
+
+		if response.Expiration.After(now) && !c.exceedsMaxAge(response, now) &&
+			!c.revalidationRequested(req, response, now) {
+			response.LastAccess = now
+			response.Frequency++
+			c.store(req.Context(), variant, response)
+
+			if c.afterLoad != nil {
+				c.afterLoad(&response, req)
+			}
+
+			event := CacheEvent{Key: variant, Status: StatusHit, Size: len(response.Value)}
+			return cachedResponse(req, response), event, nil
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, CacheEvent{}, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, CacheEvent{}, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	status := c.status(resp)
+	skip := c.skipRequested(resp.Header)
+	response := c.newResponse(req, resp.StatusCode, resp.Header, body, c.clock())
+	response.Trailer = storedTrailer(resp.Trailer)
+	if !skip && c.cacheable(req, status, response) {
+		c.storeVaried(req, key, response)
+	}
+
+	event := CacheEvent{
+		Key:          key,
+		Status:       StatusMiss,
+		Size:         len(body),
+		BackendError: classify(status) == classError,
+	}
+	return resp, event, nil
+}
+
+// cachedResponse synthesizes the response to req from a cached one.
+func cachedResponse(req *http.Request, response Response) *http.Response {
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	body := response.Value
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        sharedHeader(response.Header, nil),
+		Trailer:       storedTrailer(response.Trailer),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(response.Value)),
+		Request:       req,
+	}
+}
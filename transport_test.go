@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRoundTripper(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte("new value"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantCode  int
+		wantBody  string
+		wantCalls int
+	}{
+		{
+			"caches the response",
+			"GET",
+			"/test-1",
+			http.StatusCreated,
+			"new value",
+			1,
+		},
+		{
+			"serves head without body",
+			"HEAD",
+			"/test-1",
+			http.StatusCreated,
+			"",
+			1,
+		},
+		{
+			"does not cache error responses",
+			"GET",
+			"/missing",
+			http.StatusNotFound,
+			"new value",
+			2,
+		},
+		{
+			"does not cache post requests",
+			"POST",
+			"/test-1",
+			http.StatusCreated,
+			"new value",
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			client, _ := NewClient(&Config{
+				Adapter: &adapterMock{store: map[uint64][]byte{}},
+				TTL:     1 * time.Minute,
+			})
+			httpClient := &http.Client{Transport: client.RoundTripper(nil)}
+
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+				resp, err := httpClient.Do(req)
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if resp.StatusCode != tt.wantCode || string(body) != tt.wantBody {
+					t.Errorf("RoundTrip() = %v %v, want %v %v", resp.StatusCode, string(body), tt.wantCode, tt.wantBody)
+				}
+				if got := resp.Header.Get("Content-Type"); got != "text/plain" {
+					t.Errorf("RoundTrip() Content-Type = %v, want text/plain", got)
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("RoundTrip() origin calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRoundTripperExpired(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("new value"))
+	}))
+	defer server.Close()
+
+	client, _ := NewClient(&Config{
+		Adapter: &adapterMock{store: map[uint64][]byte{}},
+		TTL:     1 * time.Minute,
+	})
+	httpClient := &http.Client{Transport: client.RoundTripper(http.DefaultTransport)}
+
+	for i := 0; i < 2; i++ {
+		client.now = func() time.Time { return time.Now().Add(time.Duration(i) * time.Hour) }
+		resp, err := httpClient.Get(server.URL + "/test-1")
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		resp.Body.Close()
+	}
+	if calls != 2 {
+		t.Errorf("RoundTrip() origin calls = %v, want 2", calls)
+	}
+}
+
+func TestRoundTripperStatusFunc(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if status := r.URL.Query().Get("upstream"); status != "" {
+			w.Header().Set("X-Upstream-Status", status)
+		}
+		w.Write([]byte("new value"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name             string
+		query            string
+		wantCalls        int
+		wantBackendError bool
+	}{
+		{
+			"upstream error is not cached",
+			"upstream=502",
+			2,
+			true,
+		},
+		{
+			"upstream success is cached",
+			"upstream=200",
+			1,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			var events []CacheEvent
+			client, _ := NewClient(&Config{
+				Adapter: &adapterMock{store: map[uint64][]byte{}},
+				TTL:     1 * time.Minute,
+				StatusFunc: func(res *http.Response) int {
+					if status, err := strconv.Atoi(res.Header.Get("X-Upstream-Status")); err == nil {
+						return status
+					}
+					return res.StatusCode
+				},
+				OnEvent: func(e CacheEvent) {
+					events = append(events, e)
+				},
+			})
+			httpClient := &http.Client{Transport: client.RoundTripper(nil)}
+
+			for i := 0; i < 2; i++ {
+				resp, err := httpClient.Get(server.URL + "/test-1?" + tt.query)
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("RoundTrip() = %v, want %v", resp.StatusCode, http.StatusOK)
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("RoundTrip() origin calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if events[0].BackendError != tt.wantBackendError {
+				t.Errorf("RoundTrip() BackendError = %v, want %v", events[0].BackendError, tt.wantBackendError)
+			}
+		})
+	}
+}
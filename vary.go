@@ -0,0 +1,373 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptedMediaType returns the media type preferred by an Accept header,
+// without parameters. Wildcards return an empty string, since they accept
+// whatever representation the origin picks by default. Media ranges such as
+// text/* are returned as is: they are not resolved to the Content-Type the
+// origin serves for them, so each one is cached as a variant of its own.
+func acceptedMediaType(accept string) string {
+	v := preferred(accept)
+	if v == "*/*" || v == "*" {
+		return ""
+	}
+
+	return v
+}
+
+// acceptedBucket returns the media type of a bucket an Accept header prefers,
+// among the listed ones, or an empty string when it lists none of them.
+// Wildcards match no bucket, so that e.g. */* shares the default entry.
+func acceptedBucket(accept string, buckets []string) string {
+	values := qualityValues(accept)
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+
+	for _, v := range values {
+		for _, b := range buckets {
+			if v.token == b {
+				return b
+			}
+		}
+	}
+
+	return ""
+}
+
+// acceptedLanguage returns the normalized language tag preferred by an
+// Accept-Language header, e.g. en-us for en_US. Wildcards and malformed tags
+// return an empty string.
+func acceptedLanguage(acceptLanguage string) string {
+	tag := strings.Replace(preferred(acceptLanguage), "_", "-", -1)
+	if tag == "" {
+		return ""
+	}
+
+	for i, subtag := range strings.Split(tag, "-") {
+		if len(subtag) < 1 || len(subtag) > 8 {
+			return ""
+		}
+		for _, c := range subtag {
+			if c >= 'a' && c <= 'z' || i > 0 && c >= '0' && c <= '9' {
+				continue
+			}
+			return ""
+		}
+	}
+
+	return tag
+}
+
+// lookupResponse retrieves the cached response of a request as lookup does,
+// and returns it decoded along with the key it is cached under: the one of the
+// variant matching the request headers when the key of the request holds a
+// Vary index.
+func (c *Client) lookupResponse(r *http.Request, key uint64) (uint64, Response, bool) {
+	b, ok := c.lookup(r, key)
+	if !ok {
+		return key, Response{}, false
+	}
+
+	return c.variant(r, key, c.decode(b), func(k uint64) ([]byte, bool) {
+		return c.lookup(r, k)
+	})
+}
+
+// variant returns the variant of a response matching the request headers,
+// retrieved by get, when the response is a Vary index, or else the response
+// itself, along with the key it is cached under.
+func (c *Client) variant(r *http.Request, key uint64, response Response, get func(uint64) ([]byte, bool)) (uint64, Response, bool) {
+	if response.Vary == nil {
+		return key, response, c.verified(key, response)
+	}
+
+	key = varyKey(r, key, response.Vary)
+	b, ok := get(key)
+	if !ok {
+		return key, Response{}, false
+	}
+
+	response = c.decode(b)
+	return key, response, c.verified(key, response)
+}
+
+// storeVaried caches a response served by next for a request, once
+// transformed by the BeforeStore hook. Responses varying on request headers,
+// by their Vary header or DefaultVary, are cached under the key of their
+// variant, listed by a Vary index cached under the key of the request.
+// Responses with Vary: * are never cached, since no request matches them.
+func (c *Client) storeVaried(r *http.Request, key uint64, response Response) {
+	vary, ok := c.vary(response.Header)
+	if !ok {
+		return
+	}
+	if len(vary) == 0 {
+		c.storeNew(r.Context(), key, response)
+		return
+	}
+
+	index := Response{
+		Vary:           vary,
+		LastAccess:     c.clock(),
+		Expiration:     response.Expiration,
+		HardExpiration: c.hardExpiration(response),
+		StaleIfError:   response.StaleIfError,
+	}
+	if b, ok := c.get(r.Context(), key); ok {
+		if prev := c.decode(b); equalStrings(prev.Vary, vary) {
+			index.Variants = prev.Variants
+			if c.retention(prev).After(c.retention(index)) {
+				index.Expiration, index.HardExpiration, index.StaleIfError =
+					prev.Expiration, prev.HardExpiration, prev.StaleIfError
+			}
+		}
+	}
+
+	variant := varyKey(r, key, vary)
+	if !containsKey(index.Variants, variant) {
+		if c.maxVaryVariants > 0 && len(index.Variants) >= c.maxVaryVariants {
+			return
+		}
+		index.Variants = append(index.Variants, variant)
+	}
+
+	c.store(r.Context(), key, index)
+	c.storeNew(r.Context(), variant, response)
+}
+
+// vary returns the request headers a response varies on: the ones listed by
+// its Vary header and the DefaultVary ones, canonical and sorted. It returns
+// false when the response varies on *.
+func (c *Client) vary(header http.Header) ([]string, bool) {
+	keys := append([]string(nil), c.defaultVary...)
+	for _, v := range header["Vary"] {
+		for _, k := range strings.Split(v, ",") {
+			k = strings.TrimSpace(k)
+			if k == "*" {
+				return nil, false
+			}
+			if k != "" {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	return canonicalHeaderKeys(keys), true
+}
+
+// varyKey returns the key of the variant of a response matching the values of
+// the request headers it varies on.
+func varyKey(r *http.Request, key uint64, vary []string) uint64 {
+	return generateKey(strconv.FormatUint(key, 16) + "\x00vary\x00" + headerValues(r.Header, vary))
+}
+
+// equalStrings reports whether two lists of strings are equal.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsKey reports whether a list of keys contains a key.
+func containsKey(keys []uint64, key uint64) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptedEncoding returns the content coding an Accept-Encoding header
+// accepts best among the supported ones, listed by order of preference, or
+// identity when it accepts none of them. Listed codings take precedence over
+// the wildcard, so that gzip;q=0, * refuses gzip.
+func acceptedEncoding(acceptEncoding string, supported []string) string {
+	values := parseQualityValues(acceptEncoding)
+	best, bestQ := "identity", 0.0
+	for _, encoding := range supported {
+		q, explicit := 0.0, false
+		for _, v := range values {
+			if v.token == encoding {
+				q, explicit = v.q, true
+				break
+			}
+			if v.token == "*" && !explicit {
+				q = v.q
+			}
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// lowerTokens returns a lowercased copy of a list of tokens.
+func lowerTokens(tokens []string) []string {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	lower := make([]string, len(tokens))
+	for i, t := range tokens {
+		lower[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+
+	return lower
+}
+
+// preferred returns the value with the highest quality of a header such as
+// Accept, lowercased and stripped of its parameters. Values with the same
+// quality keep their order. Values with a zero quality are never returned.
+func preferred(header string) string {
+	values := qualityValues(header)
+	if len(values) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+
+	return values[0].token
+}
+
+// accepts reports whether a header such as Accept-Encoding lists a token, or
+// a wildcard, with a non-zero quality.
+func accepts(header, token string) bool {
+	for _, v := range qualityValues(header) {
+		if v.token == token || v.token == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// qualityValue is a value of a header such as Accept with its quality.
+type qualityValue struct {
+	token string
+	q     float64
+}
+
+// qualityValues returns the values of a header such as Accept, lowercased and
+// stripped of their parameters, in order. Values with a zero quality are
+// omitted.
+func qualityValues(header string) []qualityValue {
+	var values []qualityValue
+	for _, v := range parseQualityValues(header) {
+		if v.q > 0 {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// parseQualityValues returns the values of a header such as Accept as
+// qualityValues does, including the ones with a zero quality.
+func parseQualityValues(header string) []qualityValue {
+	var values []qualityValue
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		token := strings.ToLower(strings.TrimSpace(params[0]))
+		if token == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") || strings.HasPrefix(p, "Q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		values = append(values, qualityValue{token, q})
+	}
+
+	return values
+}
+
+// canonicalHeaderKeys returns the sorted canonical form of a list of header
+// keys, without duplicates.
+func canonicalHeaderKeys(keys []string) []string {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(keys))
+	canonical := make([]string, 0, len(keys))
+	for _, k := range keys {
+		k = http.CanonicalHeaderKey(k)
+		if !seen[k] {
+			seen[k] = true
+			canonical = append(canonical, k)
+		}
+	}
+	sort.Strings(canonical)
+
+	return canonical
+}
+
+// headerValues returns the normalized values of the given headers, in a form
+// to be folded into a cache key. Keys must be canonical and sorted.
+func headerValues(header http.Header, keys []string) string {
+	var b bytes.Buffer
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		for i, v := range header[k] {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strings.ToLower(strings.TrimSpace(v)))
+		}
+		b.WriteByte('\x00')
+	}
+
+	return b.String()
+}
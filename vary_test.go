@@ -0,0 +1,734 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareVaryAccept(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "application/xml" {
+			w.Write([]byte("<value/>"))
+			return
+		}
+		w.Write([]byte(`"value"`))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:    adapter,
+		TTL:        1 * time.Minute,
+		VaryAccept: true,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name     string
+		accept   string
+		wantBody string
+		wantCode int
+	}{
+		{
+			"json is not cached",
+			"application/json",
+			`"value"`,
+			200,
+		},
+		{
+			"xml is not cached",
+			"application/xml",
+			"<value/>",
+			200,
+		},
+		{
+			"json is cached",
+			"application/json",
+			`"value"`,
+			302,
+		},
+		{
+			"xml is cached",
+			"application/xml",
+			"<value/>",
+			302,
+		},
+		{
+			"q-values select the cached xml",
+			"application/json;q=0.5, application/xml",
+			"<value/>",
+			302,
+		},
+		{
+			"wildcard is not cached",
+			"*/*;q=0.8",
+			`"value"`,
+			200,
+		},
+		{
+			"request without accept shares the wildcard entry",
+			"",
+			`"value"`,
+			302,
+		},
+		{
+			"media range is not resolved to the cached json",
+			"application/*",
+			`"value"`,
+			200,
+		},
+		{
+			"media range is cached",
+			"application/*;q=0.9",
+			`"value"`,
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-accept", nil)
+			r.Header.Set("Accept", tt.accept)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareVaryAcceptBuckets(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte(r.Header.Get("Accept")))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:           adapter,
+		TTL:               1 * time.Minute,
+		VaryAcceptBuckets: []string{"application/json", "text/html"},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name     string
+		accept   string
+		wantBody string
+		wantCode int
+	}{
+		{
+			"json is not cached",
+			"application/json",
+			"application/json",
+			200,
+		},
+		{
+			"html is not cached",
+			"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			200,
+		},
+		{
+			"other types are not cached",
+			"*/*",
+			"*/*",
+			200,
+		},
+		{
+			"json is cached",
+			"application/json, text/plain, */*",
+			"application/json",
+			302,
+		},
+		{
+			"html is cached",
+			"text/html",
+			"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			302,
+		},
+		{
+			"other types share the default entry",
+			"image/png",
+			"*/*",
+			302,
+		},
+		{
+			"missing value shares the default entry",
+			"",
+			"*/*",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-bucket", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+
+	if counter != 3 {
+		t.Errorf("*Client.Middleware() handler calls = %v, want 3", counter)
+	}
+}
+
+func TestMiddlewareVaryAcceptLanguage(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:            adapter,
+		TTL:                1 * time.Minute,
+		VaryAcceptLanguage: true,
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		wantBody       string
+		wantCode       int
+	}{
+		{
+			"en-US is not cached",
+			"en-US,en;q=0.9",
+			"en-US,en;q=0.9",
+			200,
+		},
+		{
+			"fr-FR is not cached",
+			"fr-FR",
+			"fr-FR",
+			200,
+		},
+		{
+			"normalized en_us is cached",
+			"en_us",
+			"en-US,en;q=0.9",
+			302,
+		},
+		{
+			"malformed value is not cached",
+			"en-US!!",
+			"en-US!!",
+			200,
+		},
+		{
+			"other malformed value falls back to the same entry",
+			";;;",
+			"en-US!!",
+			302,
+		},
+		{
+			"missing value falls back to the same entry",
+			"",
+			"en-US!!",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-language", nil)
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAcceptedLanguage(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"en-US", "en-us"},
+		{"en_US", "en-us"},
+		{"fr-FR;q=0.5, de;q=0.8", "de"},
+		{"zh-Hant-TW", "zh-hant-tw"},
+		{"es-419", "es-419"},
+		{"*", ""},
+		{"en-US!!", ""},
+		{"0en", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptLanguage, func(t *testing.T) {
+			if got := acceptedLanguage(tt.acceptLanguage); got != tt.want {
+				t.Errorf("acceptedLanguage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br;q=1.0", "br"},
+		{"gzip, deflate", "gzip"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip;q=0.8, *;q=0.1", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate, compress", "identity"},
+		{"gzip;q=0, br;q=0", "identity"},
+		{"identity", "identity"},
+		{"*", "br"},
+		{"gzip;q=0, *", "br"},
+		{"", "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			if got := acceptedEncoding(tt.acceptEncoding, []string{"br", "gzip"}); got != tt.want {
+				t.Errorf("acceptedEncoding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareVaryAcceptEncoding(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte(r.Header.Get("Accept-Encoding")))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:            adapter,
+		TTL:                1 * time.Minute,
+		VaryAcceptEncoding: []string{"BR", "gzip"},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantBody       string
+		wantCode       int
+	}{
+		{
+			"br is not cached",
+			"gzip, deflate, br",
+			"gzip, deflate, br",
+			200,
+		},
+		{
+			"other header accepting br is cached",
+			"br;q=1.0, gzip;q=0.8",
+			"gzip, deflate, br",
+			302,
+		},
+		{
+			"gzip is not cached",
+			"gzip, deflate",
+			"gzip, deflate",
+			200,
+		},
+		{
+			"identity is not cached",
+			"deflate",
+			"deflate",
+			200,
+		},
+		{
+			"missing value falls back to identity",
+			"",
+			"deflate",
+			302,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-encoding", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+
+	if counter != 3 {
+		t.Errorf("*Client.Middleware() handler calls = %v, want 3", counter)
+	}
+}
+
+func TestMiddlewareVary(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language") + " " + r.Header.Get("Accept-Encoding")))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:         adapter,
+		TTL:             1 * time.Minute,
+		DefaultVary:     []string{"accept-encoding"},
+		MaxVaryVariants: 3,
+		ReleaseKey:      "rk",
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name           string
+		url            string
+		acceptLanguage string
+		acceptEncoding string
+		wantBody       string
+		wantCode       int
+	}{
+		{
+			"first variant is not cached",
+			"http://foo.bar/test-vary",
+			"en",
+			"gzip",
+			"en gzip",
+			200,
+		},
+		{
+			"first variant is cached",
+			"http://foo.bar/test-vary",
+			"en",
+			"gzip",
+			"en gzip",
+			302,
+		},
+		{
+			"default vary adds a variant",
+			"http://foo.bar/test-vary",
+			"en",
+			"br",
+			"en br",
+			200,
+		},
+		{
+			"origin vary adds a variant",
+			"http://foo.bar/test-vary",
+			"fr",
+			"gzip",
+			"fr gzip",
+			200,
+		},
+		{
+			"variant past the limit is not cached",
+			"http://foo.bar/test-vary",
+			"de",
+			"gzip",
+			"de gzip",
+			200,
+		},
+		{
+			"variant past the limit is still not cached",
+			"http://foo.bar/test-vary",
+			"de",
+			"gzip",
+			"de gzip",
+			200,
+		},
+		{
+			"other variant is cached",
+			"http://foo.bar/test-vary",
+			"fr",
+			"gzip",
+			"fr gzip",
+			302,
+		},
+		{
+			"release frees every variant",
+			"http://foo.bar/test-vary?rk=true",
+			"",
+			"",
+			" ",
+			200,
+		},
+		{
+			"released variant is not cached",
+			"http://foo.bar/test-vary",
+			"fr",
+			"gzip",
+			"fr gzip",
+			200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestVary(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultVary []string
+		vary        []string
+		want        []string
+		wantOK      bool
+	}{
+		{
+			"merges the default vary",
+			[]string{"accept-encoding"},
+			[]string{"Accept-Language, Accept-Encoding", "x-device"},
+			[]string{"Accept-Encoding", "Accept-Language", "X-Device"},
+			true,
+		},
+		{
+			"applies the default vary alone",
+			[]string{"Accept-Encoding"},
+			nil,
+			[]string{"Accept-Encoding"},
+			true,
+		},
+		{
+			"does not vary by default",
+			nil,
+			nil,
+			nil,
+			true,
+		},
+		{
+			"rejects vary on anything",
+			[]string{"Accept-Encoding"},
+			[]string{"Accept-Language, *"},
+			nil,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := NewClient(&Config{
+				Adapter:     &adapterMock{store: map[uint64][]byte{}},
+				TTL:         1 * time.Minute,
+				DefaultVary: tt.defaultVary,
+			})
+
+			got, ok := client.vary(http.Header{"Vary": tt.vary})
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("*Client.vary() = %v %v, want %v %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{
+			"accepts listed token",
+			"br, GZIP;q=0.5",
+			true,
+		},
+		{
+			"accepts wildcard",
+			"*",
+			true,
+		},
+		{
+			"rejects zero quality",
+			"gzip;q=0, br",
+			false,
+		},
+		{
+			"rejects unlisted token",
+			"deflate",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := accepts(tt.header, "gzip"); got != tt.want {
+				t.Errorf("accepts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareKeyHeaders(t *testing.T) {
+	counter := 0
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Write([]byte("new value"))
+	})
+
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(&Config{
+		Adapter:    adapter,
+		TTL:        1 * time.Minute,
+		KeyHeaders: []string{"x-locale", "X-Device"},
+	})
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name        string
+		header      http.Header
+		wantCode    int
+		wantCounter int
+	}{
+		{
+			"first variant is not cached",
+			http.Header{"X-Device": {"mobile"}, "X-Locale": {"en"}},
+			200,
+			1,
+		},
+		{
+			"keyed header creates a new entry",
+			http.Header{"X-Device": {"desktop"}, "X-Locale": {"en"}},
+			200,
+			2,
+		},
+		{
+			"non-keyed header shares the entry",
+			http.Header{"X-Device": {"mobile"}, "X-Locale": {"en"}, "X-Other": {"1"}},
+			302,
+			2,
+		},
+		{
+			"keyed header values are normalized",
+			http.Header{"X-Device": {" Mobile"}, "X-Locale": {"EN "}},
+			302,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-headers", nil)
+			r.Header = tt.header
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
+			}
+			if counter != tt.wantCounter {
+				t.Errorf("*Client.Middleware() handler calls = %v, want %v", counter, tt.wantCounter)
+			}
+		})
+	}
+
+	if len(adapter.store) != 2 {
+		t.Errorf("*Client.Middleware() entries = %v, want 2", len(adapter.store))
+	}
+}
+
+func TestAcceptedMediaType(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{
+			"single media type",
+			"application/json",
+			"application/json",
+		},
+		{
+			"parameters are stripped",
+			"Application/JSON; charset=utf-8",
+			"application/json",
+		},
+		{
+			"highest quality wins",
+			"text/html;q=0.8, application/xml;q=0.9",
+			"application/xml",
+		},
+		{
+			"order breaks ties",
+			"application/json, application/xml",
+			"application/json",
+		},
+		{
+			"zero quality is refused",
+			"application/json;q=0, application/xml;q=0.1",
+			"application/xml",
+		},
+		{
+			"wildcard",
+			"*/*",
+			"",
+		},
+		{
+			"wildcard with quality",
+			"*/*;q=0.8",
+			"",
+		},
+		{
+			"bare wildcard",
+			"*",
+			"",
+		},
+		{
+			"media type preferred to a wildcard",
+			"*/*;q=0.1, application/json",
+			"application/json",
+		},
+		{
+			"media range is kept",
+			"Text/*; q=0.9",
+			"text/*",
+		},
+		{
+			"media range preferred to a media type",
+			"application/*, application/json;q=0.5",
+			"application/*",
+		},
+		{
+			"empty",
+			"",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acceptedMediaType(tt.accept); got != tt.want {
+				t.Errorf("acceptedMediaType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}